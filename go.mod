@@ -2,7 +2,4 @@ module order-matching-engine
 
 go 1.25.3
 
-require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
-)
+require github.com/gorilla/mux v1.8.1
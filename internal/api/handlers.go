@@ -2,38 +2,48 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
 	"net/http"
 	"order-matching-engine/internal/engine"
+	"order-matching-engine/internal/snapshot"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
-    "sort"
-	"github.com/gorilla/mux"
 )
 
 // Server holds the HTTP server and matching engine
 type Server struct {
-	engine         *engine.MatchingEngine
-	router         *mux.Router
-	startTime      time.Time
-	ordersReceived atomic.Int64
-	ordersMatched  atomic.Int64
+	engine          *engine.MatchingEngine
+	router          *mux.Router
+	startTime       time.Time
+	ordersReceived  atomic.Int64
+	ordersMatched   atomic.Int64
 	ordersCancelled atomic.Int64
-	tradesExecuted atomic.Int64
+	ordersRejected  atomic.Int64
+	ordersExpired   atomic.Int64
+	tradesExecuted  atomic.Int64
 	latencies       []time.Duration
 	latenciesMutex  sync.Mutex
+	snapshots       *snapshot.Snapshotter // nil unless persistence is enabled
 }
 
-// NewServer creates a new API server
-func NewServer() *Server {
+// NewServer creates a new API server. Options are passed to the matching
+// engine.
+func NewServer(opts ...engine.Option) *Server {
 	s := &Server{
-		engine:    engine.NewMatchingEngine(),
 		router:    mux.NewRouter(),
 		startTime: time.Now(),
-		latencies: make([]time.Duration, 0, 100000), 
+		latencies: make([]time.Duration, 0, 100000),
 	}
 
+	opts = append(opts, engine.WithExpiryHandler(func(engine.Order) {
+		s.ordersExpired.Add(1)
+	}))
+	s.engine = engine.NewMatchingEngine(opts...)
+
 	// Register routes
 	s.registerRoutes()
 
@@ -46,9 +56,30 @@ func (s *Server) registerRoutes() {
 	api := s.router.PathPrefix("/api/v1").Subrouter()
 
 	api.HandleFunc("/orders", s.handleSubmitOrder).Methods("POST")
+	api.HandleFunc("/orders", s.handleMassCancel).Methods("DELETE")
+	api.HandleFunc("/orders/client/{client_order_id}", s.handleCancelOrderByClientID).Methods("DELETE")
+	api.HandleFunc("/orders/client/{client_order_id}", s.handleGetOrderByClientID).Methods("GET")
 	api.HandleFunc("/orders/{order_id}", s.handleCancelOrder).Methods("DELETE")
+	api.HandleFunc("/orders/{order_id}", s.handleReplaceOrder).Methods("PATCH")
 	api.HandleFunc("/orders/{order_id}", s.handleGetOrder).Methods("GET")
 	api.HandleFunc("/orderbook/{symbol}", s.handleGetOrderBook).Methods("GET")
+	api.HandleFunc("/trades/{symbol}", s.handleGetTrades).Methods("GET")
+	api.HandleFunc("/events/{symbol}", s.handleGetEvents).Methods("GET")
+	api.HandleFunc("/accounts/{account_id}/orders", s.handleGetAccountOrders).Methods("GET")
+	api.HandleFunc("/accounts/{account_id}/trades", s.handleGetAccountTrades).Methods("GET")
+	api.HandleFunc("/accounts/{account_id}/self-trade-prevention", s.handleSetSelfTradePrevention).Methods("PUT")
+	api.HandleFunc("/accounts/{account_id}/balances", s.handleGetBalances).Methods("GET")
+	api.HandleFunc("/accounts/{account_id}/deposit", s.handleDeposit).Methods("POST")
+	api.HandleFunc("/accounts/{account_id}/withdraw", s.handleWithdraw).Methods("POST")
+	api.HandleFunc("/admin/risk/accounts/{account_id}", s.handleGetAccountRiskLimits).Methods("GET")
+	api.HandleFunc("/admin/risk/accounts/{account_id}", s.handleSetAccountRiskLimits).Methods("PUT")
+	api.HandleFunc("/admin/risk/symbols/{symbol}", s.handleGetSymbolRiskLimits).Methods("GET")
+	api.HandleFunc("/admin/risk/symbols/{symbol}", s.handleSetSymbolRiskLimits).Methods("PUT")
+	api.HandleFunc("/admin/fees", s.handleGetFeeSchedules).Methods("GET")
+	api.HandleFunc("/admin/fees", s.handleSetFeeSchedule).Methods("PUT")
+	api.HandleFunc("/admin/fees/accounts/{account_id}", s.handleSetAccountFeeTier).Methods("PUT")
+	api.HandleFunc("/fees/revenue", s.handleGetFeeRevenue).Methods("GET")
+	api.HandleFunc("/admin/snapshots", s.handleTakeSnapshot).Methods("POST")
 
 	// Health and metrics
 	s.router.HandleFunc("/health", s.handleHealth).Methods("GET")
@@ -57,18 +88,37 @@ func (s *Server) registerRoutes() {
 
 // SubmitOrderRequest represents the JSON request body
 type SubmitOrderRequest struct {
-	Symbol   string `json:"symbol"`
-	Side     string `json:"side"`
-	Type     string `json:"type"`
-	Price    int64  `json:"price,omitempty"`
-	Quantity int64  `json:"quantity"`
+	// ClientOrderID is optional; retrying a request with the same ID returns
+	// the original result instead of creating a duplicate order
+	ClientOrderID string `json:"client_order_id,omitempty"`
+	AccountID     string `json:"account_id"`
+
+	Symbol      string `json:"symbol"`
+	Side        string `json:"side"`
+	Type        string `json:"type"`
+	Price       int64  `json:"price,omitempty"`
+	StopPrice   int64  `json:"stop_price,omitempty"`
+	TrailAmount int64  `json:"trail_amount,omitempty"`
+	TrailBps    int64  `json:"trail_bps,omitempty"`
+	Quantity    int64  `json:"quantity"`
+	// DisplayQuantity turns a limit order into an iceberg showing only
+	// this much of its size in the book
+	DisplayQuantity int64  `json:"display_quantity,omitempty"`
+	TimeInForce     string `json:"time_in_force,omitempty"`
+	ExpireAt        int64  `json:"expire_at,omitempty"` // Unix milliseconds, GTD only
+	PostOnly        bool   `json:"post_only,omitempty"`
+	// RepriceOnCross moves a crossing post-only order one tick behind the
+	// touch instead of rejecting it
+	RepriceOnCross bool `json:"reprice_on_cross,omitempty"`
+	// SelfTradePrevention overrides the account's default mode:
+	// CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL
+	SelfTradePrevention string `json:"self_trade_prevention,omitempty"`
 }
 
 // handleSubmitOrder handles POST /api/v1/orders
 func (s *Server) handleSubmitOrder(w http.ResponseWriter, r *http.Request) {
-	startTime := time.Now() 
+	startTime := time.Now()
 	var req SubmitOrderRequest
-	
 
 	// Parse JSON
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -77,6 +127,10 @@ func (s *Server) handleSubmitOrder(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate
+	if req.AccountID == "" {
+		respondError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
 	if req.Symbol == "" {
 		respondError(w, http.StatusBadRequest, "symbol is required")
 		return
@@ -85,27 +139,72 @@ func (s *Server) handleSubmitOrder(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "side must be BUY or SELL")
 		return
 	}
-	if req.Type != "LIMIT" && req.Type != "MARKET" {
-		respondError(w, http.StatusBadRequest, "type must be LIMIT or MARKET")
+	if req.Type != "LIMIT" && req.Type != "MARKET" && req.Type != "STOP" && req.Type != "STOP_LIMIT" && req.Type != "TRAILING_STOP" {
+		respondError(w, http.StatusBadRequest, "type must be LIMIT, MARKET, STOP, STOP_LIMIT or TRAILING_STOP")
 		return
 	}
 	if req.Quantity <= 0 {
 		respondError(w, http.StatusBadRequest, "quantity must be positive")
 		return
 	}
-	if req.Type == "LIMIT" && req.Price <= 0 {
-		respondError(w, http.StatusBadRequest, "price must be positive for LIMIT orders")
+	if (req.Type == "LIMIT" || req.Type == "STOP_LIMIT") && req.Price <= 0 {
+		respondError(w, http.StatusBadRequest, "price must be positive for LIMIT and STOP_LIMIT orders")
+		return
+	}
+	if (req.Type == "STOP" || req.Type == "STOP_LIMIT") && req.StopPrice <= 0 {
+		respondError(w, http.StatusBadRequest, "stop_price must be positive for STOP and STOP_LIMIT orders")
+		return
+	}
+	if req.Type == "TRAILING_STOP" && (req.TrailAmount > 0) == (req.TrailBps > 0) {
+		respondError(w, http.StatusBadRequest, "TRAILING_STOP orders need exactly one of trail_amount or trail_bps")
+		return
+	}
+	if req.DisplayQuantity < 0 || req.DisplayQuantity > req.Quantity {
+		respondError(w, http.StatusBadRequest, "display_quantity must be between 0 and quantity")
+		return
+	}
+	if req.TimeInForce != "" && req.TimeInForce != "GTC" && req.TimeInForce != "IOC" && req.TimeInForce != "FOK" &&
+		req.TimeInForce != "GTD" && req.TimeInForce != "DAY" {
+		respondError(w, http.StatusBadRequest, "time_in_force must be GTC, IOC, FOK, GTD or DAY")
+		return
+	}
+	if req.TimeInForce == "GTD" && req.ExpireAt <= 0 {
+		respondError(w, http.StatusBadRequest, "expire_at is required for GTD orders")
+		return
+	}
+	if req.SelfTradePrevention != "" && !validSelfTradePrevention(req.SelfTradePrevention) {
+		respondError(w, http.StatusBadRequest, "self_trade_prevention must be CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL")
 		return
 	}
-
-	// Convert types
-	side := engine.OrderSide(req.Side)
-	orderType := engine.OrderType(req.Type)
 
 	// Submit order
-	result, err := s.engine.SubmitOrder(req.Symbol, side, orderType, req.Price, req.Quantity)
+	result, err := s.engine.Submit(engine.OrderRequest{
+		AccountID:       req.AccountID,
+		ClientOrderID:   req.ClientOrderID,
+		Symbol:          req.Symbol,
+		Side:            engine.OrderSide(req.Side),
+		Type:            engine.OrderType(req.Type),
+		Price:           req.Price,
+		Quantity:        req.Quantity,
+		TimeInForce:     engine.TimeInForce(req.TimeInForce),
+		ExpireAt:        req.ExpireAt,
+		StopPrice:       req.StopPrice,
+		TrailAmount:     req.TrailAmount,
+		TrailBps:        req.TrailBps,
+		DisplayQuantity: req.DisplayQuantity,
+		PostOnly:        req.PostOnly,
+		RepriceOnCross:  req.RepriceOnCross,
+
+		SelfTradePrevention: engine.SelfTradePrevention(req.SelfTradePrevention),
+	})
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// A retried request does not create a new order, so leave metrics alone
+	if result.Duplicate {
+		respondJSON(w, http.StatusOK, result)
 		return
 	}
 
@@ -125,6 +224,12 @@ func (s *Server) handleSubmitOrder(w http.ResponseWriter, r *http.Request) {
 		s.ordersMatched.Add(1)
 		s.tradesExecuted.Add(int64(len(result.Trades)))
 	}
+	if result.Status == engine.CANCELLED || result.Status == engine.KILLED {
+		s.ordersCancelled.Add(1)
+	}
+	if result.Status == engine.REJECTED {
+		s.ordersRejected.Add(1)
+	}
 
 	// Response status code
 	statusCode := http.StatusOK
@@ -134,6 +239,10 @@ func (s *Server) handleSubmitOrder(w http.ResponseWriter, r *http.Request) {
 		statusCode = http.StatusAccepted
 	} else if result.Status == engine.ACCEPTED {
 		statusCode = http.StatusCreated
+	} else if result.Status == engine.REJECTED {
+		// Business rejections (post-only would cross, risk limits) carry a reason
+		// code instead of the {"error": ...} body used for bad requests
+		statusCode = http.StatusUnprocessableEntity
 	}
 
 	respondJSON(w, statusCode, result)
@@ -154,7 +263,7 @@ func (s *Server) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
 		if err.Error() == "order not found" {
 			respondError(w, http.StatusNotFound, err.Error())
 		} else {
-			respondError(w, http.StatusBadRequest, err.Error())
+			respondEngineError(w, http.StatusBadRequest, err)
 		}
 		return
 	}
@@ -168,6 +277,122 @@ func (s *Server) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, response)
 }
 
+// handleCancelOrderByClientID handles DELETE /api/v1/orders/client/{client_order_id}?account_id=...
+func (s *Server) handleCancelOrderByClientID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientOrderID := vars["client_order_id"]
+
+	accountID := r.URL.Query().Get("account_id")
+
+	if clientOrderID == "" {
+		respondError(w, http.StatusBadRequest, "client_order_id is required")
+		return
+	}
+	if accountID == "" {
+		respondError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
+
+	order, err := s.engine.GetOrderByClientID(accountID, clientOrderID)
+	if err == nil {
+		err = s.engine.CancelOrder(order.ID)
+	}
+	if err != nil {
+		if err.Error() == "order not found" {
+			respondError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondEngineError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	s.ordersCancelled.Add(1)
+
+	response := map[string]interface{}{
+		"order_id":        order.ID,
+		"client_order_id": clientOrderID,
+		"status":          "CANCELLED",
+	}
+	respondJSON(w, http.StatusOK, response)
+}
+
+// handleMassCancel handles DELETE /api/v1/orders?symbol=...&side=...&account_id=...
+func (s *Server) handleMassCancel(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := engine.CancelFilter{
+		Symbol:    query.Get("symbol"),
+		Side:      engine.OrderSide(query.Get("side")),
+		AccountID: query.Get("account_id"),
+	}
+
+	// Refuse to wipe every book by accident
+	if filter.Symbol == "" && filter.AccountID == "" {
+		respondError(w, http.StatusBadRequest, "symbol or account_id is required")
+		return
+	}
+	if filter.Side != "" && filter.Side != engine.BUY && filter.Side != engine.SELL {
+		respondError(w, http.StatusBadRequest, "side must be BUY or SELL")
+		return
+	}
+
+	result := s.engine.MassCancel(filter)
+	s.ordersCancelled.Add(int64(result.Count))
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+// ReplaceOrderRequest represents the JSON body of an amend request. Omitted
+// fields keep their current value; quantity is the new total quantity.
+type ReplaceOrderRequest struct {
+	Price    int64 `json:"price,omitempty"`
+	Quantity int64 `json:"quantity,omitempty"`
+}
+
+// handleReplaceOrder handles PATCH /api/v1/orders/{order_id}
+func (s *Server) handleReplaceOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID := vars["order_id"]
+
+	if orderID == "" {
+		respondError(w, http.StatusBadRequest, "order_id is required")
+		return
+	}
+
+	var req ReplaceOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.Price < 0 || req.Quantity < 0 {
+		respondError(w, http.StatusBadRequest, "price and quantity must be positive")
+		return
+	}
+	if req.Price == 0 && req.Quantity == 0 {
+		respondError(w, http.StatusBadRequest, "price or quantity is required")
+		return
+	}
+
+	result, err := s.engine.ReplaceOrder(orderID, req.Price, req.Quantity)
+	if err != nil {
+		if err.Error() == "order not found" {
+			respondError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondEngineError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+
+	if result.Status == engine.FILLED || result.Status == engine.PARTIAL_FILL {
+		s.tradesExecuted.Add(int64(len(result.Trades)))
+	}
+
+	statusCode := http.StatusOK
+	if result.Status == engine.REJECTED {
+		statusCode = http.StatusUnprocessableEntity
+	}
+	respondJSON(w, statusCode, result)
+}
+
 // handleGetOrder handles GET /api/v1/orders/{order_id}
 func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -180,13 +405,300 @@ func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 
 	order, err := s.engine.GetOrder(orderID)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err.Error())
+		respondEngineError(w, http.StatusNotFound, err)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, order)
 }
 
+// handleGetOrderByClientID handles GET /api/v1/orders/client/{client_order_id}?account_id=...
+func (s *Server) handleGetOrderByClientID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientOrderID := vars["client_order_id"]
+
+	accountID := r.URL.Query().Get("account_id")
+
+	if clientOrderID == "" {
+		respondError(w, http.StatusBadRequest, "client_order_id is required")
+		return
+	}
+	if accountID == "" {
+		respondError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
+
+	order, err := s.engine.GetOrderByClientID(accountID, clientOrderID)
+	if err != nil {
+		respondEngineError(w, http.StatusNotFound, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, order)
+}
+
+// handleGetAccountOrders handles GET /api/v1/accounts/{account_id}/orders
+func (s *Server) handleGetAccountOrders(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	orders, err := s.engine.GetAccountOrders(accountID)
+	if err != nil {
+		respondEngineError(w, http.StatusNotFound, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, orders)
+}
+
+// handleGetAccountTrades handles GET /api/v1/accounts/{account_id}/trades
+func (s *Server) handleGetAccountTrades(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	trades, err := s.engine.GetAccountTrades(accountID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, trades)
+}
+
+// SelfTradePreventionRequest represents the JSON request body for setting
+// an account's default self-trade prevention mode
+type SelfTradePreventionRequest struct {
+	Mode string `json:"mode"`
+}
+
+// validSelfTradePrevention reports whether mode is a supported STP mode
+func validSelfTradePrevention(mode string) bool {
+	return mode == "CANCEL_NEWEST" || mode == "CANCEL_OLDEST" || mode == "CANCEL_BOTH" || mode == "DECREMENT_AND_CANCEL"
+}
+
+// handleSetSelfTradePrevention handles PUT /api/v1/accounts/{account_id}/self-trade-prevention
+func (s *Server) handleSetSelfTradePrevention(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	var req SelfTradePreventionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if !validSelfTradePrevention(req.Mode) {
+		respondError(w, http.StatusBadRequest, "mode must be CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL")
+		return
+	}
+
+	if err := s.engine.SetSelfTradePrevention(accountID, engine.SelfTradePrevention(req.Mode)); err != nil {
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"account_id":            accountID,
+		"self_trade_prevention": req.Mode,
+	})
+}
+
+// BalanceChangeRequest represents the JSON request body for deposits and
+// withdrawals
+type BalanceChangeRequest struct {
+	Asset  string `json:"asset"`
+	Amount int64  `json:"amount"`
+}
+
+// handleGetBalances handles GET /api/v1/accounts/{account_id}/balances
+func (s *Server) handleGetBalances(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	balances, err := s.engine.GetBalances(accountID)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"account_id": accountID,
+		"balances":   balances,
+	})
+}
+
+// handleDeposit handles POST /api/v1/accounts/{account_id}/deposit
+func (s *Server) handleDeposit(w http.ResponseWriter, r *http.Request) {
+	s.handleBalanceChange(w, r, s.engine.Deposit)
+}
+
+// handleWithdraw handles POST /api/v1/accounts/{account_id}/withdraw
+func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
+	s.handleBalanceChange(w, r, s.engine.Withdraw)
+}
+
+// handleBalanceChange applies a deposit or withdrawal and returns the new
+// balance
+func (s *Server) handleBalanceChange(w http.ResponseWriter, r *http.Request, apply func(accountID, asset string, amount int64) (engine.Balance, error)) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	var req BalanceChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.Asset == "" {
+		respondError(w, http.StatusBadRequest, "asset is required")
+		return
+	}
+	if req.Amount <= 0 {
+		respondError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+
+	balance, err := apply(accountID, req.Asset, req.Amount)
+	if err != nil {
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"account_id": accountID,
+		"balance":    balance,
+	})
+}
+
+// handleGetAccountRiskLimits handles GET /api/v1/admin/risk/accounts/{account_id}
+func (s *Server) handleGetAccountRiskLimits(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	respondJSON(w, http.StatusOK, s.engine.GetAccountRiskLimits(vars["account_id"]))
+}
+
+// handleSetAccountRiskLimits handles PUT /api/v1/admin/risk/accounts/{account_id}
+func (s *Server) handleSetAccountRiskLimits(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	var limits engine.RiskLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if err := s.engine.SetAccountRiskLimits(accountID, limits); err != nil {
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, limits)
+}
+
+// handleGetSymbolRiskLimits handles GET /api/v1/admin/risk/symbols/{symbol}
+func (s *Server) handleGetSymbolRiskLimits(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	respondJSON(w, http.StatusOK, s.engine.GetSymbolRiskLimits(vars["symbol"]))
+}
+
+// handleSetSymbolRiskLimits handles PUT /api/v1/admin/risk/symbols/{symbol}
+func (s *Server) handleSetSymbolRiskLimits(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	symbol := vars["symbol"]
+
+	var limits engine.RiskLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if err := s.engine.SetSymbolRiskLimits(symbol, limits); err != nil {
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, limits)
+}
+
+// handleGetFeeSchedules handles GET /api/v1/admin/fees
+func (s *Server) handleGetFeeSchedules(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.engine.GetFeeSchedules())
+}
+
+// handleSetFeeSchedule handles PUT /api/v1/admin/fees
+func (s *Server) handleSetFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule engine.FeeSchedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if err := s.engine.SetFeeSchedule(schedule); err != nil {
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, schedule)
+}
+
+// FeeTierRequest represents the JSON request body for assigning an account
+// to a fee tier
+type FeeTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+// handleSetAccountFeeTier handles PUT /api/v1/admin/fees/accounts/{account_id}
+func (s *Server) handleSetAccountFeeTier(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	accountID := vars["account_id"]
+
+	var req FeeTierRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	if err := s.engine.SetAccountFeeTier(accountID, req.Tier); err != nil {
+		respondEngineError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"account_id": accountID,
+		"tier":       req.Tier,
+	})
+}
+
+// handleGetFeeRevenue handles GET /api/v1/fees/revenue
+func (s *Server) handleGetFeeRevenue(w http.ResponseWriter, r *http.Request) {
+	bySymbol, total, err := s.engine.GetFeeRevenue()
+	if err != nil {
+		respondEngineError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"symbols": bySymbol,
+		"total":   total,
+	})
+}
+
+// handleTakeSnapshot handles POST /api/v1/admin/snapshots
+func (s *Server) handleTakeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if s.snapshots == nil {
+		respondError(w, http.StatusNotFound, "snapshots are not enabled")
+		return
+	}
+
+	seq, err := s.snapshots.Snapshot()
+	if err != nil {
+		respondEngineError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sequence": seq,
+	})
+}
+
 // handleGetOrderBook handles GET /api/v1/orderbook/{symbol}
 func (s *Server) handleGetOrderBook(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -208,13 +720,71 @@ func (s *Server) handleGetOrderBook(w http.ResponseWriter, r *http.Request) {
 
 	snapshot, err := s.engine.GetOrderBook(symbol, depth)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		respondEngineError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	respondJSON(w, http.StatusOK, snapshot)
 }
 
+// handleGetTrades handles GET /api/v1/trades/{symbol}
+func (s *Server) handleGetTrades(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	symbol := vars["symbol"]
+
+	// Get limit parameter (default 100)
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	trades, err := s.engine.GetTrades(symbol, limit)
+	if err != nil {
+		respondEngineError(w, http.StatusNotFound, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, trades)
+}
+
+// handleGetEvents handles GET /api/v1/events/{symbol}?after=N
+func (s *Server) handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	symbol := vars["symbol"]
+
+	var after uint64
+	if afterStr := r.URL.Query().Get("after"); afterStr != "" {
+		a, err := strconv.ParseUint(afterStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "after must be a sequence number")
+			return
+		}
+		after = a
+	}
+
+	// Get limit parameter (default 100)
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	events, err := s.engine.GetEvents(symbol, after, limit)
+	if errors.Is(err, engine.ErrEventsUnavailable) {
+		respondError(w, http.StatusGone, err.Error())
+		return
+	}
+	if err != nil {
+		respondEngineError(w, http.StatusNotFound, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, events)
+}
+
 // handleHealth handles GET /health
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	uptime := time.Since(s.startTime).Seconds()
@@ -231,7 +801,7 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 // handleMetrics handles GET /metrics
 func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	// Calculate orders in book
-	ordersInBook := s.ordersReceived.Load() - s.ordersMatched.Load() - s.ordersCancelled.Load()
+	ordersInBook := s.ordersReceived.Load() - s.ordersMatched.Load() - s.ordersCancelled.Load() - s.ordersRejected.Load() - s.ordersExpired.Load()
 
 	// Calculate latencies
 	s.latenciesMutex.Lock()
@@ -259,14 +829,16 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := map[string]interface{}{
-		"orders_received":        s.ordersReceived.Load(),
-		"orders_matched":         s.ordersMatched.Load(),
-		"orders_cancelled":       s.ordersCancelled.Load(),
-		"orders_in_book":         ordersInBook,
-		"trades_executed":        s.tradesExecuted.Load(),
-		"latency_p50_ms":         p50,
-		"latency_p99_ms":         p99,
-		"latency_p999_ms":        p999,
+		"orders_received":           s.ordersReceived.Load(),
+		"orders_matched":            s.ordersMatched.Load(),
+		"orders_cancelled":          s.ordersCancelled.Load(),
+		"orders_rejected":           s.ordersRejected.Load(),
+		"orders_expired":            s.ordersExpired.Load(),
+		"orders_in_book":            ordersInBook,
+		"trades_executed":           s.tradesExecuted.Load(),
+		"latency_p50_ms":            p50,
+		"latency_p99_ms":            p99,
+		"latency_p999_ms":           p999,
 		"throughput_orders_per_sec": throughput,
 	}
 
@@ -288,7 +860,35 @@ func respondError(w http.ResponseWriter, statusCode int, message string) {
 	respondJSON(w, statusCode, response)
 }
 
-// Start starts the HTTP server
+// respondEngineError reports an error from the engine with statusCode, 503
+// if the symbol's queue was full or the engine is shutting down, or 500 if
+// the command log has failed
+func respondEngineError(w http.ResponseWriter, statusCode int, err error) {
+	switch {
+	case errors.Is(err, engine.ErrQueueFull), errors.Is(err, engine.ErrEngineClosed):
+		statusCode = http.StatusServiceUnavailable
+	case errors.Is(err, engine.ErrCommandLogFailed):
+		statusCode = http.StatusInternalServerError
+	}
+	respondError(w, statusCode, err.Error())
+}
+
+// Engine returns the server's matching engine, for recovery before Start
+func (s *Server) Engine() *engine.MatchingEngine {
+	return s.engine
+}
+
+// SetSnapshotter enables the snapshot admin endpoint
+func (s *Server) SetSnapshotter(snapshots *snapshot.Snapshotter) {
+	s.snapshots = snapshots
+}
+
+// Start starts the HTTP server and the order expiry scheduler
 func (s *Server) Start(port string) error {
+	defer s.engine.Close()
+
+	stopExpiry := s.engine.StartExpiry(time.Second)
+	defer stopExpiry()
+
 	return http.ListenAndServe(":"+port, s.router)
-}
\ No newline at end of file
+}
@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Account is a trading participant that owns orders and trades
+type Account struct {
+	ID string
+
+	// Self-trade prevention mode for orders that do not set their own
+	SelfTradePrevention SelfTradePrevention
+
+	orders    []*Order
+	trades    []Trade
+	positions map[string]int64 // symbol -> net quantity bought minus sold
+
+	// Live orders by ID, kept up to date by their books so risk checks
+	// never have to ask them
+	open map[string]openOrder
+
+	// Guards the fields above. Each account has its own lock, so books
+	// working for different accounts never wait on each other.
+	mu sync.Mutex
+}
+
+// openOrder is a live order as its account's risk limits see it
+type openOrder struct {
+	symbol   string
+	side     OrderSide
+	quantity int64 // left to fill
+}
+
+// accountRegistry tracks every account and its order and trade history.
+// Accounts are created on their first order. The registry lock only guards
+// the map of accounts, and is held exclusively just to add one.
+type accountRegistry struct {
+	accounts map[string]*Account
+	mu       sync.RWMutex
+}
+
+// get returns an account, or nil if it does not exist
+func (r *accountRegistry) get(accountID string) *Account {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.accounts[accountID]
+}
+
+// getOrCreate returns the account, registering it if needed
+func (r *accountRegistry) getOrCreate(accountID string) *Account {
+	if account := r.get(accountID); account != nil {
+		return account
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.accounts == nil {
+		r.accounts = make(map[string]*Account)
+	}
+	account, exists := r.accounts[accountID]
+	if !exists {
+		account = &Account{ID: accountID, positions: make(map[string]int64), open: make(map[string]openOrder)}
+		r.accounts[accountID] = account
+	}
+	return account
+}
+
+// recordOrder adds a submitted order to its account's history
+func (r *accountRegistry) recordOrder(order *Order) {
+	if order.AccountID == "" {
+		return
+	}
+
+	account := r.getOrCreate(order.AccountID)
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	account.orders = append(account.orders, order)
+}
+
+// recordTrade adds a trade to the history of both counterparties and
+// updates their positions and open orders
+func (r *accountRegistry) recordTrade(trade Trade) {
+	if trade.BuyerAccountID != "" {
+		account := r.getOrCreate(trade.BuyerAccountID)
+		account.mu.Lock()
+		account.trades = append(account.trades, trade)
+		account.positions[trade.Symbol] += trade.Quantity
+		account.fillOpen(trade.BuyerID, trade.Quantity)
+		account.mu.Unlock()
+	}
+	if trade.SellerAccountID != "" {
+		account := r.getOrCreate(trade.SellerAccountID)
+		account.mu.Lock()
+		if trade.SellerAccountID != trade.BuyerAccountID {
+			account.trades = append(account.trades, trade)
+		}
+		account.positions[trade.Symbol] -= trade.Quantity
+		account.fillOpen(trade.SellerID, trade.Quantity)
+		account.mu.Unlock()
+	}
+}
+
+// fillOpen takes quantity traded off a live order. Caller must hold the
+// account lock.
+func (a *Account) fillOpen(orderID string, quantity int64) {
+	if o, exists := a.open[orderID]; exists {
+		o.quantity -= quantity
+		a.open[orderID] = o
+	}
+}
+
+// trackOpen brings an order's entry in its account's live orders up to
+// date: what it has left to fill while it is live, nothing once it is
+// done. Must run on the order's book goroutine.
+func (r *accountRegistry) trackOpen(order *Order) {
+	if !order.isLive() {
+		r.closeOpen(order)
+		return
+	}
+	if order.AccountID == "" {
+		return
+	}
+
+	account := r.getOrCreate(order.AccountID)
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	account.open[order.ID] = openOrder{
+		symbol:   order.Symbol,
+		side:     order.Side,
+		quantity: order.Quantity - order.FilledQuantity,
+	}
+}
+
+// closeOpen removes an order from its account's live orders
+func (r *accountRegistry) closeOpen(order *Order) {
+	if order.AccountID == "" {
+		return
+	}
+
+	if account := r.get(order.AccountID); account != nil {
+		account.mu.Lock()
+		delete(account.open, order.ID)
+		account.mu.Unlock()
+	}
+}
+
+// reserveOpen runs checkers against a new or amended order with the
+// account's other live orders and position in the order's symbol filled
+// into ctx, and sets the order's entry in the live orders if they all
+// pass. Checking and reserving under the account's lock means orders
+// arriving together on different symbols cannot all pass the same limit.
+// With no checkers the order is reserved unchecked.
+func (r *accountRegistry) reserveOpen(order *Order, ctx RiskContext, checkers []RiskChecker) *RiskRejection {
+	if order.AccountID == "" {
+		for _, checker := range checkers {
+			if rejection := checker.Check(*order, ctx); rejection != nil {
+				return rejection
+			}
+		}
+		return nil
+	}
+
+	account := r.getOrCreate(order.AccountID)
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	ctx.OpenOrders = int64(len(account.open))
+	ctx.Position = account.positions[order.Symbol]
+	if _, amending := account.open[order.ID]; amending {
+		ctx.OpenOrders--
+	}
+	for id, o := range account.open {
+		if id == order.ID {
+			continue
+		}
+		if o.symbol == order.Symbol && o.side == BUY {
+			ctx.OpenBuyQuantity += o.quantity
+		} else if o.symbol == order.Symbol {
+			ctx.OpenSellQuantity += o.quantity
+		}
+	}
+
+	for _, checker := range checkers {
+		if rejection := checker.Check(*order, ctx); rejection != nil {
+			return rejection
+		}
+	}
+	account.open[order.ID] = openOrder{symbol: order.Symbol, side: order.Side, quantity: order.Quantity - order.FilledQuantity}
+	return nil
+}
+
+// ordersOf returns the orders submitted by an account, oldest first
+func (r *accountRegistry) ordersOf(accountID string) ([]*Order, bool) {
+	account := r.get(accountID)
+	if account == nil {
+		return nil, false
+	}
+
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	return append([]*Order{}, account.orders...), true
+}
+
+// readOrders calls fn with each order on the goroutine of the order's book,
+// batching each symbol's orders into one command. i is the order's index in
+// orders.
+func (me *MatchingEngine) readOrders(orders []*Order, fn func(i int, order *Order)) error {
+	bySymbol := make(map[string][]int)
+	for i, order := range orders {
+		bySymbol[order.Symbol] = append(bySymbol[order.Symbol], i)
+	}
+
+	for symbol, indexes := range bySymbol {
+		book := me.GetOrCreateBook(symbol)
+		if err := book.exec(func() {
+			for _, i := range indexes {
+				fn(i, orders[i])
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selfTradePrevention returns the account's default self-trade prevention
+// mode, or CANCEL_NEWEST if it has none
+func (r *accountRegistry) selfTradePrevention(accountID string) SelfTradePrevention {
+	account := r.get(accountID)
+	if account == nil {
+		return STP_CANCEL_NEWEST
+	}
+
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	if account.SelfTradePrevention != "" {
+		return account.SelfTradePrevention
+	}
+	return STP_CANCEL_NEWEST
+}
+
+// SetSelfTradePrevention sets the default self-trade prevention mode for an
+// account's future orders, registering the account if needed
+func (me *MatchingEngine) SetSelfTradePrevention(accountID string, mode SelfTradePrevention) error {
+	return me.setSelfTradePrevention(&Command{Type: CMD_SET_SELF_TRADE_PREVENTION, AccountID: accountID, Mode: mode})
+}
+
+// setSelfTradePrevention runs a self-trade prevention mode command
+func (me *MatchingEngine) setSelfTradePrevention(cmd *Command) error {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	accountID, mode := cmd.AccountID, cmd.Mode
+	if accountID == "" {
+		return fmt.Errorf("account ID is required")
+	}
+	if !mode.valid() {
+		return fmt.Errorf("unsupported self-trade prevention mode: %s", mode)
+	}
+	if err := me.checkLog(); err != nil {
+		return err
+	}
+
+	account := me.accounts.getOrCreate(accountID)
+	account.mu.Lock()
+	account.SelfTradePrevention = mode
+	seq, err := me.logCommand(cmd)
+	account.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return me.syncCommand(seq)
+}
+
+// GetAccountOrders returns a copy of every order submitted by an account,
+// oldest first, with its current status
+func (me *MatchingEngine) GetAccountOrders(accountID string) ([]Order, error) {
+	orders, exists := me.accounts.ordersOf(accountID)
+	if !exists {
+		return nil, fmt.Errorf("account not found")
+	}
+
+	// Orders are updated on their book's goroutine, so copy them there too
+	result := make([]Order, len(orders))
+	if err := me.readOrders(orders, func(i int, order *Order) {
+		result[i] = *order
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetAccountTrades returns every trade an account took part in, oldest first
+func (me *MatchingEngine) GetAccountTrades(accountID string) ([]Trade, error) {
+	account := me.accounts.get(accountID)
+	if account == nil {
+		return nil, fmt.Errorf("account not found")
+	}
+
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	return append([]Trade{}, account.trades...), nil
+}
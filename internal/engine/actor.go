@@ -0,0 +1,141 @@
+package engine
+
+import "errors"
+
+// DefaultQueueDepth is how many commands each book queues before new order
+// entry and queries are turned away with ErrQueueFull
+const DefaultQueueDepth = 4096
+
+var (
+	// ErrQueueFull is returned when a symbol's command queue is full. The
+	// command was not run and can be retried.
+	ErrQueueFull = errors.New("order book is busy, command queue is full")
+
+	// ErrEngineClosed is returned for commands sent after Close
+	ErrEngineClosed = errors.New("matching engine is closed")
+)
+
+// WithQueueDepth sets how many commands each book's queue holds. Values
+// below 1 are ignored.
+func WithQueueDepth(depth int) Option {
+	return func(me *MatchingEngine) {
+		if depth > 0 {
+			me.queueDepth = depth
+		}
+	}
+}
+
+// start hands the book to its own goroutine. From then on the book is only
+// read or changed by commands running on that goroutine, one at a time.
+func (ob *OrderBook) start(depth int) {
+	ob.commands = make(chan func(), depth)
+	ob.stop = make(chan struct{})
+	ob.stopped = make(chan struct{})
+	go ob.loop()
+}
+
+// loop runs commands in arrival order. Once stopped it finishes whatever is
+// already queued before exiting.
+func (ob *OrderBook) loop() {
+	defer close(ob.stopped)
+
+	for {
+		select {
+		case cmd := <-ob.commands:
+			cmd()
+		case <-ob.stop:
+			for {
+				select {
+				case cmd := <-ob.commands:
+					cmd()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops the book's goroutine and waits for it to exit
+func (ob *OrderBook) close() {
+	close(ob.stop)
+	<-ob.stopped
+}
+
+// exec runs fn on the book's goroutine and waits for it to finish. If the
+// queue is full it fails with ErrQueueFull instead of waiting for room.
+// fn must not send commands to any book, including this one.
+func (ob *OrderBook) exec(fn func()) error {
+	return ob.send(fn, false)
+}
+
+// execWait is exec for commands that must not be dropped: it waits for room
+// in the queue instead of failing
+func (ob *OrderBook) execWait(fn func()) error {
+	return ob.send(fn, true)
+}
+
+// send queues fn and waits for its reply. A book that is not owned by an
+// engine runs fn directly on the caller's goroutine.
+func (ob *OrderBook) send(fn func(), wait bool) error {
+	if ob.commands == nil {
+		fn()
+		return nil
+	}
+
+	select {
+	case <-ob.stop:
+		return ErrEngineClosed
+	default:
+	}
+
+	done := make(chan struct{})
+	cmd := func() {
+		fn()
+		close(done)
+	}
+
+	if wait {
+		select {
+		case ob.commands <- cmd:
+		case <-ob.stop:
+			return ErrEngineClosed
+		}
+	} else {
+		select {
+		case ob.commands <- cmd:
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ob.stopped:
+		// The loop may have run the command just before it exited
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrEngineClosed
+		}
+	}
+}
+
+// Close stops every book's goroutine after the commands already queued have
+// run. Commands sent afterwards fail with ErrEngineClosed.
+func (me *MatchingEngine) Close() {
+	me.mu.Lock()
+	if me.closed {
+		me.mu.Unlock()
+		return
+	}
+	me.closed = true
+	me.mu.Unlock()
+
+	for _, book := range me.allBooks() {
+		book.close()
+	}
+	me.bus.close()
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+)
+
+// clientOrder records the outcome of a submission carrying a client order
+// ID, so a retried request gets the original result back
+type clientOrder struct {
+	done   chan struct{} // closed once the original submission completes
+	result *OrderResult
+	err    error
+}
+
+// clientOrderKey scopes a client order ID to its account
+func clientOrderKey(accountID, clientOrderID string) string {
+	return accountID + "\x00" + clientOrderID
+}
+
+// clientOrderRegistry maps client order keys to their submissions
+type clientOrderRegistry struct {
+	orders map[string]*clientOrder
+	mu     sync.Mutex
+}
+
+// reserve claims a client order ID. If it is already taken the existing
+// entry is returned instead and the caller must not submit again.
+func (r *clientOrderRegistry) reserve(key string) (entry *clientOrder, isNew bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.orders == nil {
+		r.orders = make(map[string]*clientOrder)
+	}
+	if existing, ok := r.orders[key]; ok {
+		return existing, false
+	}
+
+	entry = &clientOrder{done: make(chan struct{})}
+	r.orders[key] = entry
+	return entry, true
+}
+
+// complete records the outcome of a reserved submission. Submissions that
+// failed validation release the ID so the client can correct and retry.
+func (r *clientOrderRegistry) complete(key string, entry *clientOrder, result *OrderResult, err error) {
+	if err != nil {
+		r.mu.Lock()
+		delete(r.orders, key)
+		r.mu.Unlock()
+	}
+
+	entry.result = result
+	entry.err = err
+	close(entry.done)
+}
+
+// lookup returns the engine order ID for a client order key
+func (r *clientOrderRegistry) lookup(key string) (string, bool) {
+	r.mu.Lock()
+	entry, ok := r.orders[key]
+	r.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	<-entry.done
+	if entry.err != nil {
+		return "", false
+	}
+	return entry.result.OrderID, true
+}
+
+// submitIdempotent submits an order with a client order ID exactly once per
+// account. Resubmitting the same ID returns a copy of the original result,
+// marked as a duplicate, without creating a new order.
+func (me *MatchingEngine) submitIdempotent(cmd *Command) (*OrderResult, error) {
+	key := clientOrderKey(cmd.Order.AccountID, cmd.Order.ClientOrderID)
+	entry, isNew := me.clientOrders.reserve(key)
+	if !isNew {
+		// Wait for the original submission if it is still in flight
+		<-entry.done
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		duplicate := *entry.result
+		duplicate.Duplicate = true
+		return &duplicate, nil
+	}
+
+	result, err := me.submit(cmd)
+	me.clientOrders.complete(key, entry, result, err)
+	return result, err
+}
+
+// GetOrderByClientID retrieves an account's order by its client order ID
+func (me *MatchingEngine) GetOrderByClientID(accountID, clientOrderID string) (*Order, error) {
+	orderID, ok := me.clientOrders.lookup(clientOrderKey(accountID, clientOrderID))
+	if !ok {
+		return nil, fmt.Errorf("order not found")
+	}
+	return me.GetOrder(orderID)
+}
+
+// CancelOrderByClientID cancels an account's order by its client order ID
+func (me *MatchingEngine) CancelOrderByClientID(accountID, clientOrderID string) error {
+	orderID, ok := me.clientOrders.lookup(clientOrderKey(accountID, clientOrderID))
+	if !ok {
+		return fmt.Errorf("order not found")
+	}
+	return me.CancelOrder(orderID)
+}
@@ -0,0 +1,23 @@
+package engine
+
+import "time"
+
+// Clock supplies the current time to the engine. Tests inject their own
+// clock to control time-based behaviour such as order expiry.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reads the wall clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// endOfDay returns the first instant of the next UTC day, when DAY orders
+// expire
+func endOfDay(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
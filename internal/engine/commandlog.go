@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCommandLogFailed is returned once a command could not be written to
+// the command log. The engine's state is then ahead of the log, so it
+// refuses every further command.
+var ErrCommandLogFailed = errors.New("command log write failed")
+
+// CommandType identifies a state-changing command in the command log
+type CommandType string
+
+const (
+	CMD_SUBMIT      CommandType = "SUBMIT"
+	CMD_CANCEL      CommandType = "CANCEL"
+	CMD_REPLACE     CommandType = "REPLACE"
+	CMD_MASS_CANCEL CommandType = "MASS_CANCEL" // one per book the filter cancelled orders in
+	CMD_EXPIRE      CommandType = "EXPIRE"
+
+	CMD_DEPOSIT  CommandType = "DEPOSIT"
+	CMD_WITHDRAW CommandType = "WITHDRAW"
+
+	CMD_SET_SELF_TRADE_PREVENTION CommandType = "SET_SELF_TRADE_PREVENTION"
+	CMD_SET_ACCOUNT_RISK_LIMITS   CommandType = "SET_ACCOUNT_RISK_LIMITS"
+	CMD_SET_SYMBOL_RISK_LIMITS    CommandType = "SET_SYMBOL_RISK_LIMITS"
+	CMD_SET_FEE_SCHEDULE          CommandType = "SET_FEE_SCHEDULE"
+	CMD_SET_ACCOUNT_FEE_TIER      CommandType = "SET_ACCOUNT_FEE_TIER"
+)
+
+// Command is one entry in the command log: a state-changing request as the
+// engine applied it. Only the fields used by its type are set.
+type Command struct {
+	Type CommandType `json:"type"`
+	Time int64       `json:"time_ns"` // engine clock when applied, Unix nanoseconds
+
+	// Orders. A submit records the order ID it was given, the request with
+	// defaults filled in and the outcome of the risk checks, and a submit
+	// or replace the IDs of the trades it made and which orders it found
+	// funds for, so replaying it does not depend on anything outside the
+	// log.
+	OrderID         string         `json:"order_id,omitempty"`
+	Order           *OrderRequest  `json:"order,omitempty"`
+	RiskRejection   *RiskRejection `json:"risk_rejection,omitempty"`
+	TradeIDs        []string       `json:"trade_ids,omitempty"`        // of every trade, in order
+	FundsRejections []string       `json:"funds_rejections,omitempty"` // orders refused for insufficient funds
+	Price           int64          `json:"price,omitempty"`
+	Quantity        int64          `json:"quantity,omitempty"`
+	Filter          *CancelFilter  `json:"filter,omitempty"`
+
+	// Balances and settings
+	AccountID string              `json:"account_id,omitempty"`
+	Symbol    string              `json:"symbol,omitempty"`
+	Asset     string              `json:"asset,omitempty"`
+	Amount    int64               `json:"amount,omitempty"`
+	Mode      SelfTradePrevention `json:"mode,omitempty"`
+	Limits    *RiskLimits         `json:"limits,omitempty"`
+	Fees      *FeeSchedule        `json:"fees,omitempty"`
+	Tier      string              `json:"tier,omitempty"`
+
+	replayed      bool // read back from the log, so not logged again
+	tradeIDsTaken int  // trades made so far in a replay
+}
+
+// CommandLog durably records commands so the engine can be rebuilt after a
+// restart
+type CommandLog interface {
+	// Append writes a record and returns its sequence number
+	Append(data []byte) (uint64, error)
+
+	// Sync waits until the record with sequence number seq is durable
+	Sync(seq uint64) error
+}
+
+// WithCommandLog records every accepted command in log before the engine
+// acknowledges it. Commands that touch a book are appended on the book's
+// goroutine, so each book's history is logged in the order it happened.
+func WithCommandLog(log CommandLog) Option {
+	return func(me *MatchingEngine) {
+		me.log = log
+	}
+}
+
+// logCommand appends cmd to the command log and returns its sequence
+// number, or 0 if there is no log or cmd is being replayed
+func (me *MatchingEngine) logCommand(cmd *Command) (uint64, error) {
+	if me.log == nil || cmd.replayed {
+		return 0, nil
+	}
+	if cmd.Time == 0 {
+		cmd.Time = me.clock.Now().UnixNano()
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return 0, me.failLog(err)
+	}
+	seq, err := me.log.Append(data)
+	if err != nil {
+		return 0, me.failLog(err)
+	}
+
+	// Book goroutines append concurrently, so keep the highest
+	for {
+		last := me.logSeq.Load()
+		if seq <= last || me.logSeq.CompareAndSwap(last, seq) {
+			break
+		}
+	}
+	return seq, nil
+}
+
+// syncCommand waits until the command logged as seq is durable. Callers
+// acknowledge a command only after this returns.
+func (me *MatchingEngine) syncCommand(seq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+	if err := me.log.Sync(seq); err != nil {
+		return me.failLog(err)
+	}
+	return nil
+}
+
+// failLog stops the engine taking commands after a command log error
+func (me *MatchingEngine) failLog(err error) error {
+	err = fmt.Errorf("%w: %v", ErrCommandLogFailed, err)
+	me.logErr.CompareAndSwap(nil, &err)
+	return err
+}
+
+// checkLog returns the error that stopped the command log, if any
+func (me *MatchingEngine) checkLog() error {
+	if err := me.logErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// commandTime returns when cmd is applied: now on the engine clock, or the
+// recorded time when it is replayed
+func (me *MatchingEngine) commandTime(cmd *Command) time.Time {
+	if !cmd.replayed {
+		cmd.Time = me.clock.Now().UnixNano()
+	}
+	return time.Unix(0, cmd.Time)
+}
+
+// nextTradeID returns the ID of the next trade made by the command running
+// on book. A replayed command reuses the IDs it logged; if it makes more
+// trades than it logged, the extra ones get no ID and Replay fails. Must
+// run on the book's goroutine.
+func (me *MatchingEngine) nextTradeID(book *OrderBook) string {
+	cmd := book.cmd
+	if cmd.replayed {
+		cmd.tradeIDsTaken++
+		if cmd.tradeIDsTaken > len(cmd.TradeIDs) {
+			return ""
+		}
+		return cmd.TradeIDs[cmd.tradeIDsTaken-1]
+	}
+
+	id := me.ids.NextID()
+	cmd.TradeIDs = append(cmd.TradeIDs, id)
+	return id
+}
+
+// Replay applies the command logged as seq without logging it again.
+// Commands must be replayed in log order before the engine takes any new
+// ones. An error means the log does not match the engine's state.
+func (me *MatchingEngine) Replay(seq uint64, data []byte) error {
+	cmd := &Command{}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return fmt.Errorf("decode command: %w", err)
+	}
+	cmd.replayed = true
+
+	var err error
+	switch cmd.Type {
+	case CMD_SUBMIT:
+		if cmd.Order == nil {
+			return fmt.Errorf("submit command without an order")
+		}
+		_, err = me.submitCommand(cmd)
+	case CMD_CANCEL:
+		err = me.cancel(cmd)
+	case CMD_REPLACE:
+		_, err = me.replace(cmd)
+	case CMD_MASS_CANCEL:
+		if cmd.Filter == nil {
+			return fmt.Errorf("mass cancel command without a filter")
+		}
+		me.massCancel(cmd)
+	case CMD_EXPIRE:
+		expired := false
+		err = me.withOrder(cmd.OrderID, func(book *OrderBook, order *Order) {
+			book.applyCommand(cmd, func() {
+				expired = me.expireOrder(book, order)
+			})
+		})
+		if err == nil && !expired {
+			err = fmt.Errorf("order %s is no longer live", cmd.OrderID)
+		}
+	case CMD_DEPOSIT:
+		_, err = me.deposit(cmd)
+	case CMD_WITHDRAW:
+		_, err = me.withdraw(cmd)
+	case CMD_SET_SELF_TRADE_PREVENTION:
+		err = me.setSelfTradePrevention(cmd)
+	case CMD_SET_ACCOUNT_RISK_LIMITS, CMD_SET_SYMBOL_RISK_LIMITS:
+		if cmd.Limits == nil {
+			return fmt.Errorf("risk limits command without limits")
+		}
+		err = me.setRiskLimits(cmd)
+	case CMD_SET_FEE_SCHEDULE:
+		if cmd.Fees == nil {
+			return fmt.Errorf("fee schedule command without a schedule")
+		}
+		err = me.setFeeSchedule(cmd)
+	case CMD_SET_ACCOUNT_FEE_TIER:
+		err = me.setAccountFeeTier(cmd)
+	default:
+		return fmt.Errorf("unknown command type: %s", cmd.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("replay %s: %w", cmd.Type, err)
+	}
+	if cmd.tradeIDsTaken != len(cmd.TradeIDs) {
+		return fmt.Errorf("replay %s: made %d trades, logged %d", cmd.Type, cmd.tradeIDsTaken, len(cmd.TradeIDs))
+	}
+	me.logSeq.Store(seq)
+	return nil
+}
@@ -0,0 +1,281 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSubscriberBuffer is how many events a subscriber can fall behind
+// before events for it are dropped
+const DefaultSubscriberBuffer = 1024
+
+// bookUpdateDepth is how many price levels a side of a BOOK_UPDATED event
+// shows
+const bookUpdateDepth = 10
+
+// EventType identifies an execution report or book update published to
+// subscribers
+type EventType string
+
+const (
+	ORDER_ACCEPTED         EventType = "ORDER_ACCEPTED"         // a new order passed its checks and is working
+	ORDER_PARTIALLY_FILLED EventType = "ORDER_PARTIALLY_FILLED" // an order traded and has quantity left
+	ORDER_FILLED           EventType = "ORDER_FILLED"           // an order traded its last quantity
+	ORDER_CANCELLED        EventType = "ORDER_CANCELLED"        // by its owner, self-trade prevention, IOC or FOK
+	ORDER_EXPIRED          EventType = "ORDER_EXPIRED"
+	TRADE_EXECUTED         EventType = "TRADE_EXECUTED"
+	BOOK_UPDATED           EventType = "BOOK_UPDATED" // once per command that changed the book
+)
+
+// Event is one entry in the engine's event stream. Order is a copy of the
+// order as it stands after the event, for both sides of a fill; Trade is
+// set for trades and fills, and Book for book updates. Sequence is the
+// last book event of the symbol the event follows, so a subscriber that
+// fell behind can pick up again from GetEvents or GetOrderBook.
+type Event struct {
+	Type      EventType          `json:"type"`
+	Symbol    string             `json:"symbol"`
+	Sequence  uint64             `json:"sequence"`
+	Timestamp int64              `json:"timestamp_ns"` // Unix nanoseconds
+	Order     *Order             `json:"order,omitempty"`
+	Trade     *Trade             `json:"trade,omitempty"`
+	Book      *OrderBookSnapshot `json:"book,omitempty"`
+}
+
+// Subscription receives events from the engine. Events of one symbol
+// arrive in the order they happened; events of different symbols may
+// interleave.
+type Subscription struct {
+	events  chan Event
+	symbols map[string]bool // nil for every symbol
+	dropped atomic.Uint64
+	bus     *eventBus
+}
+
+// Events returns the channel events are delivered on. It is closed by
+// Close or when the engine closes.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns how many events were dropped because the subscriber's
+// buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops delivery and closes the events channel
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// eventBus fans events out to subscribers without ever waiting for them
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+	count  atomic.Int32 // len(subs), read without the lock
+}
+
+// Subscribe registers for the engine's event stream, narrowed to the given
+// symbols if any are named. The subscription buffers up to buffer events
+// (DefaultSubscriberBuffer if below 1). Matching never waits for a
+// subscriber: once its buffer is full, further events for it are dropped
+// and counted by Dropped. A command's events are delivered once it is
+// durable in the command log; replayed commands publish nothing.
+func (me *MatchingEngine) Subscribe(buffer int, symbols ...string) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultSubscriberBuffer
+	}
+
+	sub := &Subscription{events: make(chan Event, buffer), bus: &me.bus}
+	if len(symbols) > 0 {
+		sub.symbols = make(map[string]bool, len(symbols))
+		for _, symbol := range symbols {
+			sub.symbols[symbol] = true
+		}
+	}
+	me.bus.subscribe(sub)
+	return sub
+}
+
+// subscribe adds a subscription, or closes it straight away if the bus is
+// closed
+func (b *eventBus) subscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(sub.events)
+		return
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.count.Store(int32(len(b.subs)))
+}
+
+// unsubscribe removes a subscription and closes its channel. Safe to call
+// more than once.
+func (b *eventBus) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.subs[sub]; !exists {
+		return
+	}
+	delete(b.subs, sub)
+	b.count.Store(int32(len(b.subs)))
+	close(sub.events)
+}
+
+// close closes every subscription and turns away new ones
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		close(sub.events)
+	}
+	b.subs = nil
+	b.count.Store(0)
+}
+
+// active reports whether anyone is subscribed
+func (b *eventBus) active() bool {
+	return b != nil && b.count.Load() > 0
+}
+
+// publish delivers events to every interested subscriber, dropping them
+// for subscribers whose buffer is full
+func (b *eventBus) publish(events []Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		for _, event := range events {
+			if sub.symbols != nil && !sub.symbols[event.Symbol] {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// publishing reports whether events raised by the command being applied
+// go anywhere. Must run on the book's goroutine.
+func (ob *OrderBook) publishing() bool {
+	return ob.cmd != nil && !ob.cmd.replayed && ob.bus.active()
+}
+
+// emit queues an event until the command being applied finishes. Must run
+// on the book's goroutine.
+func (ob *OrderBook) emit(eventType EventType, order *Order, trade *Trade) {
+	if !ob.publishing() {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		Symbol:    ob.Symbol,
+		Sequence:  ob.EventSequence,
+		Timestamp: ob.cmd.Time,
+		Trade:     trade,
+	}
+	if order != nil {
+		copied := *order
+		event.Order = &copied
+	}
+	ob.pendingEvents = append(ob.pendingEvents, event)
+}
+
+// emitTrade reports a trade and the fill it gave each side. The taker's
+// status is only settled once matching ends, so its copy is given the
+// status the fill leaves it with. Must run on the book's goroutine.
+func (ob *OrderBook) emitTrade(trade Trade, maker, taker *Order) {
+	if !ob.publishing() {
+		return
+	}
+
+	ob.emit(TRADE_EXECUTED, nil, &trade)
+	for _, order := range []*Order{maker, taker} {
+		eventType, status := ORDER_PARTIALLY_FILLED, PARTIAL_FILL
+		if order.FilledQuantity == order.Quantity {
+			eventType, status = ORDER_FILLED, FILLED
+		}
+		ob.emit(eventType, order, &trade)
+		ob.pendingEvents[len(ob.pendingEvents)-1].Order.Status = status
+	}
+}
+
+// eventBatch is the events raised by one command, held back until the
+// command is durable so subscribers never hear of something a crash could
+// undo
+type eventBatch struct {
+	book   *OrderBook
+	events []Event
+	done   bool // the command is durable, or failed and its events are dropped
+}
+
+// eventOutbox holds a book's event batches in the order the book applied
+// their commands. Commands become durable out of order, so batches are
+// only published from the front.
+type eventOutbox struct {
+	mu      sync.Mutex
+	batches []*eventBatch
+}
+
+// flushEvents adds a book update if the command changed the book and moves
+// the command's events to the outbox. Returns nil if there were none.
+// Must run on the book's goroutine.
+func (ob *OrderBook) flushEvents(sequenceBefore uint64) *eventBatch {
+	if ob.EventSequence != sequenceBefore && ob.publishing() {
+		ob.pendingEvents = append(ob.pendingEvents, Event{
+			Type:      BOOK_UPDATED,
+			Symbol:    ob.Symbol,
+			Sequence:  ob.EventSequence,
+			Timestamp: ob.cmd.Time,
+			Book:      ob.snapshot(bookUpdateDepth, time.Unix(0, ob.cmd.Time)),
+		})
+	}
+	if len(ob.pendingEvents) == 0 {
+		return nil
+	}
+
+	batch := &eventBatch{book: ob, events: ob.pendingEvents}
+	ob.pendingEvents = nil
+	ob.outbox.mu.Lock()
+	ob.outbox.batches = append(ob.outbox.batches, batch)
+	ob.outbox.mu.Unlock()
+	return batch
+}
+
+// release is called once the batch's command is durable, or with durable
+// false once it can never be, and publishes every batch at the front of
+// the outbox whose command is settled. Safe to call on a nil batch.
+func (b *eventBatch) release(durable bool) {
+	if b == nil {
+		return
+	}
+
+	outbox := &b.book.outbox
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	b.done = true
+	if !durable {
+		b.events = nil
+	}
+	for len(outbox.batches) > 0 && outbox.batches[0].done {
+		b.book.bus.publish(outbox.batches[0].events)
+		outbox.batches[0] = nil
+		outbox.batches = outbox.batches[1:]
+	}
+}
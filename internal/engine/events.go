@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxRecentEvents bounds the event tape kept by each book. Once reached the
+// older half is dropped.
+const maxRecentEvents = 4000
+
+// ErrEventsUnavailable is returned when events asked for have already been
+// dropped from a book's tape. Rebuild from GetOrderBook, whose sequence
+// number says where to pick the events up again.
+var ErrEventsUnavailable = errors.New("events no longer available")
+
+// BookEventType identifies a change to an order book
+type BookEventType string
+
+const (
+	EVENT_ADD    BookEventType = "ADD"    // an order rests, or rejoins the back of its queue
+	EVENT_AMEND  BookEventType = "AMEND"  // a resting order shrinks in place
+	EVENT_FILL   BookEventType = "FILL"   // a resting order trades
+	EVENT_CANCEL BookEventType = "CANCEL" // a resting order leaves without trading the rest
+	EVENT_TRADE  BookEventType = "TRADE"
+)
+
+// BookEvent is one change to an order book. Sequence numbers the events of
+// a symbol from 1 without gaps; EngineSequence orders events across every
+// symbol. Icebergs only ever show their visible slice.
+type BookEvent struct {
+	Sequence       uint64        `json:"sequence"`
+	EngineSequence uint64        `json:"engine_sequence"`
+	Type           BookEventType `json:"type"`
+	Symbol         string        `json:"symbol"`
+	OrderID        string        `json:"order_id,omitempty"` // the resting order; empty for trades
+	TradeID        string        `json:"trade_id,omitempty"` // trades and fills only
+	Side           OrderSide     `json:"side"`               // of the order; the aggressor's for trades
+	Price          int64         `json:"price"`
+	Quantity       int64         `json:"quantity"`         // visible quantity after adds and amends, removed by cancels, traded by fills and trades
+	Status         OrderStatus   `json:"status,omitempty"` // of the order after the event
+	Timestamp      int64         `json:"timestamp_ns"`     // Unix nanoseconds
+}
+
+// recordEvent numbers an event and adds it to the tape. Must run on the
+// book's goroutine.
+func (ob *OrderBook) recordEvent(event BookEvent) {
+	ob.EventSequence++
+	event.Sequence = ob.EventSequence
+	if ob.engineSequence != nil {
+		event.EngineSequence = ob.engineSequence.Add(1)
+	}
+	event.Symbol = ob.Symbol
+	if ob.cmd != nil {
+		event.Timestamp = ob.cmd.Time
+	}
+
+	ob.recentEvents = append(ob.recentEvents, event)
+	if len(ob.recentEvents) > maxRecentEvents {
+		ob.recentEvents = append(ob.recentEvents[:0:0], ob.recentEvents[len(ob.recentEvents)-maxRecentEvents/2:]...)
+	}
+}
+
+// orderEvent records an event about a resting order. Must run on the
+// book's goroutine.
+func (ob *OrderBook) orderEvent(eventType BookEventType, order *Order, quantity int64) {
+	ob.recordEvent(BookEvent{
+		Type:     eventType,
+		OrderID:  order.ID,
+		Side:     order.Side,
+		Price:    order.Price,
+		Quantity: quantity,
+		Status:   order.Status,
+	})
+}
+
+// fillEvent records a trade against a resting order. Must run on the
+// book's goroutine.
+func (ob *OrderBook) fillEvent(order *Order, trade Trade) {
+	ob.recordEvent(BookEvent{
+		Type:     EVENT_FILL,
+		OrderID:  order.ID,
+		TradeID:  trade.ID,
+		Side:     order.Side,
+		Price:    trade.Price,
+		Quantity: trade.Quantity,
+		Status:   order.Status,
+	})
+}
+
+// eventsAfter returns up to limit events following sequence number after.
+// Must run on the book's goroutine.
+func (ob *OrderBook) eventsAfter(after uint64, limit int) ([]BookEvent, error) {
+	if after >= ob.EventSequence {
+		return []BookEvent{}, nil
+	}
+
+	first := ob.EventSequence - uint64(len(ob.recentEvents)) + 1
+	if after+1 < first {
+		return nil, fmt.Errorf("%w: the oldest kept is %d", ErrEventsUnavailable, first)
+	}
+
+	events := ob.recentEvents[after+1-first:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return append([]BookEvent{}, events...), nil
+}
+
+// GetEvents returns up to limit events in a symbol after sequence number
+// after, oldest first
+func (me *MatchingEngine) GetEvents(symbol string, after uint64, limit int) ([]BookEvent, error) {
+	book, exists := me.book(symbol)
+	if !exists {
+		return nil, fmt.Errorf("symbol not found")
+	}
+
+	var events []BookEvent
+	var err error
+	if cmdErr := book.exec(func() {
+		events, err = book.eventsAfter(after, limit)
+	}); cmdErr != nil {
+		return nil, cmdErr
+	}
+	return events, err
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryEntry is a resting order scheduled to expire
+type expiryEntry struct {
+	expireAt int64 // Unix milliseconds
+	seq      uint64
+	orderID  string
+	symbol   string
+}
+
+// expiryQueue is a min-heap of entries ordered by expiry time, then by
+// scheduling order so orders expiring together are handled deterministically
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int { return len(q) }
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].expireAt != q[j].expireAt {
+		return q[i].expireAt < q[j].expireAt
+	}
+	return q[i].seq < q[j].seq
+}
+func (q expiryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)   { *q = append(*q, x.(expiryEntry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	*q = old[:n-1]
+	return entry
+}
+
+// expiryScheduler tracks GTD and DAY orders until they expire. Entries for
+// orders that are filled or cancelled first are skipped when they come due.
+type expiryScheduler struct {
+	queue   expiryQueue
+	nextSeq uint64
+	mu      sync.Mutex
+}
+
+// schedule registers an order for expiry
+func (es *expiryScheduler) schedule(order *Order) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	es.nextSeq++
+	heap.Push(&es.queue, expiryEntry{
+		expireAt: order.ExpireAt,
+		seq:      es.nextSeq,
+		orderID:  order.ID,
+		symbol:   order.Symbol,
+	})
+}
+
+// popDue removes and returns every entry due at or before now
+func (es *expiryScheduler) popDue(now int64) []expiryEntry {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	due := []expiryEntry{}
+	for len(es.queue) > 0 && es.queue[0].expireAt <= now {
+		due = append(due, heap.Pop(&es.queue).(expiryEntry))
+	}
+	return due
+}
+
+// ExpireOrders expires every GTD and DAY order whose expiry time has been
+// reached according to the engine clock. Expired orders are removed from
+// their book, marked EXPIRED and passed to the expiry handler. Returns the
+// IDs of the expired orders.
+func (me *MatchingEngine) ExpireOrders() []string {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	expired := []Order{}
+	if me.checkLog() != nil {
+		return []string{}
+	}
+
+	now := me.clock.Now()
+	var seq uint64
+	var batches []*eventBatch
+	for _, entry := range me.expiry.popDue(now.UnixMilli()) {
+		book, exists := me.book(entry.symbol)
+		if !exists {
+			continue
+		}
+
+		// Expiry must not be dropped, so wait for room in a full queue
+		book.execWait(func() {
+			order, exists := book.Orders[entry.orderID]
+			if !exists {
+				return
+			}
+			cmd := &Command{Type: CMD_EXPIRE, Time: now.UnixNano(), OrderID: order.ID}
+			ok := false
+			events := book.applyCommand(cmd, func() {
+				ok = me.expireOrder(book, order)
+			})
+			if !ok {
+				return
+			}
+			expired = append(expired, *order)
+			if cmdSeq, err := me.logCommand(cmd); err == nil {
+				seq = max(seq, cmdSeq)
+				batches = append(batches, events)
+			} else {
+				events.release(false)
+			}
+		})
+	}
+
+	// Synced once for the whole sweep, before anyone hears of it
+	err := me.syncCommand(seq)
+	for _, events := range batches {
+		events.release(err == nil)
+	}
+
+	ids := make([]string, 0, len(expired))
+	for _, order := range expired {
+		ids = append(ids, order.ID)
+		if me.onExpire != nil {
+			me.onExpire(order)
+		}
+	}
+	return ids
+}
+
+// expireOrder expires a live order and takes it out of the book. Returns
+// false if the order is no longer live. Must run on the book's goroutine.
+func (me *MatchingEngine) expireOrder(book *OrderBook, order *Order) bool {
+	if !order.isLive() {
+		return false
+	}
+	order.Status = EXPIRED
+	book.removeOrder(order)
+	me.releaseFunds(order)
+	me.accounts.trackOpen(order)
+	book.emit(ORDER_EXPIRED, order, nil)
+	return true
+}
+
+// StartExpiry runs ExpireOrders every interval in the background until the
+// returned stop function is called
+func (me *MatchingEngine) StartExpiry(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				me.ExpireOrders()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FeeAccountID is the ledger account that collects trading fees and pays
+// maker rebates
+const FeeAccountID = "FEES"
+
+// FeeSchedule sets maker and taker fee rates in basis points of a trade's
+// notional (100 = 1%). A negative maker rate is a rebate.
+type FeeSchedule struct {
+	Symbol   string `json:"symbol,omitempty"` // empty applies to every symbol
+	Tier     string `json:"tier,omitempty"`   // empty applies to every tier
+	MakerBps int64  `json:"maker_bps"`
+	TakerBps int64  `json:"taker_bps"`
+}
+
+// validate checks the rates are sane and that a maker rebate never exceeds
+// the taker fee, so the venue does not pay out on a trade
+func (fs FeeSchedule) validate() error {
+	if fs.TakerBps < 0 || fs.TakerBps > 10000 || fs.MakerBps > 10000 {
+		return fmt.Errorf("taker fee must be between 0 and 10000 bps and maker fee at most 10000 bps")
+	}
+	if fs.MakerBps < -fs.TakerBps {
+		return fmt.Errorf("maker rebate cannot exceed the taker fee")
+	}
+	return nil
+}
+
+// FeeRevenue sums the fees charged on one symbol's trades
+type FeeRevenue struct {
+	Symbol    string `json:"symbol"`
+	Trades    int64  `json:"trades"`
+	Notional  int64  `json:"notional"`
+	MakerFees int64  `json:"maker_fees"` // negative when rebates exceed fees
+	TakerFees int64  `json:"taker_fees"`
+	Net       int64  `json:"net"`
+}
+
+// feeKey identifies a schedule by symbol and tier, either of which may be
+// empty to match everything
+type feeKey struct {
+	symbol string
+	tier   string
+}
+
+// feeManager holds the fee schedules and account tiers. Revenue is kept by
+// each book on its own goroutine.
+type feeManager struct {
+	schedules map[feeKey]FeeSchedule
+	tiers     map[string]string // account -> tier
+	mu        sync.RWMutex
+}
+
+// SetFeeSchedule sets the rates for a symbol and account tier. Leave
+// Symbol or Tier empty to cover every symbol or tier. The most specific
+// schedule wins: symbol and tier, then tier, then symbol, then the default.
+func (me *MatchingEngine) SetFeeSchedule(schedule FeeSchedule) error {
+	return me.setFeeSchedule(&Command{Type: CMD_SET_FEE_SCHEDULE, Fees: &schedule})
+}
+
+// setFeeSchedule runs a fee schedule command. Fees are read by book
+// commands without being logged with them, so the change waits for every
+// command in progress to be applied and logged, and none starts until it
+// is logged too; replay then charges each trade the fees it had.
+func (me *MatchingEngine) setFeeSchedule(cmd *Command) error {
+	me.applying.Lock()
+	defer me.applying.Unlock()
+
+	schedule := *cmd.Fees
+	if err := schedule.validate(); err != nil {
+		return err
+	}
+	if err := me.checkLog(); err != nil {
+		return err
+	}
+
+	me.fees.mu.Lock()
+	if me.fees.schedules == nil {
+		me.fees.schedules = make(map[feeKey]FeeSchedule)
+	}
+	me.fees.schedules[feeKey{schedule.Symbol, schedule.Tier}] = schedule
+	seq, err := me.logCommand(cmd)
+	me.fees.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return me.syncCommand(seq)
+}
+
+// GetFeeSchedules returns every configured fee schedule
+func (me *MatchingEngine) GetFeeSchedules() []FeeSchedule {
+	me.fees.mu.RLock()
+	defer me.fees.mu.RUnlock()
+
+	schedules := make([]FeeSchedule, 0, len(me.fees.schedules))
+	for _, schedule := range me.fees.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].Symbol != schedules[j].Symbol {
+			return schedules[i].Symbol < schedules[j].Symbol
+		}
+		return schedules[i].Tier < schedules[j].Tier
+	})
+	return schedules
+}
+
+// SetAccountFeeTier puts an account in a fee tier. An empty tier removes
+// it from any tier.
+func (me *MatchingEngine) SetAccountFeeTier(accountID, tier string) error {
+	return me.setAccountFeeTier(&Command{Type: CMD_SET_ACCOUNT_FEE_TIER, AccountID: accountID, Tier: tier})
+}
+
+// setAccountFeeTier runs a fee tier command, ordered with book commands
+// like setFeeSchedule
+func (me *MatchingEngine) setAccountFeeTier(cmd *Command) error {
+	me.applying.Lock()
+	defer me.applying.Unlock()
+
+	accountID, tier := cmd.AccountID, cmd.Tier
+	if accountID == "" {
+		return fmt.Errorf("account ID is required")
+	}
+	if err := me.checkLog(); err != nil {
+		return err
+	}
+
+	me.fees.mu.Lock()
+	if me.fees.tiers == nil {
+		me.fees.tiers = make(map[string]string)
+	}
+	if tier == "" {
+		delete(me.fees.tiers, accountID)
+	} else {
+		me.fees.tiers[accountID] = tier
+	}
+	seq, err := me.logCommand(cmd)
+	me.fees.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return me.syncCommand(seq)
+}
+
+// schedule returns the rates that apply to an account trading a symbol.
+// Caller must hold the fee lock.
+func (fm *feeManager) schedule(accountID, symbol string) FeeSchedule {
+	tier := fm.tiers[accountID]
+	for _, key := range []feeKey{{symbol, tier}, {"", tier}, {symbol, ""}, {"", ""}} {
+		if schedule, exists := fm.schedules[key]; exists {
+			return schedule
+		}
+	}
+	return FeeSchedule{}
+}
+
+// maxFeeBps returns the highest rate an account could pay on a symbol, for
+// sizing the funds held by buy orders
+func (fm *feeManager) maxFeeBps(accountID, symbol string) int64 {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	schedule := fm.schedule(accountID, symbol)
+	return max(schedule.MakerBps, schedule.TakerBps, 0)
+}
+
+// feeFor returns bps of notional. Fees round up and rebates round toward
+// zero, so rounding never favours the account. Splitting notional avoids
+// overflowing int64 on large trades.
+func feeFor(notional, bps int64) int64 {
+	whole, part := notional/10000, notional%10000
+	if bps >= 0 {
+		return whole*bps + (part*bps+9999)/10000
+	}
+	return whole*bps + part*bps/10000
+}
+
+// applyFees fills in the maker/taker fields and fees of a trade in book
+// between a resting maker and an incoming taker, and records the revenue.
+// With a ledger the buyer never pays more than its order holds for fees,
+// so neither rounding nor a fee schedule raised while the order was open
+// can overdraw it. The fee lock is only read-held, so books never wait on
+// each other here. Must run on the book's goroutine.
+func (me *MatchingEngine) applyFees(book *OrderBook, trade *Trade, maker, taker *Order) {
+	trade.MakerSide = maker.Side
+	trade.TakerSide = taker.Side
+
+	notional := trade.Price * trade.Quantity
+	buyer := taker
+	if maker.Side == BUY {
+		buyer = maker
+	}
+	cover, held := me.feeCover(buyer)
+
+	me.fees.mu.RLock()
+	trade.MakerFee = feeFor(notional, me.fees.schedule(maker.AccountID, book.Symbol).MakerBps)
+	trade.TakerFee = feeFor(notional, me.fees.schedule(taker.AccountID, book.Symbol).TakerBps)
+	me.fees.mu.RUnlock()
+	if held && buyer == maker {
+		trade.MakerFee = min(trade.MakerFee, cover)
+	} else if held {
+		trade.TakerFee = min(trade.TakerFee, cover)
+	}
+
+	revenue := &book.feeRevenue
+	revenue.Symbol = book.Symbol
+	revenue.Trades++
+	revenue.Notional += notional
+	revenue.MakerFees += trade.MakerFee
+	revenue.TakerFees += trade.TakerFee
+	revenue.Net += trade.MakerFee + trade.TakerFee
+}
+
+// GetFeeRevenue returns the fees collected on each symbol that has traded,
+// sorted by symbol, along with the total across all symbols
+func (me *MatchingEngine) GetFeeRevenue() ([]FeeRevenue, FeeRevenue, error) {
+	bySymbol := []FeeRevenue{}
+	total := FeeRevenue{}
+	for _, book := range me.allBooks() {
+		var revenue FeeRevenue
+		if err := book.exec(func() {
+			revenue = book.feeRevenue
+		}); err != nil {
+			return nil, FeeRevenue{}, err
+		}
+		if revenue.Trades == 0 {
+			continue
+		}
+		bySymbol = append(bySymbol, revenue)
+		total.Trades += revenue.Trades
+		total.Notional += revenue.Notional
+		total.MakerFees += revenue.MakerFees
+		total.TakerFees += revenue.TakerFees
+		total.Net += revenue.Net
+	}
+	sort.Slice(bySymbol, func(i, j int) bool {
+		return bySymbol[i].Symbol < bySymbol[j].Symbol
+	})
+	return bySymbol, total, nil
+}
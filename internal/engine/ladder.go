@@ -0,0 +1,153 @@
+package engine
+
+import "iter"
+
+// maxLadderHeight caps the skiplist height; with a 1/4 promotion chance it
+// comfortably covers millions of price levels
+const maxLadderHeight = 16
+
+// ladderNode is one price level in the skiplist
+type ladderNode struct {
+	level *PriceLevel
+	next  []*ladderNode
+}
+
+// PriceLadder holds one side of the book: price levels ordered best first in
+// a skiplist, plus a price -> level map. Looking up a level and reading the
+// best level are O(1); adding and removing a level are O(log n).
+type PriceLadder struct {
+	descending bool // bids: highest price first
+
+	head   ladderNode // sentinel; head.next[i] is the first node at height i
+	height int
+	nodes  map[int64]*ladderNode
+
+	// xorshift state for node heights. A fixed seed keeps the structure,
+	// and so performance, identical across runs with the same input.
+	rng uint64
+}
+
+// NewPriceLadder creates an empty ladder. Bids are descending (highest
+// price first), asks ascending.
+func NewPriceLadder(descending bool) *PriceLadder {
+	return &PriceLadder{
+		descending: descending,
+		head:       ladderNode{next: make([]*ladderNode, maxLadderHeight)},
+		height:     1,
+		nodes:      make(map[int64]*ladderNode),
+		rng:        0x9E3779B97F4A7C15,
+	}
+}
+
+// Len returns the number of price levels
+func (pl *PriceLadder) Len() int {
+	return len(pl.nodes)
+}
+
+// Best returns the best price level, or nil if the ladder is empty
+func (pl *PriceLadder) Best() *PriceLevel {
+	if first := pl.head.next[0]; first != nil {
+		return first.level
+	}
+	return nil
+}
+
+// Get returns the level at price, or nil if there is none
+func (pl *PriceLadder) Get(price int64) *PriceLevel {
+	if n, exists := pl.nodes[price]; exists {
+		return n.level
+	}
+	return nil
+}
+
+// All iterates over the price levels from best to worst. The ladder must
+// not be changed during iteration.
+func (pl *PriceLadder) All() iter.Seq[*PriceLevel] {
+	return func(yield func(*PriceLevel) bool) {
+		for n := pl.head.next[0]; n != nil; n = n.next[0] {
+			if !yield(n.level) {
+				return
+			}
+		}
+	}
+}
+
+// before reports whether price a sorts ahead of price b on this side
+func (pl *PriceLadder) before(a, b int64) bool {
+	if pl.descending {
+		return a > b
+	}
+	return a < b
+}
+
+// getOrCreate returns the level at price, inserting an empty one if needed
+func (pl *PriceLadder) getOrCreate(price int64) *PriceLevel {
+	if n, exists := pl.nodes[price]; exists {
+		return n.level
+	}
+
+	// Find the last node before price at every height
+	var update [maxLadderHeight]*ladderNode
+	x := &pl.head
+	for i := pl.height - 1; i >= 0; i-- {
+		for x.next[i] != nil && pl.before(x.next[i].level.Price, price) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	height := pl.randomHeight()
+	for i := pl.height; i < height; i++ {
+		update[i] = &pl.head
+	}
+	pl.height = max(pl.height, height)
+
+	n := &ladderNode{
+		level: &PriceLevel{Price: price},
+		next:  make([]*ladderNode, height),
+	}
+	for i := 0; i < height; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	pl.nodes[price] = n
+	return n.level
+}
+
+// remove deletes the level at price. Removing the best level only touches
+// the head, so draining the top of the book stays cheap.
+func (pl *PriceLadder) remove(price int64) {
+	n, exists := pl.nodes[price]
+	if !exists {
+		return
+	}
+
+	x := &pl.head
+	for i := pl.height - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i] != n && pl.before(x.next[i].level.Price, price) {
+			x = x.next[i]
+		}
+		if x.next[i] == n {
+			x.next[i] = n.next[i]
+		}
+	}
+	for pl.height > 1 && pl.head.next[pl.height-1] == nil {
+		pl.height--
+	}
+	delete(pl.nodes, price)
+}
+
+// randomHeight picks a node height, promoting with probability 1/4
+func (pl *PriceLadder) randomHeight() int {
+	height := 1
+	for height < maxLadderHeight {
+		pl.rng ^= pl.rng << 13
+		pl.rng ^= pl.rng >> 7
+		pl.rng ^= pl.rng << 17
+		if pl.rng&3 != 0 {
+			break
+		}
+		height++
+	}
+	return height
+}
@@ -0,0 +1,478 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Balance is an account's holding of one asset. Held funds are reserved
+// for open orders and cannot be withdrawn or used by other orders.
+type Balance struct {
+	Asset     string `json:"asset"`
+	Available int64  `json:"available"`
+	Held      int64  `json:"held"`
+}
+
+// hold is the amount of one asset reserved for an open order
+type hold struct {
+	accountID string
+	asset     string
+	amount    int64
+
+	// Amount consumed per unit filled: 1 for sells, the limit price for
+	// limit buys, 0 for market buys, which consume the trade price
+	perUnit int64
+
+	// Extra quote held by buys to pay trading fees
+	fees int64
+}
+
+// ledger keeps per-account, per-asset balances and the holds backing open
+// orders. Funds only move between accounts through trades, so the total of
+// each asset changes only on deposit and withdrawal.
+//
+// The ledger keeps one engine-wide lock, taken by every hold and trade. A
+// quote asset such as USD backs orders on many symbols, and every trade
+// pays the fee account, so books on different symbols share balances and
+// must check and move funds atomically. It is held for one hold or
+// settlement at a time, never across a match.
+type ledger struct {
+	balances map[string]map[string]*Balance // account -> asset -> balance
+	holds    map[string]*hold               // order ID -> hold
+	mu       sync.Mutex
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		balances: make(map[string]map[string]*Balance),
+		holds:    make(map[string]*hold),
+	}
+}
+
+// WithLedger makes every order require an account with enough funds.
+// Limit orders hold funds while open, market orders are checked against
+// the cost of the liquidity they would take.
+func WithLedger() Option {
+	return func(me *MatchingEngine) {
+		me.ledger = newLedger()
+	}
+}
+
+// symbolAssets splits a symbol such as BTC-USD or ETH/BTC into its base and
+// quote assets. Symbols without a separator are quoted in USD.
+func symbolAssets(symbol string) (base, quote string) {
+	if i := strings.IndexAny(symbol, "-/"); i > 0 && i < len(symbol)-1 {
+		return symbol[:i], symbol[i+1:]
+	}
+	return symbol, "USD"
+}
+
+// balance returns an account's balance of asset, creating it if needed.
+// Caller must hold the ledger lock.
+func (l *ledger) balance(accountID, asset string) *Balance {
+	assets, exists := l.balances[accountID]
+	if !exists {
+		assets = make(map[string]*Balance)
+		l.balances[accountID] = assets
+	}
+	b, exists := assets[asset]
+	if !exists {
+		b = &Balance{Asset: asset}
+		assets[asset] = b
+	}
+	return b
+}
+
+// reserve moves amount plus fees from available to held for an order. It
+// fails if the account does not have enough available, unless force is
+// set.
+func (l *ledger) reserve(orderID, accountID, asset string, amount, perUnit, fees int64, force bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.balance(accountID, asset)
+	if b.Available < amount+fees && !force {
+		return false
+	}
+	b.Available -= amount + fees
+	b.Held += amount + fees
+	l.holds[orderID] = &hold{accountID: accountID, asset: asset, amount: amount, perUnit: perUnit, fees: fees}
+	return true
+}
+
+// resize changes an order's hold to amount plus fees at a new per-unit
+// rate, failing if the account cannot cover an increase unless force is
+// set
+func (l *ledger) resize(orderID string, amount, perUnit, fees int64, force bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, exists := l.holds[orderID]
+	if !exists {
+		return true
+	}
+	delta := amount + fees - h.amount - h.fees
+	b := l.balance(h.accountID, h.asset)
+	if delta > b.Available && !force {
+		return false
+	}
+	b.Available -= delta
+	b.Held += delta
+	h.amount = amount
+	h.perUnit = perUnit
+	h.fees = fees
+	return true
+}
+
+// release returns whatever is left of an order's hold to available
+func (l *ledger) release(orderID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, exists := l.holds[orderID]
+	if !exists {
+		return
+	}
+	b := l.balance(h.accountID, h.asset)
+	b.Available += h.amount + h.fees
+	b.Held -= h.amount + h.fees
+	delete(l.holds, orderID)
+}
+
+// shrink releases the part of an order's hold covering quantity units that
+// will never be filled. Market buy holds are released when the order ends.
+func (l *ledger) shrink(orderID string, quantity int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, exists := l.holds[orderID]
+	if !exists || h.perUnit == 0 {
+		return
+	}
+	amount := min(h.perUnit*quantity, h.amount)
+	b := l.balance(h.accountID, h.asset)
+	b.Available += amount
+	b.Held -= amount
+	h.amount -= amount
+}
+
+// consume takes the funds for quantity units filled at price out of an
+// order's hold, returning the amount taken. Caller must hold the ledger
+// lock.
+func (l *ledger) consume(orderID string, quantity, price int64) int64 {
+	h, exists := l.holds[orderID]
+	if !exists {
+		return 0
+	}
+	perUnit := h.perUnit
+	if perUnit == 0 {
+		perUnit = price
+	}
+	amount := min(perUnit*quantity, h.amount)
+	h.amount -= amount
+	l.balance(h.accountID, h.asset).Held -= amount
+	return amount
+}
+
+// chargeFee moves a trade fee in asset from an account to the fee account.
+// Buys pay out of the fee part of their hold first. A negative fee is a
+// rebate paid by the fee account. Caller must hold the ledger lock.
+func (l *ledger) chargeFee(orderID, accountID, asset string, fee int64) {
+	if fee == 0 {
+		return
+	}
+
+	b := l.balance(accountID, asset)
+	if h, exists := l.holds[orderID]; exists && fee > 0 && h.asset == asset {
+		fromHold := min(fee, h.fees)
+		h.fees -= fromHold
+		b.Held -= fromHold
+		b.Available += fromHold
+	}
+	b.Available -= fee
+	l.balance(FeeAccountID, asset).Available += fee
+}
+
+// settle moves the assets of a trade between buyer and seller and pays its
+// fees in the quote asset. Each side pays out of its order's hold; anything
+// held beyond the actual cost, such as a limit buy filled below its limit,
+// goes back to available.
+func (l *ledger) settle(trade Trade, base, quote string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cost := trade.Price * trade.Quantity
+
+	// Buyer pays quote and receives base
+	taken := l.consume(trade.BuyerID, trade.Quantity, trade.Price)
+	l.balance(trade.BuyerAccountID, quote).Available += taken - cost
+	l.balance(trade.BuyerAccountID, base).Available += trade.Quantity
+
+	// Seller delivers base and receives quote
+	taken = l.consume(trade.SellerID, trade.Quantity, trade.Price)
+	l.balance(trade.SellerAccountID, base).Available += taken - trade.Quantity
+	l.balance(trade.SellerAccountID, quote).Available += cost
+
+	buyerFee, sellerFee := trade.TakerFee, trade.MakerFee
+	if trade.TakerSide == SELL {
+		buyerFee, sellerFee = trade.MakerFee, trade.TakerFee
+	}
+	l.chargeFee(trade.BuyerID, trade.BuyerAccountID, quote, buyerFee)
+	l.chargeFee(trade.SellerID, trade.SellerAccountID, quote, sellerFee)
+}
+
+// reserveFunds places the hold backing an order before it can trade or
+// rest. Buy stops that execute as market orders are only checked once
+// triggered, when their cost is known. Orders already holding funds are
+// left alone. Must run on the book's goroutine.
+func (me *MatchingEngine) reserveFunds(book *OrderBook, order *Order) bool {
+	if me.ledger == nil {
+		return true
+	}
+	me.ledger.mu.Lock()
+	_, held := me.ledger.holds[order.ID]
+	me.ledger.mu.Unlock()
+	if held {
+		return true
+	}
+
+	base, quote := symbolAssets(order.Symbol)
+	remaining := order.Quantity - order.FilledQuantity
+
+	// Buys also hold enough to pay the highest fee they could be charged
+	return me.fundsDecision(book, order.ID, func(force bool) bool {
+		switch orderType := order.executionType(); {
+		case order.Side == SELL:
+			return me.ledger.reserve(order.ID, order.AccountID, base, remaining, 1, 0, force)
+		case orderType == LIMIT || orderType == STOP_LIMIT:
+			cost := order.Price * remaining
+			return me.ledger.reserve(order.ID, order.AccountID, quote, cost, order.Price, me.feeHeadroom(order, cost, remaining), force)
+		case orderType == MARKET:
+			cost := book.sweepCost(remaining, order.AccountID)
+			return me.ledger.reserve(order.ID, order.AccountID, quote, cost, 0, me.feeHeadroom(order, cost, remaining), force)
+		}
+		return true
+	})
+}
+
+// fundsDecision decides whether an order in the command running on book
+// gets the funds try asks for, and records the answer in the command.
+// Balances also change outside book commands, so a deposit or a release
+// can be logged on the other side of the order it made a difference to; a
+// replayed command therefore repeats the answers it logged, forcing the
+// holds it got the first time. Must run on the book's goroutine.
+func (me *MatchingEngine) fundsDecision(book *OrderBook, orderID string, try func(force bool) bool) bool {
+	cmd := book.cmd
+	if cmd.replayed {
+		for _, id := range cmd.FundsRejections {
+			if id == orderID {
+				return false
+			}
+		}
+		return try(true)
+	}
+
+	if try(false) {
+		return true
+	}
+	cmd.FundsRejections = append(cmd.FundsRejections, orderID)
+	return false
+}
+
+// feeHeadroom returns the most a buy of quantity costing cost could pay in
+// fees. Each fill rounds its fee up on its own, so a buy filled one unit at
+// a time can pay up to a cent more than the fee on its total for every
+// fill after the first.
+func (me *MatchingEngine) feeHeadroom(order *Order, cost, quantity int64) int64 {
+	bps := me.fees.maxFeeBps(order.AccountID, order.Symbol)
+	if bps == 0 {
+		return 0
+	}
+	return feeFor(cost, bps) + quantity - 1
+}
+
+// feeCover returns what is left of the fees held for a buy order, the most
+// it can be charged. held is false without a ledger or a hold.
+func (me *MatchingEngine) feeCover(order *Order) (cover int64, held bool) {
+	if me.ledger == nil {
+		return 0, false
+	}
+	me.ledger.mu.Lock()
+	defer me.ledger.mu.Unlock()
+
+	h, exists := me.ledger.holds[order.ID]
+	if !exists {
+		return 0, false
+	}
+	return h.fees, true
+}
+
+// resizeHold adjusts an open order's hold for an amendment to price and
+// total quantity. Must run on the book's goroutine.
+func (me *MatchingEngine) resizeHold(book *OrderBook, order *Order, price, quantity int64) bool {
+	if me.ledger == nil {
+		return true
+	}
+	remaining := quantity - order.FilledQuantity
+	return me.fundsDecision(book, order.ID, func(force bool) bool {
+		if order.Side == SELL {
+			return me.ledger.resize(order.ID, remaining, 1, 0, force)
+		}
+		return me.ledger.resize(order.ID, price*remaining, price, me.feeHeadroom(order, price*remaining, remaining), force)
+	})
+}
+
+// releaseFunds returns what is left of a finished order's hold
+func (me *MatchingEngine) releaseFunds(order *Order) {
+	if me.ledger != nil {
+		me.ledger.release(order.ID)
+	}
+}
+
+// shrinkFunds releases the hold for quantity an order will no longer fill
+func (me *MatchingEngine) shrinkFunds(order *Order, quantity int64) {
+	if me.ledger != nil {
+		me.ledger.shrink(order.ID, quantity)
+	}
+}
+
+// settleTrade moves funds between the counterparties of a trade in book
+func (me *MatchingEngine) settleTrade(book *OrderBook, trade Trade) {
+	if me.ledger == nil {
+		return
+	}
+	base, quote := symbolAssets(book.Symbol)
+	me.ledger.settle(trade, base, quote)
+}
+
+// errLedgerDisabled is returned by balance operations without WithLedger
+var errLedgerDisabled = fmt.Errorf("ledger is not enabled")
+
+// Deposit credits amount of asset to an account's available balance
+func (me *MatchingEngine) Deposit(accountID, asset string, amount int64) (Balance, error) {
+	return me.deposit(&Command{Type: CMD_DEPOSIT, AccountID: accountID, Asset: asset, Amount: amount})
+}
+
+// deposit runs a deposit command
+func (me *MatchingEngine) deposit(cmd *Command) (Balance, error) {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	accountID, asset, amount := cmd.AccountID, cmd.Asset, cmd.Amount
+	if me.ledger == nil {
+		return Balance{}, errLedgerDisabled
+	}
+	if accountID == "" || asset == "" {
+		return Balance{}, fmt.Errorf("account ID and asset are required")
+	}
+	if amount <= 0 {
+		return Balance{}, fmt.Errorf("amount must be positive")
+	}
+	if err := me.checkLog(); err != nil {
+		return Balance{}, err
+	}
+
+	// Logged under the ledger lock, so changes to one balance are logged in
+	// the order they were made
+	me.ledger.mu.Lock()
+	b := me.ledger.balance(accountID, asset)
+	b.Available += amount
+	balance := *b
+	seq, err := me.logCommand(cmd)
+	me.ledger.mu.Unlock()
+
+	if err == nil {
+		err = me.syncCommand(seq)
+	}
+	if err != nil {
+		return Balance{}, err
+	}
+	return balance, nil
+}
+
+// Withdraw debits amount of asset from an account's available balance.
+// Funds held for open orders cannot be withdrawn.
+func (me *MatchingEngine) Withdraw(accountID, asset string, amount int64) (Balance, error) {
+	return me.withdraw(&Command{Type: CMD_WITHDRAW, AccountID: accountID, Asset: asset, Amount: amount})
+}
+
+// withdraw runs a withdraw command
+func (me *MatchingEngine) withdraw(cmd *Command) (Balance, error) {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	accountID, asset, amount := cmd.AccountID, cmd.Asset, cmd.Amount
+	if me.ledger == nil {
+		return Balance{}, errLedgerDisabled
+	}
+	if accountID == "" || asset == "" {
+		return Balance{}, fmt.Errorf("account ID and asset are required")
+	}
+	if amount <= 0 {
+		return Balance{}, fmt.Errorf("amount must be positive")
+	}
+	if err := me.checkLog(); err != nil {
+		return Balance{}, err
+	}
+
+	// A replayed withdrawal was covered when it was made, though funds
+	// released by commands logged after it may not be back yet
+	me.ledger.mu.Lock()
+	b := me.ledger.balance(accountID, asset)
+	if b.Available < amount && !cmd.replayed {
+		me.ledger.mu.Unlock()
+		return *b, fmt.Errorf("insufficient funds: %d %s available", b.Available, asset)
+	}
+	b.Available -= amount
+	balance := *b
+	seq, err := me.logCommand(cmd)
+	me.ledger.mu.Unlock()
+
+	if err == nil {
+		err = me.syncCommand(seq)
+	}
+	if err != nil {
+		return Balance{}, err
+	}
+	return balance, nil
+}
+
+// GetBalances returns an account's balances, sorted by asset
+func (me *MatchingEngine) GetBalances(accountID string) ([]Balance, error) {
+	if me.ledger == nil {
+		return nil, errLedgerDisabled
+	}
+
+	me.ledger.mu.Lock()
+	defer me.ledger.mu.Unlock()
+
+	balances := make([]Balance, 0, len(me.ledger.balances[accountID]))
+	for _, b := range me.ledger.balances[accountID] {
+		balances = append(balances, *b)
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Asset < balances[j].Asset
+	})
+	return balances, nil
+}
+
+// AssetTotals returns the total of each asset across all accounts,
+// available and held. Trades never change these totals.
+func (me *MatchingEngine) AssetTotals() map[string]int64 {
+	totals := make(map[string]int64)
+	if me.ledger == nil {
+		return totals
+	}
+
+	me.ledger.mu.Lock()
+	defer me.ledger.mu.Unlock()
+
+	for _, assets := range me.ledger.balances {
+		for asset, b := range assets {
+			totals[asset] += b.Available + b.Held
+		}
+	}
+	return totals
+}
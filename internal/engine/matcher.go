@@ -2,105 +2,630 @@ package engine
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
 )
 
-// MatchingEngine manages order books for multiple symbols
+// MatchingEngine manages order books for multiple symbols. Each book is
+// owned by its own goroutine: submits, cancels, amends and queries become
+// commands on that book's queue, so matching never takes a lock on the book.
 type MatchingEngine struct {
-	books map[string]*OrderBook // symbol -> OrderBook
-	mu    sync.RWMutex
+	books      sync.Map   // symbol -> *OrderBook
+	orders     sync.Map   // order ID -> *OrderBook holding it
+	mu         sync.Mutex // guards book creation and closed
+	closed     bool
+	queueDepth int
+	eventSeq   atomic.Uint64 // last book event numbered, across every symbol
+	bus        eventBus
+
+	clock        Clock
+	ids          IDGenerator
+	expiry       expiryScheduler
+	onExpire     func(Order)
+	clientOrders clientOrderRegistry
+	accounts     accountRegistry
+	risk         riskManager
+	ledger       *ledger // nil unless WithLedger is used
+	fees         feeManager
+
+	log    CommandLog // nil unless WithCommandLog is used
+	logErr atomic.Pointer[error]
+	logSeq atomic.Uint64 // last command logged or replayed
+
+	// Held shared by each command while it is applied and logged, and
+	// exclusively while a snapshot is taken or fees change
+	applying sync.RWMutex
+}
+
+// Option configures a MatchingEngine
+type Option func(*MatchingEngine)
+
+// WithClock sets the clock used for order and trade timestamps and
+// time-based behaviour such as order expiry. Defaults to the system clock.
+func WithClock(clock Clock) Option {
+	return func(me *MatchingEngine) {
+		me.clock = clock
+	}
+}
+
+// WithIDGenerator sets the generator of order and trade IDs. Defaults to
+// Snowflake IDs for node 0 on the engine's clock.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(me *MatchingEngine) {
+		me.ids = ids
+	}
+}
+
+// WithExpiryHandler registers a function called with a copy of every order
+// the engine expires
+func WithExpiryHandler(fn func(Order)) Option {
+	return func(me *MatchingEngine) {
+		me.onExpire = fn
+	}
 }
 
 // NewMatchingEngine creates a new matching engine
-func NewMatchingEngine() *MatchingEngine {
-	return &MatchingEngine{
-		books: make(map[string]*OrderBook),
+func NewMatchingEngine(opts ...Option) *MatchingEngine {
+	me := &MatchingEngine{
+		clock:      SystemClock{},
+		queueDepth: DefaultQueueDepth,
+	}
+
+	for _, opt := range opts {
+		opt(me)
 	}
+	if me.ids == nil {
+		// Node 0 is always valid
+		me.ids, _ = NewSnowflakeIDGenerator(0, me.clock)
+	}
+
+	return me
 }
 
-// GetOrCreateBook gets or creates an order book for a symbol
+// GetOrCreateBook gets or creates an order book for a symbol, starting the
+// goroutine that owns it
 func (me *MatchingEngine) GetOrCreateBook(symbol string) *OrderBook {
+	if book, exists := me.book(symbol); exists {
+		return book
+	}
+
 	me.mu.Lock()
 	defer me.mu.Unlock()
 
-	if book, exists := me.books[symbol]; exists {
+	if book, exists := me.book(symbol); exists {
 		return book
 	}
 
 	book := NewOrderBook(symbol)
-	me.books[symbol] = book
+	book.index = &me.orders
+	book.engineSequence = &me.eventSeq
+	book.bus = &me.bus
+	book.start(me.queueDepth)
+	if me.closed {
+		book.close()
+	}
+	me.books.Store(symbol, book)
 	return book
 }
 
+// book returns the order book for a symbol if it exists
+func (me *MatchingEngine) book(symbol string) (*OrderBook, bool) {
+	book, exists := me.books.Load(symbol)
+	if !exists {
+		return nil, false
+	}
+	return book.(*OrderBook), true
+}
+
+// allBooks returns every order book
+func (me *MatchingEngine) allBooks() []*OrderBook {
+	books := []*OrderBook{}
+	me.books.Range(func(_, book any) bool {
+		books = append(books, book.(*OrderBook))
+		return true
+	})
+	return books
+}
+
 // OrderResult represents the result of submitting an order
 type OrderResult struct {
-	OrderID          string      `json:"order_id"`
-	Status           OrderStatus `json:"status"`
-	FilledQuantity   int64       `json:"filled_quantity,omitempty"`
-	RemainingQuantity int64      `json:"remaining_quantity,omitempty"`
-	Trades           []Trade     `json:"trades,omitempty"`
-	Message          string      `json:"message,omitempty"`
+	OrderID           string       `json:"order_id"`
+	ClientOrderID     string       `json:"client_order_id,omitempty"`
+	Status            OrderStatus  `json:"status"`
+	FilledQuantity    int64        `json:"filled_quantity,omitempty"`
+	RemainingQuantity int64        `json:"remaining_quantity,omitempty"`
+	CancelledQuantity int64        `json:"cancelled_quantity,omitempty"`
+	Trades            []Trade      `json:"trades,omitempty"`
+	RejectReason      RejectReason `json:"reject_reason,omitempty"`
+	CancelReason      CancelReason `json:"cancel_reason,omitempty"`
+	Message           string       `json:"message,omitempty"`
+
+	// Self-trade prevention: quantity of this order that went unfilled and
+	// the resting orders from the same account that were cancelled
+	SelfTradePreventedQuantity int64    `json:"self_trade_prevented_quantity,omitempty"`
+	SelfTradeCancelledOrderIDs []string `json:"self_trade_cancelled_order_ids,omitempty"`
+
+	Duplicate bool `json:"duplicate,omitempty"` // resubmitted client order ID, original result returned
+}
+
+// OrderRequest describes an order to be submitted to the engine. Submits
+// are logged with their request, so its JSON names are part of the command
+// log format.
+type OrderRequest struct {
+	AccountID     string `json:"account_id,omitempty"`      // owner of the order
+	ClientOrderID string `json:"client_order_id,omitempty"` // optional, unique per account; makes submission idempotent
+
+	Symbol      string      `json:"symbol"`
+	Side        OrderSide   `json:"side"`
+	Type        OrderType   `json:"type"`
+	Price       int64       `json:"price,omitempty"`
+	Quantity    int64       `json:"quantity"`
+	TimeInForce TimeInForce `json:"time_in_force,omitempty"` // defaults to GTC
+	ExpireAt    int64       `json:"expire_at,omitempty"`     // Unix milliseconds, GTD only
+	StopPrice   int64       `json:"stop_price,omitempty"`    // STOP and STOP_LIMIT only
+
+	// Trailing stops follow the market by either a fixed amount in cents
+	// or a percentage in basis points (100 = 1%)
+	TrailAmount int64 `json:"trail_amount,omitempty"`
+	TrailBps    int64 `json:"trail_bps,omitempty"`
+
+	// DisplayQuantity makes a resting limit order an iceberg: only this
+	// much is shown in the book, the rest is a hidden reserve
+	DisplayQuantity int64 `json:"display_quantity,omitempty"`
+
+	// PostOnly orders never take liquidity. If the order would cross on
+	// arrival it is rejected, or with RepriceOnCross moved one tick behind
+	// the touch.
+	PostOnly       bool `json:"post_only,omitempty"`
+	RepriceOnCross bool `json:"reprice_on_cross,omitempty"`
+
+	// SelfTradePrevention decides what happens if this order would trade
+	// with a resting order from the same account. Defaults to the account's
+	// mode, or CANCEL_NEWEST.
+	SelfTradePrevention SelfTradePrevention `json:"self_trade_prevention,omitempty"`
 }
 
-// SubmitOrder submits an order and attempts to match it
+// SubmitOrder submits a good-till-cancel order and attempts to match it
 func (me *MatchingEngine) SubmitOrder(symbol string, side OrderSide, orderType OrderType, price, quantity int64) (*OrderResult, error) {
+	return me.Submit(OrderRequest{
+		Symbol:   symbol,
+		Side:     side,
+		Type:     orderType,
+		Price:    price,
+		Quantity: quantity,
+	})
+}
+
+// Submit submits an order request and attempts to match it. Requests with
+// a ClientOrderID are idempotent: resubmitting the same ID returns the
+// original result instead of creating another order.
+func (me *MatchingEngine) Submit(req OrderRequest) (*OrderResult, error) {
+	return me.submitCommand(&Command{Type: CMD_SUBMIT, Order: &req})
+}
+
+// submitCommand runs a submit command, through the client order ID
+// registry if the order has a client order ID
+func (me *MatchingEngine) submitCommand(cmd *Command) (*OrderResult, error) {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	if cmd.Order.ClientOrderID != "" {
+		return me.submitIdempotent(cmd)
+	}
+	return me.submit(cmd)
+}
+
+// submit validates, matches and rests a new order
+func (me *MatchingEngine) submit(cmd *Command) (*OrderResult, error) {
+	if err := me.checkLog(); err != nil {
+		return nil, err
+	}
+
+	req := cmd.Order
+	if req.TimeInForce == "" {
+		req.TimeInForce = GTC
+	}
+
 	// Validation
-	if quantity <= 0 {
+	if req.Quantity <= 0 {
 		return nil, fmt.Errorf("quantity must be positive")
 	}
-	if orderType == LIMIT && price <= 0 {
+	if req.Type != LIMIT && req.Type != MARKET && req.Type != STOP && req.Type != STOP_LIMIT && req.Type != TRAILING_STOP {
+		return nil, fmt.Errorf("unsupported order type: %s", req.Type)
+	}
+	if (req.Type == LIMIT || req.Type == STOP_LIMIT) && req.Price <= 0 {
 		return nil, fmt.Errorf("price must be positive for limit orders")
 	}
+	if (req.Type == STOP || req.Type == STOP_LIMIT) && req.StopPrice <= 0 {
+		return nil, fmt.Errorf("stop price must be positive for stop orders")
+	}
+	if req.Type == TRAILING_STOP && (req.TrailAmount > 0) == (req.TrailBps > 0) {
+		return nil, fmt.Errorf("trailing stops need exactly one of a positive trail amount or trail percentage")
+	}
+	if req.TimeInForce != GTC && req.TimeInForce != IOC && req.TimeInForce != FOK &&
+		req.TimeInForce != GTD && req.TimeInForce != DAY {
+		return nil, fmt.Errorf("unsupported time in force: %s", req.TimeInForce)
+	}
+	now := me.commandTime(cmd)
+	if req.TimeInForce == GTD && req.ExpireAt <= now.UnixMilli() {
+		return nil, fmt.Errorf("expiry time must be in the future for GTD orders")
+	}
+	if req.TimeInForce != GTD && req.ExpireAt != 0 {
+		return nil, fmt.Errorf("expiry time is only supported for GTD orders")
+	}
+	if req.DisplayQuantity < 0 || req.DisplayQuantity > req.Quantity {
+		return nil, fmt.Errorf("display quantity must be between 0 and the order quantity")
+	}
+	if req.DisplayQuantity > 0 && req.Type != LIMIT && req.Type != STOP_LIMIT {
+		return nil, fmt.Errorf("display quantity is only supported for limit orders")
+	}
+	if req.PostOnly && (req.Type != LIMIT || req.TimeInForce == IOC || req.TimeInForce == FOK) {
+		return nil, fmt.Errorf("post-only is only supported for resting limit orders")
+	}
+	if me.ledger != nil && req.AccountID == "" {
+		return nil, fmt.Errorf("account ID is required when balances are enforced")
+	}
+	if req.SelfTradePrevention != "" && !req.SelfTradePrevention.valid() {
+		return nil, fmt.Errorf("unsupported self-trade prevention mode: %s", req.SelfTradePrevention)
+	}
 
 	// Get order book
-	book := me.GetOrCreateBook(symbol)
+	book := me.GetOrCreateBook(req.Symbol)
+
+	// Create order. A replayed order keeps the ID it was first given.
+	if cmd.OrderID == "" {
+		cmd.OrderID = me.ids.NextID()
+	}
+	order := NewOrder(cmd.OrderID, req.Symbol, req.Side, req.Type, req.Price, req.Quantity, now.UnixNano())
+	order.AccountID = req.AccountID
+	order.ClientOrderID = req.ClientOrderID
+	order.TimeInForce = req.TimeInForce
+	order.PostOnly = req.PostOnly
+	order.RepriceOnCross = req.RepriceOnCross
+	order.StopPrice = req.StopPrice
+	order.TrailAmount = req.TrailAmount
+	order.TrailBps = req.TrailBps
+	order.DisplayQuantity = req.DisplayQuantity
+	order.ExpireAt = req.ExpireAt
+	order.SelfTradePrevention = req.SelfTradePrevention
+	if order.SelfTradePrevention == "" {
+		order.SelfTradePrevention = me.accounts.selfTradePrevention(order.AccountID)
+		req.SelfTradePrevention = order.SelfTradePrevention
+	}
+	if order.TimeInForce == DAY {
+		order.ExpireAt = endOfDay(now).UnixMilli()
+	}
+
+	// Pre-trade risk checks, matching and resting the remainder run as one
+	// command on the book's goroutine, which also logs it. A replayed order
+	// gets the risk check outcome it had the first time, and is counted
+	// against its account's limits if it passed.
+	var result *OrderResult
+	var seq uint64
+	var events *eventBatch
+	var err error
+	if cmdErr := book.exec(func() {
+		events = book.applyCommand(cmd, func() {
+			if !cmd.replayed {
+				cmd.RiskRejection = me.checkRisk(book, order)
+			} else if cmd.RiskRejection == nil {
+				me.accounts.reserveOpen(order, RiskContext{}, nil)
+			}
+			if cmd.RiskRejection != nil {
+				result = me.rejectRisk(order, cmd.RiskRejection)
+				return
+			}
+			result, err = me.placeOrder(book, order)
+		})
+		if err == nil {
+			seq, err = me.logCommand(cmd)
+		}
+	}); cmdErr != nil {
+		return nil, cmdErr
+	}
+	if err == nil {
+		err = me.syncCommand(seq)
+	}
+	events.release(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// placeOrder matches a new order that passed risk checks, rests it or parks
+// it in the trigger book, and records it in its account's history. An order
+// that fails outright is never created, so it is not recorded. Must run on
+// the book's goroutine.
+func (me *MatchingEngine) placeOrder(book *OrderBook, order *Order) (*OrderResult, error) {
+	if order.Type == TRAILING_STOP {
+		me.initTrailingStop(book, order)
+	}
+
+	var result *OrderResult
+	if order.isPendingStop() && !order.stopReached(book.LastTradePrice) && !me.reserveFunds(book, order) {
+		result = me.rejectInsufficientFunds(order)
+	} else if order.isPendingStop() && !order.stopReached(book.LastTradePrice) {
+		// Stops wait in the trigger book until the last price reaches them
+		book.trackOrder(order)
+		book.Stops.Add(order)
+		me.accounts.trackOpen(order)
+		book.emit(ORDER_ACCEPTED, order, nil)
+		result = &OrderResult{
+			OrderID:           order.ID,
+			ClientOrderID:     order.ClientOrderID,
+			Status:            ACCEPTED,
+			RemainingQuantity: order.Quantity,
+			Message:           "Stop order accepted, waiting for trigger",
+		}
+	} else if order.isPendingStop() {
+		// The stop price has already been reached
+		result = me.activateStop(book, order, true)
+		result.Message = "Stop order triggered on arrival: " + result.Message
+	} else {
+		var err error
+		result, err = me.processOrder(book, order, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	me.accounts.recordOrder(order)
+
+	// Trades above may have moved the last price through resting stops
+	me.processTriggers(book)
+
+	// GTD and DAY orders left in the book are expired by the scheduler
+	if order.ExpireAt > 0 && order.isLive() && book.Orders[order.ID] == order {
+		me.expiry.schedule(order)
+	}
+
+	return result, nil
+}
+
+// initTrailingStop sets the first stop price of a trailing stop from the
+// last trade, falling back to the touch if nothing has traded yet. With no
+// reference price at all the stop is armed by the first trade.
+// Must run on the book's goroutine.
+func (me *MatchingEngine) initTrailingStop(book *OrderBook, order *Order) {
+	order.StopPrice = 0
+
+	reference := book.LastTradePrice
+	if reference == 0 && order.Side == BUY {
+		reference = book.bestAsk()
+	} else if reference == 0 {
+		reference = book.bestBid()
+	}
+
+	if reference > 0 {
+		order.StopPrice = order.trailingStopPrice(reference)
+	}
+}
 
-	// Create order
-	order := NewOrder(symbol, side, orderType, price, quantity)
+// processTriggers activates every stop order triggered by the last trade
+// price, in arrival order. Fills from activated orders move the price
+// again, so this repeats until no further stops trigger.
+// Must run on the book's goroutine.
+func (me *MatchingEngine) processTriggers(book *OrderBook) {
+	for {
+		triggered := book.Stops.PopTriggered(book.LastTradePrice)
+		if len(triggered) == 0 {
+			return
+		}
+
+		for _, order := range triggered {
+			me.activateStop(book, order, false)
+		}
+	}
+}
+
+// activateStop sends a triggered stop through matching as a market or
+// limit order. arriving is true for a stop triggered as it was submitted.
+// Must run on the book's goroutine.
+func (me *MatchingEngine) activateStop(book *OrderBook, order *Order, arriving bool) *OrderResult {
+	// The order stays in the lookup map so its owner can still query it,
+	// and keeps its type and time in force; executionType and
+	// executionTimeInForce say how it now trades
+	order.Triggered = true
+
+	// A triggered market order is IOC or FOK, never failing for want of
+	// liquidity, so processOrder cannot fail here
+	result, _ := me.processOrder(book, order, arriving)
+	return result
+}
+
+// processOrder matches an incoming order and rests or cancels whatever is
+// left according to its time in force. arriving is true for a newly
+// submitted order, which is reported accepted once it passes its checks;
+// replaced and triggered orders were accepted before. Must run on the
+// book's goroutine.
+func (me *MatchingEngine) processOrder(book *OrderBook, order *Order, arriving bool) (*OrderResult, error) {
+	requestedPrice := order.Price
+	order.selfTradeQty = 0
+	order.selfTradeCancelled = nil
+
+	// Post-only orders must not take liquidity
+	if order.PostOnly && !me.applyPostOnly(book, order) {
+		order.Status = REJECTED
+		order.RejectReason = REJECT_POST_ONLY_WOULD_CROSS
+		me.accounts.trackOpen(order)
+		return &OrderResult{
+			OrderID:       order.ID,
+			ClientOrderID: order.ClientOrderID,
+			Status:        REJECTED,
+			RejectReason:  order.RejectReason,
+			Message:       "Post-only order would cross the book",
+		}, nil
+	}
+
+	// With a ledger, the order must be backed by funds before it trades
+	if !me.reserveFunds(book, order) {
+		return me.rejectInsufficientFunds(order), nil
+	}
+
+	pending := len(book.pendingEvents)
+	if arriving {
+		book.emit(ORDER_ACCEPTED, order, nil)
+	}
 
 	// Try to match
 	trades, err := me.matchOrder(book, order)
 	if err != nil {
+		// Nothing happened, so nothing is reported
+		me.releaseFunds(order)
+		me.accounts.closeOpen(order)
+		book.pendingEvents = book.pendingEvents[:pending]
 		return nil, err
 	}
 
 	// Build result
 	result := &OrderResult{
 		OrderID:        order.ID,
+		ClientOrderID:  order.ClientOrderID,
 		Status:         order.Status,
 		FilledQuantity: order.FilledQuantity,
 		Trades:         trades,
 	}
 
-	// If not fully filled and it's a limit order, add to book
-	if order.FilledQuantity < order.Quantity && orderType == LIMIT {
-		remaining := order.Quantity - order.FilledQuantity
+	remaining := order.Quantity - order.FilledQuantity
+	if order.Status == KILLED {
+		// FOK: nothing traded, the whole order is killed
+		result.CancelledQuantity = remaining
+		result.Message = "Order killed, insufficient liquidity to fill completely (FOK)"
+	} else if order.CancelReason == CANCEL_SELF_TRADE {
+		// Self-trade prevention cancelled the rest of the order
+		order.selfTradeQty += remaining
+		order.Status = CANCELLED
+		result.CancelReason = order.CancelReason
+
+		if order.FilledQuantity > 0 {
+			result.Status = PARTIAL_FILL
+			result.Message = fmt.Sprintf("Order partially filled, remainder cancelled by self-trade prevention (%s)", order.SelfTradePrevention)
+		} else {
+			result.Status = CANCELLED
+			result.Message = fmt.Sprintf("Order cancelled by self-trade prevention (%s)", order.SelfTradePrevention)
+		}
+	} else if remaining > 0 && order.executionType() == LIMIT && order.restsInBook() {
+		// Not fully filled: rest the remainder in the book
 		result.RemainingQuantity = remaining
-		book.AddOrder(order)
-		
+		book.addOrder(order)
+
 		if order.FilledQuantity > 0 {
 			result.Status = PARTIAL_FILL
 			result.Message = "Order partially filled and added to book"
+		} else if order.Price != requestedPrice {
+			result.Status = ACCEPTED
+			result.Message = fmt.Sprintf("Post-only order repriced to %d and added to book", order.Price)
 		} else {
 			result.Status = ACCEPTED
 			result.Message = "Order added to book"
 		}
-	} else if order.FilledQuantity == order.Quantity {
+		order.Status = result.Status
+	} else if remaining > 0 {
+		// IOC or market: cancel whatever did not match immediately
+		result.CancelledQuantity = remaining
+		order.Status = CANCELLED
+
+		if order.FilledQuantity > 0 {
+			result.Status = PARTIAL_FILL
+			result.Message = "Order partially filled, remainder cancelled (IOC)"
+		} else {
+			result.Status = CANCELLED
+			result.Message = "Order cancelled, no immediate match (IOC)"
+		}
+	} else {
 		result.Status = FILLED
 		result.Message = "Order fully filled"
+		order.Status = FILLED
+	}
+
+	// Funds held for an order that is done go back to the account
+	if !order.isLive() {
+		me.releaseFunds(order)
+	}
+	me.accounts.trackOpen(order)
+	if order.Status == CANCELLED || order.Status == KILLED {
+		book.emit(ORDER_CANCELLED, order, nil)
+	}
+
+	// Quantity removed by self-trade prevention never rests or trades
+	if order.selfTradeQty > 0 || len(order.selfTradeCancelled) > 0 {
+		result.CancelledQuantity += order.selfTradeQty
+		result.SelfTradePreventedQuantity = order.selfTradeQty
+		result.SelfTradeCancelledOrderIDs = order.selfTradeCancelled
+		if order.CancelReason == "" {
+			result.Message += fmt.Sprintf(" (self-trade prevention: %s)", order.SelfTradePrevention)
+		}
 	}
 
 	return result, nil
 }
 
-// matchOrder attempts to match an order against the book
+// rejectRisk rejects a new order that failed a pre-trade risk check
+func (me *MatchingEngine) rejectRisk(order *Order, rejection *RiskRejection) *OrderResult {
+	order.Status = REJECTED
+	order.RejectReason = rejection.Reason
+	me.accounts.recordOrder(order)
+	return &OrderResult{
+		OrderID:       order.ID,
+		ClientOrderID: order.ClientOrderID,
+		Status:        REJECTED,
+		RejectReason:  order.RejectReason,
+		Message:       "Risk check failed: " + rejection.Message,
+	}
+}
+
+// rejectInsufficientFunds rejects an order the account cannot pay for.
+// Must run on the book's goroutine.
+func (me *MatchingEngine) rejectInsufficientFunds(order *Order) *OrderResult {
+	order.Status = REJECTED
+	order.RejectReason = REJECT_INSUFFICIENT_FUNDS
+	me.accounts.trackOpen(order)
+	return &OrderResult{
+		OrderID:       order.ID,
+		ClientOrderID: order.ClientOrderID,
+		Status:        REJECTED,
+		RejectReason:  order.RejectReason,
+		Message:       "Insufficient funds for order",
+	}
+}
+
+// applyPostOnly checks a post-only order against the touch. It returns false
+// if the order would cross and cannot be repriced. Must run on the book's goroutine.
+func (me *MatchingEngine) applyPostOnly(book *OrderBook, order *Order) bool {
+	if order.Side == BUY {
+		bestAsk := book.bestAsk()
+		if bestAsk == 0 || order.Price < bestAsk {
+			return true
+		}
+		if !order.RepriceOnCross || bestAsk-1 <= 0 {
+			return false
+		}
+		// One tick (cent) below the best ask
+		order.Price = bestAsk - 1
+		return true
+	}
+
+	bestBid := book.bestBid()
+	if bestBid == 0 || order.Price > bestBid {
+		return true
+	}
+	if !order.RepriceOnCross {
+		return false
+	}
+	// One tick (cent) above the best bid
+	order.Price = bestBid + 1
+	return true
+}
+
+// matchOrder attempts to match an order against the book. Must run on the
+// book's goroutine.
 func (me *MatchingEngine) matchOrder(book *OrderBook, order *Order) ([]Trade, error) {
 	trades := []Trade{}
 
-	if order.Type == MARKET {
+	if order.executionType() == MARKET {
 		// Market orders must execute immediately
 		t, err := me.matchMarketOrder(book, order)
 		if err != nil {
@@ -118,8 +643,12 @@ func (me *MatchingEngine) matchOrder(book *OrderBook, order *Order) ([]Trade, er
 
 // matchLimitOrder matches a limit order
 func (me *MatchingEngine) matchLimitOrder(book *OrderBook, order *Order) []Trade {
-	book.mu.Lock()
-	defer book.mu.Unlock()
+	// FOK: check the whole quantity is available at or better than the
+	// limit price before anything in the book is touched
+	if order.executionTimeInForce() == FOK && !me.canFillCompletely(book, order, order.Price) {
+		order.Status = KILLED
+		return []Trade{}
+	}
 
 	trades := []Trade{}
 
@@ -139,52 +668,67 @@ func (me *MatchingEngine) matchBuyOrder(book *OrderBook, buyOrder *Order) []Trad
 	trades := []Trade{}
 
 	// Walk through asks (sell orders) from lowest price
-	for len(book.Asks) > 0 && buyOrder.FilledQuantity < buyOrder.Quantity {
-		bestAsk := book.Asks[0]
+	for buyOrder.canTake() {
+		bestAsk := book.Asks.Best()
+		if bestAsk == nil {
+			break
+		}
 
 		// Check if prices cross
-		if buyOrder.Type == LIMIT && buyOrder.Price < bestAsk.Price {
+		if buyOrder.executionType() == LIMIT && buyOrder.Price < bestAsk.Price {
 			// No match possible
 			break
 		}
 
 		// Match against orders at this price level (FIFO)
-		for len(bestAsk.Orders) > 0 && buyOrder.FilledQuantity < buyOrder.Quantity {
-			sellOrder := bestAsk.Orders[0]
+		for bestAsk.OrderCount > 0 && buyOrder.canTake() {
+			sellOrder := bestAsk.Front()
+
+			// Never trade with an order from the same account
+			if isSelfTrade(buyOrder, sellOrder) {
+				me.preventSelfTrade(book, bestAsk, buyOrder, sellOrder)
+				continue
+			}
 
 			// Calculate trade quantity
 			remainingBuy := buyOrder.Quantity - buyOrder.FilledQuantity
-			remainingSell := sellOrder.Quantity - sellOrder.FilledQuantity
+			remainingSell := sellOrder.visibleQuantity()
 			tradeQty := min(remainingBuy, remainingSell)
 
 			// Execute trade at the sell order's price (resting order price)
 			trade := Trade{
-				ID:        uuid.New().String(),
+				ID:        me.nextTradeID(book),
+				Symbol:    book.Symbol,
+				Sequence:  book.nextTradeSequence(),
 				Price:     sellOrder.Price,
 				Quantity:  tradeQty,
-				Timestamp: time.Now().UnixMilli(),
+				Timestamp: book.cmd.Time,
 				BuyerID:   buyOrder.ID,
 				SellerID:  sellOrder.ID,
+
+				BuyerAccountID:  buyOrder.AccountID,
+				SellerAccountID: sellOrder.AccountID,
+
+				AggressorSide: BUY,
+				MakerOrderID:  sellOrder.ID,
+				TakerOrderID:  buyOrder.ID,
 			}
+			me.applyFees(book, &trade, sellOrder, buyOrder)
 			trades = append(trades, trade)
+			book.recordTrade(trade)
+			me.accounts.recordTrade(trade)
+			me.settleTrade(book, trade)
 
-			// Update filled quantities
+			// Update filled quantities, status, pop filled order or
+			// requeue iceberg
 			buyOrder.FilledQuantity += tradeQty
-			sellOrder.FilledQuantity += tradeQty
-
-			// Update statuses
-			if sellOrder.FilledQuantity == sellOrder.Quantity {
-				sellOrder.Status = FILLED
-				// Remove from book
-				bestAsk.Orders = bestAsk.Orders[1:]
-			} else {
-				sellOrder.Status = PARTIAL_FILL
-			}
+			me.updateRestingOrder(book, bestAsk, sellOrder, trade)
+			book.emitTrade(trade, sellOrder, buyOrder)
 		}
 
 		// If this price level is empty, remove it
-		if len(bestAsk.Orders) == 0 {
-			book.Asks = book.Asks[1:]
+		if bestAsk.OrderCount == 0 {
+			book.Asks.remove(bestAsk.Price)
 		}
 	}
 
@@ -196,84 +740,129 @@ func (me *MatchingEngine) matchSellOrder(book *OrderBook, sellOrder *Order) []Tr
 	trades := []Trade{}
 
 	// Walk through bids (buy orders) from highest price
-	for len(book.Bids) > 0 && sellOrder.FilledQuantity < sellOrder.Quantity {
-		bestBid := book.Bids[0]
+	for sellOrder.canTake() {
+		bestBid := book.Bids.Best()
+		if bestBid == nil {
+			break
+		}
 
 		// Check if prices cross
-		if sellOrder.Type == LIMIT && sellOrder.Price > bestBid.Price {
+		if sellOrder.executionType() == LIMIT && sellOrder.Price > bestBid.Price {
 			// No match possible
 			break
 		}
 
 		// Match against orders at this price level (FIFO)
-		for len(bestBid.Orders) > 0 && sellOrder.FilledQuantity < sellOrder.Quantity {
-			buyOrder := bestBid.Orders[0]
+		for bestBid.OrderCount > 0 && sellOrder.canTake() {
+			buyOrder := bestBid.Front()
+
+			// Never trade with an order from the same account
+			if isSelfTrade(sellOrder, buyOrder) {
+				me.preventSelfTrade(book, bestBid, sellOrder, buyOrder)
+				continue
+			}
 
 			// Calculate trade quantity
 			remainingSell := sellOrder.Quantity - sellOrder.FilledQuantity
-			remainingBuy := buyOrder.Quantity - buyOrder.FilledQuantity
+			remainingBuy := buyOrder.visibleQuantity()
 			tradeQty := min(remainingSell, remainingBuy)
 
 			// Execute trade at the buy order's price (resting order price)
 			trade := Trade{
-				ID:        uuid.New().String(),
+				ID:        me.nextTradeID(book),
+				Symbol:    book.Symbol,
+				Sequence:  book.nextTradeSequence(),
 				Price:     buyOrder.Price,
 				Quantity:  tradeQty,
-				Timestamp: time.Now().UnixMilli(),
+				Timestamp: book.cmd.Time,
 				BuyerID:   buyOrder.ID,
 				SellerID:  sellOrder.ID,
+
+				BuyerAccountID:  buyOrder.AccountID,
+				SellerAccountID: sellOrder.AccountID,
+
+				AggressorSide: SELL,
+				MakerOrderID:  buyOrder.ID,
+				TakerOrderID:  sellOrder.ID,
 			}
+			me.applyFees(book, &trade, buyOrder, sellOrder)
 			trades = append(trades, trade)
+			book.recordTrade(trade)
+			me.accounts.recordTrade(trade)
+			me.settleTrade(book, trade)
 
-			// Update filled quantities
+			// Update filled quantities, status, pop filled order or
+			// requeue iceberg
 			sellOrder.FilledQuantity += tradeQty
-			buyOrder.FilledQuantity += tradeQty
-
-			// Update statuses
-			if buyOrder.FilledQuantity == buyOrder.Quantity {
-				buyOrder.Status = FILLED
-				// Remove from book
-				bestBid.Orders = bestBid.Orders[1:]
-				// DON'T delete from book.Orders - keep it for queries
-				// delete(book.Orders, buyOrder.ID)  // <-- REMOVE THIS LINE
-			} else {
-				buyOrder.Status = PARTIAL_FILL
-}
-
+			me.updateRestingOrder(book, bestBid, buyOrder, trade)
+			book.emitTrade(trade, buyOrder, sellOrder)
 		}
 
 		// If this price level is empty, remove it
-		if len(bestBid.Orders) == 0 {
-			book.Bids = book.Bids[1:]
+		if bestBid.OrderCount == 0 {
+			book.Bids.remove(bestBid.Price)
 		}
 	}
 
 	return trades
 }
 
+// updateRestingOrder fills a resting order at the front of level with its
+// share of trade. Filled orders leave the queue but stay in book.Orders for
+// status queries. An iceberg whose visible slice is used up is replenished
+// from its reserve and moved to the back of the queue, losing time priority.
+// Must run on the book's goroutine.
+func (me *MatchingEngine) updateRestingOrder(book *OrderBook, level *PriceLevel, resting *Order, trade Trade) {
+	level.update(resting, func() {
+		resting.FilledQuantity += trade.Quantity
+		if resting.DisplayQuantity > 0 {
+			resting.displayRemaining -= trade.Quantity
+		}
+	})
+
+	if resting.FilledQuantity == resting.Quantity {
+		resting.Status = FILLED
+		level.remove(resting)
+		me.releaseFunds(resting)
+		me.accounts.trackOpen(resting)
+		book.fillEvent(resting, trade)
+		return
+	}
+
+	resting.Status = PARTIAL_FILL
+	book.fillEvent(resting, trade)
+	if resting.DisplayQuantity > 0 && resting.displayRemaining == 0 {
+		level.remove(resting)
+		resting.replenishDisplay()
+		level.pushBack(resting)
+		book.orderEvent(EVENT_ADD, resting, resting.visibleQuantity())
+	}
+}
+
+// canFillCompletely reports whether a FOK order is guaranteed to fill in
+// full at or better than limitPrice (0 for no bound). Resting orders from
+// the same account do not count as liquidity, and unless self-trade
+// prevention cancels them out of the way they would cut the order short.
+// Must run on the book's goroutine.
+func (me *MatchingEngine) canFillCompletely(book *OrderBook, order *Order, limitPrice int64) bool {
+	available, own := book.availableLiquidity(order.Side, limitPrice, order.Quantity, order.AccountID)
+	if own > 0 && order.SelfTradePrevention != STP_CANCEL_OLDEST {
+		return false
+	}
+	return available >= order.Quantity
+}
+
 // matchMarketOrder matches a market order (must execute immediately or fail)
 func (me *MatchingEngine) matchMarketOrder(book *OrderBook, order *Order) ([]Trade, error) {
-	book.mu.Lock()
-	defer book.mu.Unlock()
-
 	// Check if there's enough liquidity
-	availableLiquidity := int64(0)
-
-	if order.Side == BUY {
-		for _, level := range book.Asks {
-			for _, o := range level.Orders {
-				availableLiquidity += (o.Quantity - o.FilledQuantity)
-			}
-		}
-	} else {
-		for _, level := range book.Bids {
-			for _, o := range level.Orders {
-				availableLiquidity += (o.Quantity - o.FilledQuantity)
-			}
-		}
+	if order.executionTimeInForce() == FOK && !me.canFillCompletely(book, order, 0) {
+		order.Status = KILLED
+		return []Trade{}, nil
 	}
 
-	if availableLiquidity < order.Quantity {
+	// IOC market orders take whatever is available instead of failing
+	availableLiquidity, _ := book.availableLiquidity(order.Side, 0, order.Quantity, order.AccountID)
+	if availableLiquidity < order.Quantity && order.executionTimeInForce() != IOC {
 		return nil, fmt.Errorf("insufficient liquidity: only %d shares available, requested %d", availableLiquidity, order.Quantity)
 	}
 
@@ -288,100 +877,442 @@ func (me *MatchingEngine) matchMarketOrder(book *OrderBook, order *Order) ([]Tra
 	return trades, nil
 }
 
+// withOrder looks up the book holding orderID in the order index and runs
+// fn with the order on that book's goroutine. No other book is touched.
+// Returns "order not found" if the order is unknown or has left the book.
+func (me *MatchingEngine) withOrder(orderID string, fn func(book *OrderBook, order *Order)) error {
+	entry, exists := me.orders.Load(orderID)
+	if !exists {
+		return fmt.Errorf("order not found")
+	}
+	book := entry.(*OrderBook)
+
+	// The order may have been cancelled since the index was read
+	found := false
+	if err := book.exec(func() {
+		if order, exists := book.Orders[orderID]; exists {
+			found = true
+			fn(book, order)
+		}
+	}); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("order not found")
+	}
+	return nil
+}
+
 // CancelOrder cancels an order
 func (me *MatchingEngine) CancelOrder(orderID string) error {
-	me.mu.RLock()
-	defer me.mu.RUnlock()
-
-	// Find which book has this order
-	for _, book := range me.books {
-		book.mu.RLock()
-		order, exists := book.Orders[orderID]
-		book.mu.RUnlock()
-
-		if exists {
-			if order.Status == FILLED {
-				return fmt.Errorf("cannot cancel: order already filled")
+	return me.cancel(&Command{Type: CMD_CANCEL, OrderID: orderID})
+}
+
+// cancel runs a cancel command
+func (me *MatchingEngine) cancel(cmd *Command) error {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	if err := me.checkLog(); err != nil {
+		return err
+	}
+	me.commandTime(cmd)
+
+	var seq uint64
+	var events *eventBatch
+	var err error
+	if findErr := me.withOrder(cmd.OrderID, func(book *OrderBook, order *Order) {
+		events = book.applyCommand(cmd, func() {
+			err = me.cancelOrder(book, order)
+		})
+		if err == nil {
+			seq, err = me.logCommand(cmd)
+		}
+	}); findErr != nil {
+		return findErr
+	}
+	if err == nil {
+		err = me.syncCommand(seq)
+	}
+	events.release(err == nil)
+	return err
+}
+
+// cancelOrder cancels a live order. Must run on the book's goroutine.
+func (me *MatchingEngine) cancelOrder(book *OrderBook, order *Order) error {
+	if !order.isLive() {
+		return fmt.Errorf("cannot cancel: order already %s", strings.ToLower(string(order.Status)))
+	}
+	order.Status = CANCELLED
+	book.removeOrder(order)
+	me.releaseFunds(order)
+	me.accounts.trackOpen(order)
+	book.emit(ORDER_CANCELLED, order, nil)
+	return nil
+}
+
+// CancelFilter selects the resting orders removed by MassCancel. Empty
+// fields match everything.
+type CancelFilter struct {
+	Symbol    string    `json:"symbol,omitempty"`
+	Side      OrderSide `json:"side,omitempty"`
+	AccountID string    `json:"account_id,omitempty"`
+}
+
+// MassCancelResult lists the orders removed by MassCancel
+type MassCancelResult struct {
+	CancelledIDs []string `json:"cancelled_order_ids"`
+	Count        int      `json:"count"`
+}
+
+// MassCancel cancels every live order matching the filter, including
+// pending stops. Each book is swept by a single command, which waits for
+// room in a full queue rather than leaving orders working.
+func (me *MatchingEngine) MassCancel(filter CancelFilter) *MassCancelResult {
+	return me.massCancel(&Command{Type: CMD_MASS_CANCEL, Filter: &filter})
+}
+
+// massCancel runs a mass cancel command. It is logged once per book it
+// cancelled orders in, narrowed to that book's symbol, so a replay cancels
+// the same orders at the same point in each book's history.
+func (me *MatchingEngine) massCancel(cmd *Command) *MassCancelResult {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	result := &MassCancelResult{CancelledIDs: []string{}}
+	if me.checkLog() != nil {
+		return result
+	}
+
+	filter := *cmd.Filter
+	me.commandTime(cmd)
+	var seq uint64
+	var batches []*eventBatch
+	for _, book := range me.allBooks() {
+		if filter.Symbol != "" && filter.Symbol != book.Symbol {
+			continue
+		}
+
+		var ids []string
+		book.execWait(func() {
+			bookCmd := *cmd
+			bookCmd.Filter = &CancelFilter{Symbol: book.Symbol, Side: filter.Side, AccountID: filter.AccountID}
+			events := book.applyCommand(&bookCmd, func() {
+				ids = me.cancelMatching(book, filter)
+			})
+			if len(ids) > 0 {
+				if bookSeq, err := me.logCommand(&bookCmd); err == nil {
+					seq = bookSeq
+				} else {
+					events.release(false)
+					events = nil
+				}
 			}
-			order.Status = CANCELLED
-			return book.RemoveOrder(orderID)
+			batches = append(batches, events)
+		})
+		result.CancelledIDs = append(result.CancelledIDs, ids...)
+	}
+	result.Count = len(result.CancelledIDs)
+
+	// A log failure stops the engine; the orders are cancelled either way
+	err := me.syncCommand(seq)
+	for _, events := range batches {
+		events.release(err == nil)
+	}
+	return result
+}
+
+// cancelMatching cancels the live orders in one book that match the filter
+// and returns their IDs in a stable order. Must run on the book's goroutine.
+func (me *MatchingEngine) cancelMatching(book *OrderBook, filter CancelFilter) []string {
+	matched := []*Order{}
+	for _, order := range book.Orders {
+		if !order.isLive() {
+			continue
+		}
+		if filter.Side != "" && order.Side != filter.Side {
+			continue
 		}
+		if filter.AccountID != "" && order.AccountID != filter.AccountID {
+			continue
+		}
+		matched = append(matched, order)
 	}
 
-	return fmt.Errorf("order not found")
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].ID < matched[j].ID
+	})
+
+	ids := make([]string, 0, len(matched))
+	for _, order := range matched {
+		order.Status = CANCELLED
+		book.removeOrder(order)
+		me.releaseFunds(order)
+		me.accounts.trackOpen(order)
+		book.emit(ORDER_CANCELLED, order, nil)
+		ids = append(ids, order.ID)
+	}
+	return ids
 }
 
-// GetOrder retrieves an order by ID
-func (me *MatchingEngine) GetOrder(orderID string) (*Order, error) {
-	me.mu.RLock()
-	defer me.mu.RUnlock()
+// ReplaceOrder atomically amends the price and/or quantity of a resting
+// limit order. A price or quantity of 0 keeps the current value. quantity
+// is the new total order quantity, including anything already filled, and
+// must exceed the filled quantity.
+//
+// A pure quantity decrease keeps the order's place in the queue. A price
+// change or quantity increase loses time priority: the order is taken out
+// of the book and re-entered as if newly arrived, so it can match right away.
+func (me *MatchingEngine) ReplaceOrder(orderID string, price, quantity int64) (*OrderResult, error) {
+	if price < 0 || quantity < 0 {
+		return nil, fmt.Errorf("price and quantity must be positive")
+	}
+
+	return me.replace(&Command{Type: CMD_REPLACE, OrderID: orderID, Price: price, Quantity: quantity})
+}
 
-	for _, book := range me.books {
-		book.mu.RLock()
-		order, exists := book.Orders[orderID]
-		book.mu.RUnlock()
+// replace runs a replace command. Rejected amendments change nothing and
+// are not logged.
+func (me *MatchingEngine) replace(cmd *Command) (*OrderResult, error) {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
 
-		if exists {
-			return order, nil
+	if err := me.checkLog(); err != nil {
+		return nil, err
+	}
+	now := me.commandTime(cmd)
+
+	var result *OrderResult
+	var seq uint64
+	var events *eventBatch
+	var err error
+	if findErr := me.withOrder(cmd.OrderID, func(book *OrderBook, order *Order) {
+		events = book.applyCommand(cmd, func() {
+			result, err = me.replaceOrder(book, order, cmd.Price, cmd.Quantity, now)
+		})
+		// Rejected amendments change nothing; only risk rejections are
+		// logged, so a replay reaches the same decision
+		if err == nil && (result.Status != REJECTED || cmd.RiskRejection != nil) {
+			seq, err = me.logCommand(cmd)
 		}
+	}); findErr != nil {
+		return nil, findErr
+	}
+	if err == nil {
+		err = me.syncCommand(seq)
+	}
+	events.release(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// replaceOrder amends an order in place or re-enters it into the book. Must
+// run on the book's goroutine.
+func (me *MatchingEngine) replaceOrder(book *OrderBook, order *Order, price, quantity int64, now time.Time) (*OrderResult, error) {
+	if !order.isLive() {
+		return nil, fmt.Errorf("cannot replace: order already %s", strings.ToLower(string(order.Status)))
+	}
+	if order.executionType() != LIMIT {
+		return nil, fmt.Errorf("only resting limit orders can be replaced")
+	}
+	if price == 0 {
+		price = order.Price
+	}
+	if quantity == 0 {
+		quantity = order.Quantity
+	}
+	if quantity <= order.FilledQuantity {
+		return nil, fmt.Errorf("quantity must exceed filled quantity of %d", order.FilledQuantity)
+	}
+	if order.DisplayQuantity > quantity {
+		return nil, fmt.Errorf("quantity cannot be less than the display quantity")
+	}
+
+	// The amended order must pass the pre-trade checks a new one would. A
+	// replayed amendment gets the outcome it had the first time.
+	amended := *order
+	amended.Price, amended.Quantity = price, quantity
+	cmd := book.cmd
+	if !cmd.replayed {
+		cmd.RiskRejection = me.checkRisk(book, &amended)
+	} else if cmd.RiskRejection == nil {
+		me.accounts.reserveOpen(&amended, RiskContext{}, nil)
+	}
+	if cmd.RiskRejection != nil {
+		return &OrderResult{
+			OrderID:       order.ID,
+			ClientOrderID: order.ClientOrderID,
+			Status:        REJECTED,
+			RejectReason:  cmd.RiskRejection.Reason,
+			Message:       "Risk check failed: " + cmd.RiskRejection.Message + ", original order kept",
+		}, nil
+	}
+
+	if price == order.Price && quantity <= order.Quantity {
+		// Size reduction only: keep queue position
+		me.resizeHold(book, order, price, quantity)
+		order.level.update(order, func() {
+			order.Quantity = quantity
+			if order.DisplayQuantity > 0 {
+				order.displayRemaining = min(order.displayRemaining, quantity-order.FilledQuantity)
+			}
+		})
+		me.accounts.trackOpen(order)
+		book.orderEvent(EVENT_AMEND, order, order.visibleQuantity())
+		return &OrderResult{
+			OrderID:           order.ID,
+			ClientOrderID:     order.ClientOrderID,
+			Status:            order.Status,
+			FilledQuantity:    order.FilledQuantity,
+			RemainingQuantity: order.Quantity - order.FilledQuantity,
+			Message:           "Order amended, queue position kept",
+		}, nil
 	}
 
-	return nil, fmt.Errorf("order not found")
+	// Post-only orders must not be amended into a crossing price. Check on
+	// a copy so a rejected amendment leaves the original order untouched.
+	if order.PostOnly && price != order.Price {
+		probe := *order
+		probe.Price = price
+		if !me.applyPostOnly(book, &probe) {
+			return &OrderResult{
+				OrderID:       order.ID,
+				ClientOrderID: order.ClientOrderID,
+				Status:        REJECTED,
+				RejectReason:  REJECT_POST_ONLY_WOULD_CROSS,
+				Message:       "Amended post-only order would cross the book, original order kept",
+			}, nil
+		}
+		price = probe.Price
+	}
+
+	if !me.resizeHold(book, order, price, quantity) {
+		return &OrderResult{
+			OrderID:       order.ID,
+			ClientOrderID: order.ClientOrderID,
+			Status:        REJECTED,
+			RejectReason:  REJECT_INSUFFICIENT_FUNDS,
+			Message:       "Insufficient funds for amended order, original order kept",
+		}, nil
+	}
+
+	// Price change or size increase: lose priority and re-enter the book.
+	// The order stays in the lookup map and index throughout, so it can be
+	// found while it is being replaced and after it fills.
+	book.removeFromLevel(order)
+	book.orderEvent(EVENT_CANCEL, order, order.visibleQuantity())
+	order.Price = price
+	order.Quantity = quantity
+	order.Timestamp = now.UnixNano()
+
+	result, err := me.processOrder(book, order, false)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == CANCELLED {
+		// Cancelled by self-trade prevention on re-entry
+		book.untrackOrder(order)
+	}
+	me.processTriggers(book)
+
+	return result, nil
+}
+
+// GetOrder returns a copy of an order by ID with its current status.
+// Only orders that rested or waited for a trigger are indexed, and
+// cancelled and expired ones leave the index, so those are not found;
+// GetAccountOrders still has them.
+func (me *MatchingEngine) GetOrder(orderID string) (*Order, error) {
+	var result Order
+	if err := me.withOrder(orderID, func(_ *OrderBook, order *Order) {
+		result = *order
+	}); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetTrades returns up to limit of the most recent trades in a symbol,
+// oldest first
+func (me *MatchingEngine) GetTrades(symbol string, limit int) ([]Trade, error) {
+	book, exists := me.book(symbol)
+	if !exists {
+		return nil, fmt.Errorf("symbol not found")
+	}
+
+	var trades []Trade
+	if err := book.exec(func() {
+		trades = book.recentTradesCopy(limit)
+	}); err != nil {
+		return nil, err
+	}
+	return trades, nil
 }
 
 // GetOrderBook returns the order book for a symbol
 func (me *MatchingEngine) GetOrderBook(symbol string, depth int) (*OrderBookSnapshot, error) {
 	book := me.GetOrCreateBook(symbol)
 
-	book.mu.RLock()
-	defer book.mu.RUnlock()
+	var snapshot *OrderBookSnapshot
+	if err := book.exec(func() {
+		snapshot = book.snapshot(depth, me.clock.Now())
+	}); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
 
+// snapshot aggregates the visible quantity of the top depth levels on each
+// side. Must run on the book's goroutine.
+func (ob *OrderBook) snapshot(depth int, now time.Time) *OrderBookSnapshot {
 	snapshot := &OrderBookSnapshot{
-		Symbol:    symbol,
-		Timestamp: time.Now().UnixMilli(),
+		Symbol:    ob.Symbol,
+		Sequence:  ob.EventSequence,
+		Timestamp: now.UnixMilli(),
 		Bids:      []PriceLevelSnapshot{},
 		Asks:      []PriceLevelSnapshot{},
 	}
 
 	// Get bids (up to depth levels)
-	for i := 0; i < len(book.Bids) && i < depth; i++ {
-		level := book.Bids[i]
-		totalQty := int64(0)
-		for _, order := range level.Orders {
-			totalQty += (order.Quantity - order.FilledQuantity)
+	for level := range ob.Bids.All() {
+		if len(snapshot.Bids) == depth {
+			break
 		}
-		if totalQty > 0 {
+		// Icebergs only show their current slice
+		if level.VisibleQuantity > 0 {
 			snapshot.Bids = append(snapshot.Bids, PriceLevelSnapshot{
 				Price:    level.Price,
-				Quantity: totalQty,
+				Quantity: level.VisibleQuantity,
 			})
 		}
 	}
 
 	// Get asks (up to depth levels)
-	for i := 0; i < len(book.Asks) && i < depth; i++ {
-		level := book.Asks[i]
-		totalQty := int64(0)
-		for _, order := range level.Orders {
-			totalQty += (order.Quantity - order.FilledQuantity)
+	for level := range ob.Asks.All() {
+		if len(snapshot.Asks) == depth {
+			break
 		}
-		if totalQty > 0 {
+		// Icebergs only show their current slice
+		if level.VisibleQuantity > 0 {
 			snapshot.Asks = append(snapshot.Asks, PriceLevelSnapshot{
 				Price:    level.Price,
-				Quantity: totalQty,
+				Quantity: level.VisibleQuantity,
 			})
 		}
 	}
 
-	return snapshot, nil
+	return snapshot
 }
 
 // OrderBookSnapshot represents a point-in-time view of the order book
 type OrderBookSnapshot struct {
-	Symbol    string                `json:"symbol"`
-	Timestamp int64                 `json:"timestamp"`
-	Bids      []PriceLevelSnapshot  `json:"bids"`
-	Asks      []PriceLevelSnapshot  `json:"asks"`
+	Symbol    string               `json:"symbol"`
+	Sequence  uint64               `json:"sequence"` // last book event included
+	Timestamp int64                `json:"timestamp"`
+	Bids      []PriceLevelSnapshot `json:"bids"`
+	Asks      []PriceLevelSnapshot `json:"asks"`
 }
 
 // PriceLevelSnapshot represents aggregated quantity at a price level
@@ -396,4 +1327,4 @@ func min(a, b int64) int64 {
 		return a
 	}
 	return b
-}
\ No newline at end of file
+}
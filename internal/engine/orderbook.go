@@ -2,207 +2,344 @@ package engine
 
 import (
 	"fmt"
-	"sort"
 	"sync"
-	"time"
-
-	"github.com/google/uuid"
+	"sync/atomic"
 )
 
+// maxRecentTrades bounds the trade tape kept by each book. Once reached the
+// older half is dropped.
+const maxRecentTrades = 1000
+
 // OrderBook manages all orders for a symbol
 type OrderBook struct {
 	Symbol string
-	
+
 	// Buy orders sorted by price (high to low), then time
-	Bids []*PriceLevel
-	
+	Bids *PriceLadder
+
 	// Sell orders sorted by price (low to high), then time
-	Asks []*PriceLevel
-	
+	Asks *PriceLadder
+
+	// Stop orders waiting to be triggered
+	Stops *TriggerBook
+
+	// Price of the most recent trade, 0 if nothing has traded yet
+	LastTradePrice int64
+
+	// Sequence number of the most recent trade
+	TradeSequence uint64
+
+	// Sequence number of the most recent book event
+	EventSequence uint64
+
+	// Most recent trades, oldest first, for the trade tape
+	recentTrades []Trade
+
+	// Fees collected on the book's trades
+	feeRevenue FeeRevenue
+
+	// Most recent book events, oldest first
+	recentEvents []BookEvent
+
 	// Quick lookup by order ID
 	Orders map[string]*Order
-	
-	// Lock for thread safety
-	mu sync.RWMutex
+
+	// Engine-wide order ID -> book index, kept in step with Orders; nil for
+	// a standalone book
+	index *sync.Map
+
+	// Engine-wide event counter shared by every book; nil for a standalone
+	// book
+	engineSequence *atomic.Uint64
+
+	// Command being applied on the book's goroutine, which trades and
+	// events take their IDs and time from
+	cmd *Command
+
+	// Engine event bus, the events raised by the command being applied, and
+	// those of earlier commands waiting for them to be durable; bus is nil
+	// for a standalone book
+	bus           *eventBus
+	pendingEvents []Event
+	outbox        eventOutbox
+
+	// Commands for the goroutine that owns the book once an engine has
+	// started it; nil for a standalone book
+	commands chan func()
+	stop     chan struct{} // closed to stop the goroutine
+	stopped  chan struct{} // closed once the goroutine has exited
 }
 
 // NewOrderBook creates a new order book
 func NewOrderBook(symbol string) *OrderBook {
 	return &OrderBook{
 		Symbol: symbol,
-		Bids:   make([]*PriceLevel, 0),
-		Asks:   make([]*PriceLevel, 0),
+		Bids:   NewPriceLadder(true),
+		Asks:   NewPriceLadder(false),
+		Stops:  NewTriggerBook(),
 		Orders: make(map[string]*Order),
 	}
 }
 
 // AddOrder adds an order to the book (not matched yet)
 func (ob *OrderBook) AddOrder(order *Order) {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-	
-	// Store in lookup map
-	ob.Orders[order.ID] = order
-	
-	// Add to appropriate side
-	if order.Side == BUY {
-		ob.addToBids(order)
-	} else {
-		ob.addToAsks(order)
-	}
+	ob.execWait(func() {
+		ob.addOrder(order)
+	})
 }
 
-// addToBids adds order to buy side
-func (ob *OrderBook) addToBids(order *Order) {
-	// Find or create price level
-	for _, level := range ob.Bids {
-		if level.Price == order.Price {
-			level.Orders = append(level.Orders, order)
-			return
-		}
+// addOrder adds an order to the book. Must run on the book's goroutine.
+func (ob *OrderBook) addOrder(order *Order) {
+	if order.DisplayQuantity > 0 {
+		// Show the first iceberg slice
+		order.replenishDisplay()
 	}
-	
-	// Create new price level
-	newLevel := &PriceLevel{
-		Price:  order.Price,
-		Orders: []*Order{order},
-	}
-	ob.Bids = append(ob.Bids, newLevel)
-	
-	// Sort: highest price first
-	sort.Slice(ob.Bids, func(i, j int) bool {
-		return ob.Bids[i].Price > ob.Bids[j].Price
-	})
+
+	// Store in lookup map
+	ob.trackOrder(order)
+
+	// Add to the back of the queue at its price level
+	ob.ladder(order.Side).getOrCreate(order.Price).pushBack(order)
+	ob.orderEvent(EVENT_ADD, order, order.visibleQuantity())
 }
 
-// addToAsks adds order to sell side
-func (ob *OrderBook) addToAsks(order *Order) {
-	// Find or create price level
-	for _, level := range ob.Asks {
-		if level.Price == order.Price {
-			level.Orders = append(level.Orders, order)
-			return
-		}
+// ladder returns the price levels for one side of the book
+func (ob *OrderBook) ladder(side OrderSide) *PriceLadder {
+	if side == BUY {
+		return ob.Bids
 	}
-	
-	// Create new price level
-	newLevel := &PriceLevel{
-		Price:  order.Price,
-		Orders: []*Order{order},
-	}
-	ob.Asks = append(ob.Asks, newLevel)
-	
-	// Sort: lowest price first
-	sort.Slice(ob.Asks, func(i, j int) bool {
-		return ob.Asks[i].Price < ob.Asks[j].Price
-	})
+	return ob.Asks
 }
 
 // RemoveOrder removes an order from the book
 func (ob *OrderBook) RemoveOrder(orderID string) error {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-	
-	order, exists := ob.Orders[orderID]
-	if !exists {
-		return fmt.Errorf("order not found")
-	}
-	
-	// Only delete if it's being cancelled (not if it's filled)
-	// Filled orders should stay in the map for status queries
-	
-	// Remove from price level
-	if order.Side == BUY {
-		ob.removeFromBids(order)
-	} else {
-		ob.removeFromAsks(order)
-	}
-	
-	return nil
-}
-
-func (ob *OrderBook) removeFromBids(order *Order) {
-	for i, level := range ob.Bids {
-		if level.Price == order.Price {
-			// Remove order from this level
-			for j, o := range level.Orders {
-				if o.ID == order.ID {
-					level.Orders = append(level.Orders[:j], level.Orders[j+1:]...)
-					break
-				}
-			}
-			// If level is empty, remove it
-			if len(level.Orders) == 0 {
-				ob.Bids = append(ob.Bids[:i], ob.Bids[i+1:]...)
-			}
+	var err error
+	if cmdErr := ob.execWait(func() {
+		order, exists := ob.Orders[orderID]
+		if !exists {
+			err = fmt.Errorf("order not found")
 			return
 		}
+		ob.removeOrder(order)
+	}); cmdErr != nil {
+		return cmdErr
 	}
+	return err
 }
 
-func (ob *OrderBook) removeFromAsks(order *Order) {
-	for i, level := range ob.Asks {
-		if level.Price == order.Price {
-			// Remove order from this level
-			for j, o := range level.Orders {
-				if o.ID == order.ID {
-					level.Orders = append(level.Orders[:j], level.Orders[j+1:]...)
-					break
-				}
-			}
-			// If level is empty, remove it
-			if len(level.Orders) == 0 {
-				ob.Asks = append(ob.Asks[:i], ob.Asks[i+1:]...)
-			}
-			return
-		}
+// removeOrder takes a cancelled or expired order out of the book, the lookup
+// map and the order index, after which only its account's history has it.
+// Filled orders never come through here: they leave their price level
+// during matching but stay in the map for status queries. Must run on the
+// book's goroutine.
+func (ob *OrderBook) removeOrder(order *Order) {
+	ob.untrackOrder(order)
+
+	// Pending stops live in the trigger book, not the price levels
+	if order.isPendingStop() {
+		ob.Stops.Remove(order)
+		return
+	}
+
+	if order.level != nil {
+		ob.removeFromLevel(order)
+		ob.orderEvent(EVENT_CANCEL, order, order.visibleQuantity())
+	}
+}
+
+// applyCommand runs fn with cmd as the command being applied and returns
+// the events it raised, to be released once the command is logged and
+// synced. Must run on the book's goroutine.
+func (ob *OrderBook) applyCommand(cmd *Command, fn func()) *eventBatch {
+	ob.cmd = cmd
+	defer func() { ob.cmd = nil }()
+	sequenceBefore := ob.EventSequence
+	fn()
+	return ob.flushEvents(sequenceBefore)
+}
+
+// trackOrder adds an order to the lookup map and the engine's order index.
+// Must run on the book's goroutine.
+func (ob *OrderBook) trackOrder(order *Order) {
+	ob.Orders[order.ID] = order
+	if ob.index != nil {
+		ob.index.Store(order.ID, ob)
+	}
+}
+
+// untrackOrder drops an order from the lookup map and the engine's order
+// index. Must run on the book's goroutine.
+func (ob *OrderBook) untrackOrder(order *Order) {
+	delete(ob.Orders, order.ID)
+	if ob.index != nil {
+		ob.index.Delete(order.ID)
+	}
+}
+
+// removeFromLevel takes an order out of its price level, dropping the
+// level once it is empty. Must run on the book's goroutine.
+func (ob *OrderBook) removeFromLevel(order *Order) {
+	level := order.level
+	if level == nil {
+		return
+	}
+
+	level.remove(order)
+	if level.OrderCount == 0 {
+		ob.ladder(order.Side).remove(level.Price)
 	}
 }
 
 func (ob *OrderBook) RemoveFromPriceLevels(order *Order) {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-	
-	if order.Side == BUY {
-		ob.removeFromBids(order)
-	} else {
-		ob.removeFromAsks(order)
+	ob.execWait(func() {
+		ob.removeFromLevel(order)
+	})
+}
+
+// recordTrade adds a trade to the tape, updates the last trade price and
+// lets trailing stops follow it. Must run on the book's goroutine.
+func (ob *OrderBook) recordTrade(trade Trade) {
+	ob.LastTradePrice = trade.Price
+	ob.Stops.UpdateTrailing(trade.Price)
+	ob.recordEvent(BookEvent{
+		Type:     EVENT_TRADE,
+		TradeID:  trade.ID,
+		Side:     trade.AggressorSide,
+		Price:    trade.Price,
+		Quantity: trade.Quantity,
+	})
+
+	ob.recentTrades = append(ob.recentTrades, trade)
+	if len(ob.recentTrades) > maxRecentTrades {
+		ob.recentTrades = append(ob.recentTrades[:0:0], ob.recentTrades[len(ob.recentTrades)-maxRecentTrades/2:]...)
 	}
 }
 
+// RecentTrades returns up to limit of the most recent trades, oldest first
+func (ob *OrderBook) RecentTrades(limit int) []Trade {
+	var trades []Trade
+	ob.execWait(func() {
+		trades = ob.recentTradesCopy(limit)
+	})
+	return trades
+}
+
+// recentTradesCopy returns a copy of up to limit of the most recent trades.
+// Must run on the book's goroutine.
+func (ob *OrderBook) recentTradesCopy(limit int) []Trade {
+	start := max(len(ob.recentTrades)-limit, 0)
+	return append([]Trade{}, ob.recentTrades[start:]...)
+}
+
+// nextTradeSequence returns the sequence number for the next trade in this
+// book. Must run on the book's goroutine.
+func (ob *OrderBook) nextTradeSequence() uint64 {
+	ob.TradeSequence++
+	return ob.TradeSequence
+}
+
 // GetBestBid returns highest buy price
 func (ob *OrderBook) GetBestBid() int64 {
-	ob.mu.RLock()
-	defer ob.mu.RUnlock()
-	
-	if len(ob.Bids) == 0 {
-		return 0
+	var price int64
+	ob.execWait(func() {
+		price = ob.bestBid()
+	})
+	return price
+}
+
+// bestBid returns highest buy price. Must run on the book's goroutine.
+func (ob *OrderBook) bestBid() int64 {
+	if best := ob.Bids.Best(); best != nil {
+		return best.Price
 	}
-	return ob.Bids[0].Price
+	return 0
 }
 
 // GetBestAsk returns lowest sell price
 func (ob *OrderBook) GetBestAsk() int64 {
-	ob.mu.RLock()
-	defer ob.mu.RUnlock()
-	
-	if len(ob.Asks) == 0 {
-		return 0
+	var price int64
+	ob.execWait(func() {
+		price = ob.bestAsk()
+	})
+	return price
+}
+
+// bestAsk returns lowest sell price. Must run on the book's goroutine.
+func (ob *OrderBook) bestAsk() int64 {
+	if best := ob.Asks.Best(); best != nil {
+		return best.Price
+	}
+	return 0
+}
+
+// availableLiquidity returns the resting quantity an incoming order on the
+// given side could trade against. A limitPrice of 0 means no price bound.
+// Orders from accountID cannot be traded against because of self-trade
+// prevention; their quantity is returned separately as own. The scan stops
+// once needed is available, so own only counts orders ahead of that point.
+// Must run on the book's goroutine.
+func (ob *OrderBook) availableLiquidity(side OrderSide, limitPrice, needed int64, accountID string) (available, own int64) {
+	levels := ob.Bids
+	if side == BUY {
+		levels = ob.Asks
+	}
+
+	for level := range levels.All() {
+		if limitPrice > 0 && side == BUY && level.Price > limitPrice {
+			break
+		}
+		if limitPrice > 0 && side == SELL && level.Price < limitPrice {
+			break
+		}
+		for o := range level.All() {
+			if available >= needed {
+				return available, own
+			}
+			if accountID != "" && o.AccountID == accountID {
+				own += (o.Quantity - o.FilledQuantity)
+			} else {
+				available += (o.Quantity - o.FilledQuantity)
+			}
+		}
 	}
-	return ob.Asks[0].Price
+
+	return available, own
 }
 
-// Helper function to create new order with generated ID
-func NewOrder(symbol string, side OrderSide, orderType OrderType, price, quantity int64) *Order {
+// sweepCost returns what buying up to quantity from the asks would cost.
+// Orders from accountID are skipped, as self-trade prevention never trades
+// against them. Must run on the book's goroutine.
+func (ob *OrderBook) sweepCost(quantity int64, accountID string) int64 {
+	var cost int64
+	for level := range ob.Asks.All() {
+		for o := range level.All() {
+			if quantity == 0 {
+				return cost
+			}
+			if accountID != "" && o.AccountID == accountID {
+				continue
+			}
+			qty := min(quantity, o.Quantity-o.FilledQuantity)
+			cost += qty * level.Price
+			quantity -= qty
+		}
+	}
+	return cost
+}
+
+// Helper function to create new order with the given ID, arriving at
+// timestamp (Unix nanoseconds)
+func NewOrder(id, symbol string, side OrderSide, orderType OrderType, price, quantity, timestamp int64) *Order {
 	return &Order{
-		ID:             uuid.New().String(),
+		ID:             id,
 		Symbol:         symbol,
 		Side:           side,
 		Type:           orderType,
+		TimeInForce:    GTC,
 		Price:          price,
 		Quantity:       quantity,
 		FilledQuantity: 0,
 		Status:         ACCEPTED,
-		Timestamp:      time.Now().UnixMilli(),
+		Timestamp:      timestamp,
 	}
-}
\ No newline at end of file
+}
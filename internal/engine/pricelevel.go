@@ -0,0 +1,66 @@
+package engine
+
+import "iter"
+
+// Front returns the order at the head of the queue, or nil if it is empty
+func (pl *PriceLevel) Front() *Order {
+	return pl.head
+}
+
+// All iterates over the queued orders, oldest first. The queue must not be
+// changed during iteration.
+func (pl *PriceLevel) All() iter.Seq[*Order] {
+	return func(yield func(*Order) bool) {
+		for o := pl.head; o != nil; o = o.next {
+			if !yield(o) {
+				return
+			}
+		}
+	}
+}
+
+// pushBack adds an order to the back of the queue
+func (pl *PriceLevel) pushBack(o *Order) {
+	o.level = pl
+	o.prev = pl.tail
+	o.next = nil
+	if pl.tail != nil {
+		pl.tail.next = o
+	} else {
+		pl.head = o
+	}
+	pl.tail = o
+
+	pl.OrderCount++
+	pl.TotalQuantity += o.Quantity - o.FilledQuantity
+	pl.VisibleQuantity += o.visibleQuantity()
+}
+
+// remove unlinks an order from anywhere in the queue
+func (pl *PriceLevel) remove(o *Order) {
+	if o.prev != nil {
+		o.prev.next = o.next
+	} else {
+		pl.head = o.next
+	}
+	if o.next != nil {
+		o.next.prev = o.prev
+	} else {
+		pl.tail = o.prev
+	}
+
+	pl.OrderCount--
+	pl.TotalQuantity -= o.Quantity - o.FilledQuantity
+	pl.VisibleQuantity -= o.visibleQuantity()
+	o.level, o.prev, o.next = nil, nil, nil
+}
+
+// update applies a change to the quantities of a queued order and adjusts
+// the level's aggregates to match. Every change to a resting order's
+// quantities must go through here.
+func (pl *PriceLevel) update(o *Order, change func()) {
+	remaining, visible := o.Quantity-o.FilledQuantity, o.visibleQuantity()
+	change()
+	pl.TotalQuantity += o.Quantity - o.FilledQuantity - remaining
+	pl.VisibleQuantity += o.visibleQuantity() - visible
+}
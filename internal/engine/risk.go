@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RiskLimits bounds what an account may do in a symbol. Zero means no limit.
+type RiskLimits struct {
+	MaxOrderQuantity int64 `json:"max_order_quantity,omitempty"`
+	MaxNotional      int64 `json:"max_notional,omitempty"`     // price * quantity in cents
+	PriceCollarBps   int64 `json:"price_collar_bps,omitempty"` // how far through the reference price an order may be priced (100 = 1%)
+	MaxOpenOrders    int64 `json:"max_open_orders,omitempty"`  // live orders across all symbols
+	MaxPosition      int64 `json:"max_position,omitempty"`     // absolute net position in the symbol, counting live orders
+}
+
+// stricter combines two sets of limits, keeping the tighter of each
+func (l RiskLimits) stricter(other RiskLimits) RiskLimits {
+	tighter := func(a, b int64) int64 {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+	return RiskLimits{
+		MaxOrderQuantity: tighter(l.MaxOrderQuantity, other.MaxOrderQuantity),
+		MaxNotional:      tighter(l.MaxNotional, other.MaxNotional),
+		PriceCollarBps:   tighter(l.PriceCollarBps, other.PriceCollarBps),
+		MaxOpenOrders:    tighter(l.MaxOpenOrders, other.MaxOpenOrders),
+		MaxPosition:      tighter(l.MaxPosition, other.MaxPosition),
+	}
+}
+
+// RiskContext is what a RiskChecker knows about the account and market
+// when an order arrives
+type RiskContext struct {
+	// Limits for the order's account and symbol; where both set a limit
+	// the stricter one applies
+	Limits RiskLimits
+
+	LastTradePrice int64
+	BestBid        int64
+	BestAsk        int64
+
+	OpenOrders       int64 // live orders the account already has, across all symbols
+	Position         int64 // the account's net position in the symbol, buys minus sells
+	OpenBuyQuantity  int64 // left to fill on the account's live buys in the symbol
+	OpenSellQuantity int64 // left to fill on the account's live sells in the symbol
+}
+
+// ReferencePrice returns the price an order on side is measured against:
+// the last trade, or the opposite touch if nothing has traded yet. Returns
+// 0 if there is neither.
+func (ctx RiskContext) ReferencePrice(side OrderSide) int64 {
+	if ctx.LastTradePrice > 0 {
+		return ctx.LastTradePrice
+	}
+	if side == BUY {
+		return ctx.BestAsk
+	}
+	return ctx.BestBid
+}
+
+// RiskRejection is returned by a RiskChecker that refuses an order
+type RiskRejection struct {
+	Reason  RejectReason `json:"reason"`
+	Message string       `json:"message"`
+}
+
+func (r *RiskRejection) Error() string {
+	return r.Message
+}
+
+// RiskChecker validates an order before it reaches the book. It returns nil
+// to accept the order.
+type RiskChecker interface {
+	Check(order Order, ctx RiskContext) *RiskRejection
+}
+
+// RiskCheckerFunc adapts a function to the RiskChecker interface
+type RiskCheckerFunc func(order Order, ctx RiskContext) *RiskRejection
+
+func (f RiskCheckerFunc) Check(order Order, ctx RiskContext) *RiskRejection {
+	return f(order, ctx)
+}
+
+// WithRiskChecker adds a pre-trade check that runs after the built-in ones.
+// Checks run on the order's book goroutine, so they must not call back
+// into the engine, and orders on different symbols are checked at the same
+// time, so a checker must be safe for concurrent use.
+func WithRiskChecker(checker RiskChecker) Option {
+	return func(me *MatchingEngine) {
+		me.risk.checkers = append(me.risk.checkers, checker)
+	}
+}
+
+// builtinRiskCheckers run on every order, in this order
+var builtinRiskCheckers = []RiskChecker{
+	RiskCheckerFunc(checkMaxOrderQuantity),
+	RiskCheckerFunc(checkMaxNotional),
+	RiskCheckerFunc(checkPriceCollar),
+	RiskCheckerFunc(checkMaxOpenOrders),
+	RiskCheckerFunc(checkMaxPosition),
+}
+
+func checkMaxOrderQuantity(order Order, ctx RiskContext) *RiskRejection {
+	if ctx.Limits.MaxOrderQuantity > 0 && order.Quantity > ctx.Limits.MaxOrderQuantity {
+		return &RiskRejection{
+			Reason:  REJECT_MAX_ORDER_QUANTITY,
+			Message: fmt.Sprintf("order quantity %d exceeds limit of %d", order.Quantity, ctx.Limits.MaxOrderQuantity),
+		}
+	}
+	return nil
+}
+
+// checkMaxNotional values market and stop orders at the reference price
+func checkMaxNotional(order Order, ctx RiskContext) *RiskRejection {
+	price := order.Price
+	if price == 0 {
+		price = ctx.ReferencePrice(order.Side)
+	}
+	if ctx.Limits.MaxNotional > 0 && price*order.Quantity > ctx.Limits.MaxNotional {
+		return &RiskRejection{
+			Reason:  REJECT_MAX_NOTIONAL,
+			Message: fmt.Sprintf("order notional %d exceeds limit of %d", price*order.Quantity, ctx.Limits.MaxNotional),
+		}
+	}
+	return nil
+}
+
+// checkPriceCollar rejects limit prices too far through the reference
+// price: buys too far above it, sells too far below. Orders priced away from
+// the market are never collared.
+func checkPriceCollar(order Order, ctx RiskContext) *RiskRejection {
+	reference := ctx.ReferencePrice(order.Side)
+	if ctx.Limits.PriceCollarBps == 0 || order.Price == 0 || reference == 0 {
+		return nil
+	}
+
+	band := reference * ctx.Limits.PriceCollarBps / 10000
+	if (order.Side == BUY && order.Price > reference+band) || (order.Side == SELL && order.Price < reference-band) {
+		return &RiskRejection{
+			Reason:  REJECT_PRICE_COLLAR,
+			Message: fmt.Sprintf("price %d is more than %d bps from reference price %d", order.Price, ctx.Limits.PriceCollarBps, reference),
+		}
+	}
+	return nil
+}
+
+func checkMaxOpenOrders(order Order, ctx RiskContext) *RiskRejection {
+	if ctx.Limits.MaxOpenOrders > 0 && ctx.OpenOrders >= ctx.Limits.MaxOpenOrders {
+		return &RiskRejection{
+			Reason:  REJECT_MAX_OPEN_ORDERS,
+			Message: fmt.Sprintf("account already has %d open orders, limit is %d", ctx.OpenOrders, ctx.Limits.MaxOpenOrders),
+		}
+	}
+	return nil
+}
+
+// checkMaxPosition assumes the order fills completely, and so do the
+// account's live orders on the same side
+func checkMaxPosition(order Order, ctx RiskContext) *RiskRejection {
+	position := ctx.Position + ctx.OpenBuyQuantity + order.Quantity
+	if order.Side == SELL {
+		position = ctx.Position - ctx.OpenSellQuantity - order.Quantity
+	}
+	if position < 0 {
+		position = -position
+	}
+	if ctx.Limits.MaxPosition > 0 && position > ctx.Limits.MaxPosition {
+		return &RiskRejection{
+			Reason:  REJECT_MAX_POSITION,
+			Message: fmt.Sprintf("position would reach %d, limit is %d", position, ctx.Limits.MaxPosition),
+		}
+	}
+	return nil
+}
+
+// riskManager holds the configured limits and any extra checkers
+type riskManager struct {
+	accountLimits map[string]RiskLimits
+	symbolLimits  map[string]RiskLimits
+	checkers      []RiskChecker
+	mu            sync.RWMutex
+}
+
+// limits returns the limits that apply to an account trading a symbol
+func (rm *riskManager) limits(accountID, symbol string) RiskLimits {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	return rm.accountLimits[accountID].stricter(rm.symbolLimits[symbol])
+}
+
+// SetAccountRiskLimits replaces the risk limits for an account
+func (me *MatchingEngine) SetAccountRiskLimits(accountID string, limits RiskLimits) error {
+	return me.setRiskLimits(&Command{Type: CMD_SET_ACCOUNT_RISK_LIMITS, AccountID: accountID, Limits: &limits})
+}
+
+// SetSymbolRiskLimits replaces the risk limits for a symbol
+func (me *MatchingEngine) SetSymbolRiskLimits(symbol string, limits RiskLimits) error {
+	return me.setRiskLimits(&Command{Type: CMD_SET_SYMBOL_RISK_LIMITS, Symbol: symbol, Limits: &limits})
+}
+
+// setRiskLimits runs an account or symbol risk limits command
+func (me *MatchingEngine) setRiskLimits(cmd *Command) error {
+	me.applying.RLock()
+	defer me.applying.RUnlock()
+
+	if cmd.Type == CMD_SET_ACCOUNT_RISK_LIMITS && cmd.AccountID == "" {
+		return fmt.Errorf("account ID is required")
+	}
+	if cmd.Type == CMD_SET_SYMBOL_RISK_LIMITS && cmd.Symbol == "" {
+		return fmt.Errorf("symbol is required")
+	}
+	if err := cmd.Limits.validate(); err != nil {
+		return err
+	}
+	if err := me.checkLog(); err != nil {
+		return err
+	}
+
+	me.risk.mu.Lock()
+	if cmd.Type == CMD_SET_ACCOUNT_RISK_LIMITS {
+		if me.risk.accountLimits == nil {
+			me.risk.accountLimits = make(map[string]RiskLimits)
+		}
+		me.risk.accountLimits[cmd.AccountID] = *cmd.Limits
+	} else {
+		if me.risk.symbolLimits == nil {
+			me.risk.symbolLimits = make(map[string]RiskLimits)
+		}
+		me.risk.symbolLimits[cmd.Symbol] = *cmd.Limits
+	}
+	seq, err := me.logCommand(cmd)
+	me.risk.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return me.syncCommand(seq)
+}
+
+// GetAccountRiskLimits returns the risk limits set for an account
+func (me *MatchingEngine) GetAccountRiskLimits(accountID string) RiskLimits {
+	me.risk.mu.RLock()
+	defer me.risk.mu.RUnlock()
+
+	return me.risk.accountLimits[accountID]
+}
+
+// GetSymbolRiskLimits returns the risk limits set for a symbol
+func (me *MatchingEngine) GetSymbolRiskLimits(symbol string) RiskLimits {
+	me.risk.mu.RLock()
+	defer me.risk.mu.RUnlock()
+
+	return me.risk.symbolLimits[symbol]
+}
+
+func (l RiskLimits) validate() error {
+	if l.MaxOrderQuantity < 0 || l.MaxNotional < 0 || l.PriceCollarBps < 0 || l.MaxOpenOrders < 0 || l.MaxPosition < 0 {
+		return fmt.Errorf("risk limits must not be negative")
+	}
+	return nil
+}
+
+// checkRisk runs every pre-trade check against a new order and returns the
+// first rejection. An order that passes is counted among its account's
+// live orders straight away. It runs just before the order touches the
+// book, in the same command. Must run on the book's goroutine.
+func (me *MatchingEngine) checkRisk(book *OrderBook, order *Order) *RiskRejection {
+	me.risk.mu.RLock()
+	checkers := append(append([]RiskChecker{}, builtinRiskCheckers...), me.risk.checkers...)
+	me.risk.mu.RUnlock()
+
+	ctx := RiskContext{
+		Limits:         me.risk.limits(order.AccountID, order.Symbol),
+		LastTradePrice: book.LastTradePrice,
+		BestBid:        book.bestBid(),
+		BestAsk:        book.bestAsk(),
+	}
+	return me.accounts.reserveOpen(order, ctx, checkers)
+}
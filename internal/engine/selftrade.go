@@ -0,0 +1,66 @@
+package engine
+
+// isSelfTrade reports whether an incoming order would trade with a resting
+// order from the same account. Orders without an account never self-trade.
+func isSelfTrade(incoming, resting *Order) bool {
+	return incoming.AccountID != "" && incoming.AccountID == resting.AccountID
+}
+
+// preventSelfTrade applies the incoming order's self-trade prevention mode
+// to a resting order at the front of level. Resting orders that are
+// cancelled leave the queue and the lookup map. An incoming order that is
+// cancelled gets CANCEL_SELF_TRADE, which stops matching; processOrder
+// cancels its remainder. Must run on the book's goroutine.
+func (me *MatchingEngine) preventSelfTrade(book *OrderBook, level *PriceLevel, incoming, resting *Order) {
+	switch incoming.SelfTradePrevention {
+	case STP_CANCEL_OLDEST:
+		me.cancelSelfTrade(book, level, incoming, resting)
+
+	case STP_CANCEL_BOTH:
+		me.cancelSelfTrade(book, level, incoming, resting)
+		incoming.CancelReason = CANCEL_SELF_TRADE
+
+	case STP_DECREMENT_AND_CANCEL:
+		// Both orders shrink by the quantity that would have traded, and
+		// whichever reaches zero is cancelled
+		qty := min(incoming.Quantity-incoming.FilledQuantity, resting.Quantity-resting.FilledQuantity)
+		incoming.Quantity -= qty
+		incoming.selfTradeQty += qty
+		level.update(resting, func() {
+			resting.Quantity -= qty
+			if resting.DisplayQuantity > 0 {
+				resting.displayRemaining = resting.visibleQuantity()
+			}
+		})
+		me.shrinkFunds(incoming, qty)
+		me.shrinkFunds(resting, qty)
+
+		if resting.Quantity == resting.FilledQuantity {
+			me.cancelSelfTrade(book, level, incoming, resting)
+		} else {
+			me.accounts.trackOpen(resting)
+			book.orderEvent(EVENT_AMEND, resting, resting.visibleQuantity())
+		}
+		if incoming.Quantity == incoming.FilledQuantity {
+			incoming.CancelReason = CANCEL_SELF_TRADE
+		}
+
+	default:
+		// CANCEL_NEWEST: the resting order keeps its place
+		incoming.CancelReason = CANCEL_SELF_TRADE
+	}
+}
+
+// cancelSelfTrade cancels a resting order at the front of level that the
+// incoming order would have traded with. Must run on the book's goroutine.
+func (me *MatchingEngine) cancelSelfTrade(book *OrderBook, level *PriceLevel, incoming, resting *Order) {
+	resting.Status = CANCELLED
+	resting.CancelReason = CANCEL_SELF_TRADE
+	level.remove(resting)
+	book.untrackOrder(resting)
+	me.releaseFunds(resting)
+	me.accounts.trackOpen(resting)
+	book.orderEvent(EVENT_CANCEL, resting, resting.visibleQuantity())
+	book.emit(ORDER_CANCELLED, resting, nil)
+	incoming.selfTradeCancelled = append(incoming.selfTradeCancelled, resting.ID)
+}
@@ -0,0 +1,542 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// A snapshot holds the whole engine state after a given command log
+// sequence number:
+//
+//	magic, format version, sequence number, engine event sequence number,
+//	books, accounts, client order IDs, risk limits, ledger, fees, expiry,
+//	CRC-32C of everything before it (4 bytes, little endian)
+//
+// Integers are varints and strings are length-prefixed. Each order is
+// written once, with the book that tracks it or else with its account, and
+// referred to by ID everywhere else.
+//
+// Version 2 added event sequence numbers and the event tape, and made
+// timestamps nanoseconds. Version 1 snapshots still load, with their
+// events starting from 1.
+const (
+	snapshotMagic = "OMESNAP\n"
+
+	// SnapshotVersion is the snapshot format written by WriteSnapshot
+	SnapshotVersion = 2
+)
+
+var snapshotCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteSnapshot writes the engine's state to w and returns the sequence
+// number of the last logged command it includes. Commands wait while the
+// state is copied, but not while it is written out.
+func (me *MatchingEngine) WriteSnapshot(w io.Writer) (uint64, error) {
+	seq, data, err := me.encodeSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// encodeSnapshot copies the engine's state once every command in progress
+// has been applied and logged
+func (me *MatchingEngine) encodeSnapshot() (uint64, []byte, error) {
+	me.applying.Lock()
+	defer me.applying.Unlock()
+
+	// After a log failure the state is ahead of the log
+	if err := me.checkLog(); err != nil {
+		return 0, nil, err
+	}
+
+	seq := me.logSeq.Load()
+	e := &snapshotEncoder{buf: []byte(snapshotMagic)}
+	e.putUint(SnapshotVersion)
+	e.putUint(seq)
+	e.putUint(me.eventSeq.Load())
+
+	books := me.allBooks()
+	sort.Slice(books, func(i, j int) bool {
+		return books[i].Symbol < books[j].Symbol
+	})
+	written := make(map[string]bool)
+	var revenue []FeeRevenue
+	e.putUint(uint64(len(books)))
+	for _, book := range books {
+		if err := book.execWait(func() {
+			book.encodeSnapshot(e, written)
+			if book.feeRevenue.Trades > 0 {
+				revenue = append(revenue, book.feeRevenue)
+			}
+		}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	me.accounts.encodeSnapshot(e, written)
+	me.clientOrders.encodeSnapshot(e)
+
+	me.risk.mu.RLock()
+	e.putRiskLimits(me.risk.accountLimits)
+	e.putRiskLimits(me.risk.symbolLimits)
+	me.risk.mu.RUnlock()
+
+	e.putBool(me.ledger != nil)
+	if me.ledger != nil {
+		me.ledger.encodeSnapshot(e)
+	}
+	me.fees.encodeSnapshot(e, revenue)
+	me.expiry.encodeSnapshot(e)
+
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, crc32.Checksum(e.buf, snapshotCRC))
+	return seq, e.buf, nil
+}
+
+// LoadSnapshot restores state written by WriteSnapshot into a new engine,
+// configured with the same ledger setting, before it takes any commands.
+// It returns the sequence number of the last command the snapshot
+// includes; replay the command log from the one after it. Nothing is
+// changed if the snapshot is damaged.
+func (me *MatchingEngine) LoadSnapshot(r io.Reader) (uint64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("not a snapshot")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, snapshotCRC) != sum {
+		return 0, fmt.Errorf("corrupt snapshot: checksum mismatch")
+	}
+
+	d := &snapshotDecoder{data: body[len(snapshotMagic):]}
+	d.version = d.uint()
+	if d.version < 1 || d.version > SnapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", d.version)
+	}
+	seq := d.uint()
+	var eventSeq uint64
+	if d.version >= 2 {
+		eventSeq = d.uint()
+	}
+
+	// Decode everything before touching the engine
+	orders := make(map[string]*Order)
+	books := make([]*OrderBook, d.count())
+	for i := range books {
+		books[i] = decodeBookSnapshot(d, orders)
+	}
+	accounts := decodeAccountsSnapshot(d, orders)
+	clientOrders := decodeClientOrdersSnapshot(d)
+	accountLimits, symbolLimits := d.riskLimits(), d.riskLimits()
+	var balances *ledger
+	if d.bool() {
+		balances = decodeLedgerSnapshot(d)
+	}
+	fees, revenue := decodeFeesSnapshot(d)
+	queue, nextExpirySeq := decodeExpirySnapshot(d)
+
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d unexpected bytes at the end", len(d.data))
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	if (balances != nil) != (me.ledger != nil) {
+		return 0, fmt.Errorf("snapshot ledger setting does not match the engine")
+	}
+
+	me.applying.Lock()
+	defer me.applying.Unlock()
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	if me.closed {
+		return 0, ErrEngineClosed
+	}
+	if len(me.allBooks()) > 0 || me.logSeq.Load() > 0 {
+		return 0, fmt.Errorf("snapshots can only be loaded into a new engine")
+	}
+
+	for _, book := range books {
+		book.index = &me.orders
+		book.engineSequence = &me.eventSeq
+		book.bus = &me.bus
+		book.feeRevenue = revenue[book.Symbol]
+		for id := range book.Orders {
+			me.orders.Store(id, book)
+		}
+		book.start(me.queueDepth)
+		me.books.Store(book.Symbol, book)
+	}
+
+	me.accounts.mu.Lock()
+	me.accounts.accounts = accounts
+	me.accounts.mu.Unlock()
+
+	me.clientOrders.mu.Lock()
+	me.clientOrders.orders = clientOrders
+	me.clientOrders.mu.Unlock()
+
+	me.risk.mu.Lock()
+	me.risk.accountLimits, me.risk.symbolLimits = accountLimits, symbolLimits
+	me.risk.mu.Unlock()
+
+	if balances != nil {
+		me.ledger.mu.Lock()
+		me.ledger.balances, me.ledger.holds = balances.balances, balances.holds
+		me.ledger.mu.Unlock()
+	}
+
+	me.fees.mu.Lock()
+	me.fees.schedules, me.fees.tiers = fees.schedules, fees.tiers
+	me.fees.mu.Unlock()
+
+	me.expiry.mu.Lock()
+	me.expiry.queue, me.expiry.nextSeq = queue, nextExpirySeq
+	me.expiry.mu.Unlock()
+
+	me.eventSeq.Store(eventSeq)
+	me.logSeq.Store(seq)
+	return seq, nil
+}
+
+// encodeSnapshot writes the book's orders, price levels, stops, and trade
+// and event tapes. IDs of the orders written are added to written. Must run
+// on the book's goroutine.
+func (ob *OrderBook) encodeSnapshot(e *snapshotEncoder, written map[string]bool) {
+	e.putString(ob.Symbol)
+	e.putInt(ob.LastTradePrice)
+	e.putUint(ob.TradeSequence)
+	e.putTrades(ob.recentTrades)
+	e.putUint(ob.EventSequence)
+	e.putEvents(ob.recentEvents)
+
+	ids := sortedKeys(ob.Orders)
+	e.putUint(uint64(len(ids)))
+	for _, id := range ids {
+		e.putOrder(ob.Orders[id])
+		written[id] = true
+	}
+
+	// Levels best first, each queue front to back
+	for _, ladder := range []*PriceLadder{ob.Bids, ob.Asks} {
+		e.putUint(uint64(ladder.Len()))
+		for level := range ladder.All() {
+			e.putInt(level.Price)
+			e.putUint(uint64(level.OrderCount))
+			for o := range level.All() {
+				e.putString(o.ID)
+			}
+		}
+	}
+
+	for _, stops := range [][]*Order{ob.Stops.BuyStops, ob.Stops.SellStops} {
+		e.putUint(uint64(len(stops)))
+		for _, o := range stops {
+			e.putString(o.ID)
+		}
+	}
+	e.putUint(ob.Stops.nextSeq)
+}
+
+// decodeBookSnapshot rebuilds a standalone book, adding its orders to orders
+func decodeBookSnapshot(d *snapshotDecoder, orders map[string]*Order) *OrderBook {
+	book := NewOrderBook(d.string())
+	book.LastTradePrice = d.int()
+	book.TradeSequence = d.uint()
+	book.recentTrades = d.trades()
+	if d.version >= 2 {
+		book.EventSequence = d.uint()
+		book.recentEvents = d.events()
+	}
+
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		order := d.order()
+		book.Orders[order.ID] = order
+		orders[order.ID] = order
+	}
+
+	lookup := func() *Order {
+		id := d.string()
+		order, exists := book.Orders[id]
+		if !exists && d.err == nil {
+			d.fail("book %s refers to unknown order %s", book.Symbol, id)
+		}
+		return order
+	}
+
+	for _, ladder := range []*PriceLadder{book.Bids, book.Asks} {
+		for levels := d.count(); levels > 0 && d.err == nil; levels-- {
+			level := ladder.getOrCreate(d.int())
+			for n := d.count(); n > 0 && d.err == nil; n-- {
+				if order := lookup(); order != nil {
+					level.pushBack(order)
+				}
+			}
+		}
+	}
+
+	for _, stops := range []*[]*Order{&book.Stops.BuyStops, &book.Stops.SellStops} {
+		for n := d.count(); n > 0 && d.err == nil; n-- {
+			if order := lookup(); order != nil {
+				*stops = append(*stops, order)
+				if order.Type == TRAILING_STOP {
+					book.Stops.trailing++
+				}
+			}
+		}
+	}
+	book.Stops.nextSeq = d.uint()
+	return book
+}
+
+// encodeSnapshot writes every account with its order and trade history.
+// Orders already written with a book are referred to by ID. The snapshot
+// holds the applying lock, so no account changes while it is written.
+func (r *accountRegistry) encodeSnapshot(e *snapshotEncoder, written map[string]bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e.putUint(uint64(len(r.accounts)))
+	for _, id := range sortedKeys(r.accounts) {
+		account := r.accounts[id]
+		e.putString(id)
+		e.putString(string(account.SelfTradePrevention))
+
+		e.putUint(uint64(len(account.orders)))
+		for _, o := range account.orders {
+			e.putBool(written[o.ID])
+			if written[o.ID] {
+				e.putString(o.ID)
+			} else {
+				e.putOrder(o)
+			}
+		}
+
+		e.putTrades(account.trades)
+
+		e.putUint(uint64(len(account.positions)))
+		for _, symbol := range sortedKeys(account.positions) {
+			e.putString(symbol)
+			e.putInt(account.positions[symbol])
+		}
+	}
+}
+
+func decodeAccountsSnapshot(d *snapshotDecoder, orders map[string]*Order) map[string]*Account {
+	n := d.count()
+	accounts := make(map[string]*Account, n)
+	for ; n > 0 && d.err == nil; n-- {
+		account := &Account{ID: d.string(), positions: make(map[string]int64), open: make(map[string]openOrder)}
+		account.SelfTradePrevention = SelfTradePrevention(d.string())
+
+		for count := d.count(); count > 0 && d.err == nil; count-- {
+			if !d.bool() {
+				account.orders = append(account.orders, d.order())
+				continue
+			}
+			id := d.string()
+			order, exists := orders[id]
+			if !exists {
+				d.fail("account %s refers to unknown order %s", account.ID, id)
+				break
+			}
+			account.orders = append(account.orders, order)
+
+			// Every live order is tracked by a book, so is written with it
+			if order.isLive() {
+				account.open[id] = openOrder{symbol: order.Symbol, side: order.Side, quantity: order.Quantity - order.FilledQuantity}
+			}
+		}
+
+		account.trades = d.trades()
+
+		for count := d.count(); count > 0 && d.err == nil; count-- {
+			symbol := d.string()
+			account.positions[symbol] = d.int()
+		}
+		accounts[account.ID] = account
+	}
+	return accounts
+}
+
+// encodeSnapshot writes the result of every completed submission with a
+// client order ID. None are in flight while a snapshot is taken.
+func (r *clientOrderRegistry) encodeSnapshot(e *snapshotEncoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e.putUint(uint64(len(r.orders)))
+	for _, key := range sortedKeys(r.orders) {
+		e.putString(key)
+		e.putOrderResult(r.orders[key].result)
+	}
+}
+
+func decodeClientOrdersSnapshot(d *snapshotDecoder) map[string]*clientOrder {
+	n := d.count()
+	orders := make(map[string]*clientOrder, n)
+	for ; n > 0 && d.err == nil; n-- {
+		key := d.string()
+		entry := &clientOrder{done: make(chan struct{}), result: d.orderResult()}
+		close(entry.done)
+		orders[key] = entry
+	}
+	return orders
+}
+
+// encodeSnapshot writes every balance and hold
+func (l *ledger) encodeSnapshot(e *snapshotEncoder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.putUint(uint64(len(l.balances)))
+	for _, accountID := range sortedKeys(l.balances) {
+		assets := l.balances[accountID]
+		e.putString(accountID)
+		e.putUint(uint64(len(assets)))
+		for _, asset := range sortedKeys(assets) {
+			b := assets[asset]
+			e.putString(b.Asset)
+			e.putInt(b.Available)
+			e.putInt(b.Held)
+		}
+	}
+
+	e.putUint(uint64(len(l.holds)))
+	for _, orderID := range sortedKeys(l.holds) {
+		h := l.holds[orderID]
+		e.putString(orderID)
+		e.putString(h.accountID)
+		e.putString(h.asset)
+		e.putInt(h.amount)
+		e.putInt(h.perUnit)
+		e.putInt(h.fees)
+	}
+}
+
+func decodeLedgerSnapshot(d *snapshotDecoder) *ledger {
+	l := newLedger()
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		accountID := d.string()
+		assets := make(map[string]*Balance)
+		for count := d.count(); count > 0 && d.err == nil; count-- {
+			b := &Balance{Asset: d.string(), Available: d.int(), Held: d.int()}
+			assets[b.Asset] = b
+		}
+		l.balances[accountID] = assets
+	}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		orderID := d.string()
+		l.holds[orderID] = &hold{
+			accountID: d.string(),
+			asset:     d.string(),
+			amount:    d.int(),
+			perUnit:   d.int(),
+			fees:      d.int(),
+		}
+	}
+	return l
+}
+
+// encodeSnapshot writes the fee schedules, account tiers and the revenue
+// collected by each book, sorted by symbol
+func (fm *feeManager) encodeSnapshot(e *snapshotEncoder, revenue []FeeRevenue) {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	schedules := make([]FeeSchedule, 0, len(fm.schedules))
+	for _, schedule := range fm.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].Symbol != schedules[j].Symbol {
+			return schedules[i].Symbol < schedules[j].Symbol
+		}
+		return schedules[i].Tier < schedules[j].Tier
+	})
+	e.putUint(uint64(len(schedules)))
+	for _, s := range schedules {
+		e.putString(s.Symbol)
+		e.putString(s.Tier)
+		e.putInt(s.MakerBps)
+		e.putInt(s.TakerBps)
+	}
+
+	e.putUint(uint64(len(fm.tiers)))
+	for _, accountID := range sortedKeys(fm.tiers) {
+		e.putString(accountID)
+		e.putString(fm.tiers[accountID])
+	}
+
+	e.putUint(uint64(len(revenue)))
+	for _, r := range revenue {
+		e.putString(r.Symbol)
+		e.putInt(r.Trades)
+		e.putInt(r.Notional)
+		e.putInt(r.MakerFees)
+		e.putInt(r.TakerFees)
+		e.putInt(r.Net)
+	}
+}
+
+func decodeFeesSnapshot(d *snapshotDecoder) (*feeManager, map[string]FeeRevenue) {
+	fm := &feeManager{
+		schedules: make(map[feeKey]FeeSchedule),
+		tiers:     make(map[string]string),
+	}
+	revenue := make(map[string]FeeRevenue)
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		s := FeeSchedule{Symbol: d.string(), Tier: d.string(), MakerBps: d.int(), TakerBps: d.int()}
+		fm.schedules[feeKey{s.Symbol, s.Tier}] = s
+	}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		accountID := d.string()
+		fm.tiers[accountID] = d.string()
+	}
+	for n := d.count(); n > 0 && d.err == nil; n-- {
+		r := FeeRevenue{
+			Symbol:    d.string(),
+			Trades:    d.int(),
+			Notional:  d.int(),
+			MakerFees: d.int(),
+			TakerFees: d.int(),
+			Net:       d.int(),
+		}
+		revenue[r.Symbol] = r
+	}
+	return fm, revenue
+}
+
+// encodeSnapshot writes the expiry queue in heap order
+func (es *expiryScheduler) encodeSnapshot(e *snapshotEncoder) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	e.putUint(es.nextSeq)
+	e.putUint(uint64(len(es.queue)))
+	for _, entry := range es.queue {
+		e.putInt(entry.expireAt)
+		e.putUint(entry.seq)
+		e.putString(entry.orderID)
+		e.putString(entry.symbol)
+	}
+}
+
+func decodeExpirySnapshot(d *snapshotDecoder) (expiryQueue, uint64) {
+	nextSeq := d.uint()
+	queue := make(expiryQueue, d.count())
+	for i := range queue {
+		queue[i] = expiryEntry{expireAt: d.int(), seq: d.uint(), orderID: d.string(), symbol: d.string()}
+	}
+	return queue, nextSeq
+}
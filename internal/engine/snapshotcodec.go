@@ -0,0 +1,352 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// snapshotEncoder appends values in the snapshot encoding: unsigned and
+// signed varints, and length-prefixed strings
+type snapshotEncoder struct {
+	buf []byte
+}
+
+func (e *snapshotEncoder) putUint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *snapshotEncoder) putInt(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *snapshotEncoder) putString(s string) {
+	e.putUint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *snapshotEncoder) putBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *snapshotEncoder) putStrings(values []string) {
+	e.putUint(uint64(len(values)))
+	for _, v := range values {
+		e.putString(v)
+	}
+}
+
+// snapshotDecoder reads values written by snapshotEncoder. The first error
+// sticks: later reads return zero values and err reports it.
+type snapshotDecoder struct {
+	data    []byte
+	err     error
+	version uint64 // format being read
+}
+
+func (d *snapshotDecoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("corrupt snapshot: "+format, args...)
+	}
+}
+
+func (d *snapshotDecoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad integer")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *snapshotDecoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("bad integer")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *snapshotDecoder) string() string {
+	n := d.uint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.data)) {
+		d.fail("string runs past the end")
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+// timestamp reads a time in Unix nanoseconds, converting the milliseconds
+// of version 1
+func (d *snapshotDecoder) timestamp() int64 {
+	t := d.int()
+	if d.version == 1 {
+		t *= int64(time.Millisecond)
+	}
+	return t
+}
+
+func (d *snapshotDecoder) bool() bool {
+	return d.uint() != 0
+}
+
+// count reads the length of a list. Every element takes at least a byte,
+// so a count larger than what is left is corruption, not a huge list.
+func (d *snapshotDecoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.fail("list of %d entries runs past the end", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *snapshotDecoder) strings() []string {
+	values := make([]string, d.count())
+	for i := range values {
+		values[i] = d.string()
+	}
+	return values
+}
+
+// sortedKeys returns the keys of a string-keyed map in order, so snapshots of
+// the same state are identical
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *snapshotEncoder) putOrder(o *Order) {
+	e.putString(o.ID)
+	e.putString(o.ClientOrderID)
+	e.putString(o.AccountID)
+	e.putString(o.Symbol)
+	e.putString(string(o.Side))
+	e.putString(string(o.Type))
+	e.putString(string(o.TimeInForce))
+	e.putBool(o.PostOnly)
+	e.putBool(o.RepriceOnCross)
+	e.putString(string(o.SelfTradePrevention))
+	e.putInt(o.Price)
+	e.putInt(o.StopPrice)
+	e.putBool(o.Triggered)
+	e.putInt(o.TrailAmount)
+	e.putInt(o.TrailBps)
+	e.putInt(o.Quantity)
+	e.putInt(o.FilledQuantity)
+	e.putInt(o.DisplayQuantity)
+	e.putString(string(o.Status))
+	e.putString(string(o.RejectReason))
+	e.putString(string(o.CancelReason))
+	e.putInt(o.ExpireAt)
+	e.putInt(o.Timestamp)
+	e.putUint(o.stopSeq)
+	e.putInt(o.displayRemaining)
+}
+
+func (d *snapshotDecoder) order() *Order {
+	return &Order{
+		ID:                  d.string(),
+		ClientOrderID:       d.string(),
+		AccountID:           d.string(),
+		Symbol:              d.string(),
+		Side:                OrderSide(d.string()),
+		Type:                OrderType(d.string()),
+		TimeInForce:         TimeInForce(d.string()),
+		PostOnly:            d.bool(),
+		RepriceOnCross:      d.bool(),
+		SelfTradePrevention: SelfTradePrevention(d.string()),
+		Price:               d.int(),
+		StopPrice:           d.int(),
+		Triggered:           d.bool(),
+		TrailAmount:         d.int(),
+		TrailBps:            d.int(),
+		Quantity:            d.int(),
+		FilledQuantity:      d.int(),
+		DisplayQuantity:     d.int(),
+		Status:              OrderStatus(d.string()),
+		RejectReason:        RejectReason(d.string()),
+		CancelReason:        CancelReason(d.string()),
+		ExpireAt:            d.int(),
+		Timestamp:           d.timestamp(),
+		stopSeq:             d.uint(),
+		displayRemaining:    d.int(),
+	}
+}
+
+func (e *snapshotEncoder) putTrades(trades []Trade) {
+	e.putUint(uint64(len(trades)))
+	for _, t := range trades {
+		e.putString(t.ID)
+		e.putString(t.Symbol)
+		e.putUint(t.Sequence)
+		e.putInt(t.Price)
+		e.putInt(t.Quantity)
+		e.putInt(t.Timestamp)
+		e.putString(t.BuyerID)
+		e.putString(t.SellerID)
+		e.putString(t.BuyerAccountID)
+		e.putString(t.SellerAccountID)
+		e.putString(string(t.AggressorSide))
+		e.putString(t.MakerOrderID)
+		e.putString(t.TakerOrderID)
+		e.putString(string(t.MakerSide))
+		e.putString(string(t.TakerSide))
+		e.putInt(t.MakerFee)
+		e.putInt(t.TakerFee)
+	}
+}
+
+func (d *snapshotDecoder) trades() []Trade {
+	trades := make([]Trade, d.count())
+	for i := range trades {
+		trades[i] = Trade{
+			ID:              d.string(),
+			Symbol:          d.string(),
+			Sequence:        d.uint(),
+			Price:           d.int(),
+			Quantity:        d.int(),
+			Timestamp:       d.timestamp(),
+			BuyerID:         d.string(),
+			SellerID:        d.string(),
+			BuyerAccountID:  d.string(),
+			SellerAccountID: d.string(),
+			AggressorSide:   OrderSide(d.string()),
+			MakerOrderID:    d.string(),
+			TakerOrderID:    d.string(),
+			MakerSide:       OrderSide(d.string()),
+			TakerSide:       OrderSide(d.string()),
+			MakerFee:        d.int(),
+			TakerFee:        d.int(),
+		}
+	}
+	return trades
+}
+
+func (e *snapshotEncoder) putEvents(events []BookEvent) {
+	e.putUint(uint64(len(events)))
+	for _, ev := range events {
+		e.putUint(ev.Sequence)
+		e.putUint(ev.EngineSequence)
+		e.putString(string(ev.Type))
+		e.putString(ev.Symbol)
+		e.putString(ev.OrderID)
+		e.putString(ev.TradeID)
+		e.putString(string(ev.Side))
+		e.putInt(ev.Price)
+		e.putInt(ev.Quantity)
+		e.putString(string(ev.Status))
+		e.putInt(ev.Timestamp)
+	}
+}
+
+func (d *snapshotDecoder) events() []BookEvent {
+	events := make([]BookEvent, d.count())
+	for i := range events {
+		events[i] = BookEvent{
+			Sequence:       d.uint(),
+			EngineSequence: d.uint(),
+			Type:           BookEventType(d.string()),
+			Symbol:         d.string(),
+			OrderID:        d.string(),
+			TradeID:        d.string(),
+			Side:           OrderSide(d.string()),
+			Price:          d.int(),
+			Quantity:       d.int(),
+			Status:         OrderStatus(d.string()),
+			Timestamp:      d.int(),
+		}
+	}
+	return events
+}
+
+func (e *snapshotEncoder) putOrderResult(r *OrderResult) {
+	e.putString(r.OrderID)
+	e.putString(r.ClientOrderID)
+	e.putString(string(r.Status))
+	e.putInt(r.FilledQuantity)
+	e.putInt(r.RemainingQuantity)
+	e.putInt(r.CancelledQuantity)
+	e.putTrades(r.Trades)
+	e.putString(string(r.RejectReason))
+	e.putString(string(r.CancelReason))
+	e.putString(r.Message)
+	e.putInt(r.SelfTradePreventedQuantity)
+	e.putStrings(r.SelfTradeCancelledOrderIDs)
+}
+
+func (d *snapshotDecoder) orderResult() *OrderResult {
+	r := &OrderResult{
+		OrderID:           d.string(),
+		ClientOrderID:     d.string(),
+		Status:            OrderStatus(d.string()),
+		FilledQuantity:    d.int(),
+		RemainingQuantity: d.int(),
+		CancelledQuantity: d.int(),
+		Trades:            d.trades(),
+		RejectReason:      RejectReason(d.string()),
+		CancelReason:      CancelReason(d.string()),
+		Message:           d.string(),
+	}
+	r.SelfTradePreventedQuantity = d.int()
+	r.SelfTradeCancelledOrderIDs = d.strings()
+	if len(r.Trades) == 0 {
+		r.Trades = nil
+	}
+	if len(r.SelfTradeCancelledOrderIDs) == 0 {
+		r.SelfTradeCancelledOrderIDs = nil
+	}
+	return r
+}
+
+func (e *snapshotEncoder) putRiskLimits(limits map[string]RiskLimits) {
+	e.putUint(uint64(len(limits)))
+	for _, key := range sortedKeys(limits) {
+		l := limits[key]
+		e.putString(key)
+		e.putInt(l.MaxOrderQuantity)
+		e.putInt(l.MaxNotional)
+		e.putInt(l.PriceCollarBps)
+		e.putInt(l.MaxOpenOrders)
+		e.putInt(l.MaxPosition)
+	}
+}
+
+func (d *snapshotDecoder) riskLimits() map[string]RiskLimits {
+	n := d.count()
+	limits := make(map[string]RiskLimits, n)
+	for i := 0; i < n; i++ {
+		key := d.string()
+		limits[key] = RiskLimits{
+			MaxOrderQuantity: d.int(),
+			MaxNotional:      d.int(),
+			PriceCollarBps:   d.int(),
+			MaxOpenOrders:    d.int(),
+			MaxPosition:      d.int(),
+		}
+	}
+	return limits
+}
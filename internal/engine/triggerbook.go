@@ -0,0 +1,154 @@
+package engine
+
+import "sort"
+
+// TriggerBook holds stop orders for a symbol until the last trade price
+// reaches their stop price. These orders are not visible in Bids/Asks.
+type TriggerBook struct {
+	// Buy stops sorted by stop price (low to high), then time
+	BuyStops []*Order
+
+	// Sell stops sorted by stop price (high to low), then time
+	SellStops []*Order
+
+	// Arrival counter used to activate orders in a deterministic order
+	nextSeq uint64
+
+	// Number of trailing stops, so books without any skip the update
+	trailing int
+}
+
+// NewTriggerBook creates an empty trigger book
+func NewTriggerBook() *TriggerBook {
+	return &TriggerBook{
+		BuyStops:  make([]*Order, 0),
+		SellStops: make([]*Order, 0),
+	}
+}
+
+// Add parks a stop order until it is triggered
+func (tb *TriggerBook) Add(order *Order) {
+	tb.nextSeq++
+	order.stopSeq = tb.nextSeq
+	if order.Type == TRAILING_STOP {
+		tb.trailing++
+	}
+
+	if order.Side == BUY {
+		tb.BuyStops = append(tb.BuyStops, order)
+		tb.sortBuyStops()
+	} else {
+		tb.SellStops = append(tb.SellStops, order)
+		tb.sortSellStops()
+	}
+}
+
+// sortBuyStops orders buy stops low to high. The stable sort keeps arrival
+// order among equal stop prices.
+func (tb *TriggerBook) sortBuyStops() {
+	sort.SliceStable(tb.BuyStops, func(i, j int) bool {
+		return tb.BuyStops[i].StopPrice < tb.BuyStops[j].StopPrice
+	})
+}
+
+// sortSellStops orders sell stops high to low
+func (tb *TriggerBook) sortSellStops() {
+	sort.SliceStable(tb.SellStops, func(i, j int) bool {
+		return tb.SellStops[i].StopPrice > tb.SellStops[j].StopPrice
+	})
+}
+
+// UpdateTrailing moves trailing stops after a trade at price. Stop prices
+// only ever move in the order's favour: down for buys, up for sells.
+func (tb *TriggerBook) UpdateTrailing(price int64) {
+	if tb.trailing == 0 {
+		return
+	}
+
+	moved := false
+	for _, o := range tb.BuyStops {
+		if o.Type != TRAILING_STOP {
+			continue
+		}
+		if stop := o.trailingStopPrice(price); o.StopPrice == 0 || stop < o.StopPrice {
+			o.StopPrice = stop
+			moved = true
+		}
+	}
+	if moved {
+		tb.sortBuyStops()
+	}
+
+	moved = false
+	for _, o := range tb.SellStops {
+		if o.Type != TRAILING_STOP {
+			continue
+		}
+		if stop := o.trailingStopPrice(price); stop > o.StopPrice {
+			o.StopPrice = stop
+			moved = true
+		}
+	}
+	if moved {
+		tb.sortSellStops()
+	}
+}
+
+// Remove takes a pending stop order out of the trigger book
+func (tb *TriggerBook) Remove(order *Order) bool {
+	stops := &tb.SellStops
+	if order.Side == BUY {
+		stops = &tb.BuyStops
+	}
+
+	for i, o := range *stops {
+		if o.ID == order.ID {
+			*stops = append((*stops)[:i], (*stops)[i+1:]...)
+			if order.Type == TRAILING_STOP {
+				tb.trailing--
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of pending stop orders
+func (tb *TriggerBook) Len() int {
+	return len(tb.BuyStops) + len(tb.SellStops)
+}
+
+// PopTriggered removes and returns every stop order triggered by the given
+// last trade price, in the order they arrived. Buy stops trigger when the
+// price trades at or above their stop price, sell stops at or below.
+func (tb *TriggerBook) PopTriggered(lastPrice int64) []*Order {
+	triggered := []*Order{}
+
+	// Buy stops are sorted low to high, so triggered ones are a prefix
+	n := 0
+	for n < len(tb.BuyStops) && tb.BuyStops[n].stopReached(lastPrice) {
+		n++
+	}
+	triggered = append(triggered, tb.BuyStops[:n]...)
+	tb.BuyStops = append([]*Order{}, tb.BuyStops[n:]...)
+
+	// Sell stops are sorted high to low, so triggered ones are a prefix
+	n = 0
+	for n < len(tb.SellStops) && tb.SellStops[n].stopReached(lastPrice) {
+		n++
+	}
+	triggered = append(triggered, tb.SellStops[:n]...)
+	tb.SellStops = append([]*Order{}, tb.SellStops[n:]...)
+
+	sort.Slice(triggered, func(i, j int) bool {
+		return triggered[i].stopSeq < triggered[j].stopSeq
+	})
+
+	for _, o := range triggered {
+		if o.Type == TRAILING_STOP {
+			tb.trailing--
+		}
+	}
+
+	return triggered
+}
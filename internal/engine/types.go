@@ -1,6 +1,14 @@
 package engine
 
-// import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// JSONVersion is the version of the order and trade JSON, sent with each
+// as "version". Version 2 added nanosecond timestamps as "timestamp_ns";
+// "timestamp" keeps its version 1 meaning of Unix milliseconds.
+const JSONVersion = 2
 
 // OrderSide represents buy or sell
 type OrderSide string
@@ -14,10 +22,47 @@ const (
 type OrderType string
 
 const (
-	LIMIT  OrderType = "LIMIT"
-	MARKET OrderType = "MARKET"
+	LIMIT      OrderType = "LIMIT"
+	MARKET     OrderType = "MARKET"
+	STOP       OrderType = "STOP"       // trades as a MARKET order once triggered
+	STOP_LIMIT OrderType = "STOP_LIMIT" // trades as a LIMIT order once triggered
+
+	// TRAILING_STOP is a stop whose stop price follows the market by a
+	// fixed amount or a percentage; trades as a MARKET order once triggered
+	TRAILING_STOP OrderType = "TRAILING_STOP"
+)
+
+// TimeInForce controls how long an order remains working
+type TimeInForce string
+
+const (
+	GTC TimeInForce = "GTC" // Good-till-cancel: unfilled remainder rests in the book
+	IOC TimeInForce = "IOC" // Immediate-or-cancel: unfilled remainder is cancelled
+	FOK TimeInForce = "FOK" // Fill-or-kill: fills completely at once or not at all
+	GTD TimeInForce = "GTD" // Good-till-date: rests until ExpireAt
+	DAY TimeInForce = "DAY" // Rests until the end of the current UTC day
 )
 
+// SelfTradePrevention decides what happens when an incoming order would
+// trade against a resting order from the same account
+type SelfTradePrevention string
+
+const (
+	STP_CANCEL_NEWEST        SelfTradePrevention = "CANCEL_NEWEST"        // cancel the incoming order's remainder
+	STP_CANCEL_OLDEST        SelfTradePrevention = "CANCEL_OLDEST"        // cancel the resting order
+	STP_CANCEL_BOTH          SelfTradePrevention = "CANCEL_BOTH"          // cancel both orders
+	STP_DECREMENT_AND_CANCEL SelfTradePrevention = "DECREMENT_AND_CANCEL" // reduce both by the overlap, cancel whichever reaches zero
+)
+
+// valid reports whether the mode is one the engine supports
+func (m SelfTradePrevention) valid() bool {
+	switch m {
+	case STP_CANCEL_NEWEST, STP_CANCEL_OLDEST, STP_CANCEL_BOTH, STP_DECREMENT_AND_CANCEL:
+		return true
+	}
+	return false
+}
+
 // OrderStatus represents order state
 type OrderStatus string
 
@@ -26,33 +71,217 @@ const (
 	PARTIAL_FILL OrderStatus = "PARTIAL_FILL"
 	FILLED       OrderStatus = "FILLED"
 	CANCELLED    OrderStatus = "CANCELLED"
+	KILLED       OrderStatus = "KILLED" // FOK order that could not be filled in full
+	REJECTED     OrderStatus = "REJECTED"
+	EXPIRED      OrderStatus = "EXPIRED" // GTD/DAY order removed at its expiry time
+)
+
+// RejectReason explains why an otherwise valid order was rejected
+type RejectReason string
+
+const (
+	REJECT_POST_ONLY_WOULD_CROSS RejectReason = "POST_ONLY_WOULD_CROSS"
+
+	// Pre-trade risk checks
+	REJECT_MAX_ORDER_QUANTITY RejectReason = "MAX_ORDER_QUANTITY_EXCEEDED"
+	REJECT_MAX_NOTIONAL       RejectReason = "MAX_NOTIONAL_EXCEEDED"
+	REJECT_PRICE_COLLAR       RejectReason = "PRICE_OUTSIDE_COLLAR"
+	REJECT_MAX_OPEN_ORDERS    RejectReason = "MAX_OPEN_ORDERS_EXCEEDED"
+	REJECT_MAX_POSITION       RejectReason = "MAX_POSITION_EXCEEDED"
+
+	// Ledger
+	REJECT_INSUFFICIENT_FUNDS RejectReason = "INSUFFICIENT_FUNDS"
+)
+
+// CancelReason explains why the engine cancelled some or all of an order
+type CancelReason string
+
+const (
+	CANCEL_SELF_TRADE CancelReason = "SELF_TRADE_PREVENTION"
 )
 
 // Order represents a single order
 type Order struct {
-	ID             string      `json:"order_id"`
-	Symbol         string      `json:"symbol"`
-	Side           OrderSide   `json:"side"`
-	Type           OrderType   `json:"type"`
-	Price          int64       `json:"price"`           // in cents
-	Quantity       int64       `json:"quantity"`
-	FilledQuantity int64       `json:"filled_quantity"`
-	Status         OrderStatus `json:"status"`
-	Timestamp      int64       `json:"timestamp"` // Unix milliseconds
+	ID                  string              `json:"order_id"`
+	ClientOrderID       string              `json:"client_order_id,omitempty"`
+	AccountID           string              `json:"account_id,omitempty"`
+	Symbol              string              `json:"symbol"`
+	Side                OrderSide           `json:"side"`
+	Type                OrderType           `json:"type"`
+	TimeInForce         TimeInForce         `json:"time_in_force"`
+	PostOnly            bool                `json:"post_only,omitempty"`
+	RepriceOnCross      bool                `json:"reprice_on_cross,omitempty"` // post-only: reprice behind the touch instead of rejecting
+	SelfTradePrevention SelfTradePrevention `json:"self_trade_prevention,omitempty"`
+	Price               int64               `json:"price"`                  // in cents
+	StopPrice           int64               `json:"stop_price,omitempty"`   // in cents, stop orders only
+	Triggered           bool                `json:"triggered,omitempty"`    // stop order has been activated
+	TrailAmount         int64               `json:"trail_amount,omitempty"` // in cents, trailing stops only
+	TrailBps            int64               `json:"trail_bps,omitempty"`    // in basis points, trailing stops only
+	Quantity            int64               `json:"quantity"`
+	FilledQuantity      int64               `json:"filled_quantity"`
+	DisplayQuantity     int64               `json:"display_quantity,omitempty"` // iceberg slice size, 0 shows everything
+	Status              OrderStatus         `json:"status"`
+	RejectReason        RejectReason        `json:"reject_reason,omitempty"`
+	CancelReason        CancelReason        `json:"cancel_reason,omitempty"`
+	ExpireAt            int64               `json:"expire_at,omitempty"` // Unix milliseconds, GTD/DAY only
+	Timestamp           int64               `json:"timestamp_ns"`        // Unix nanoseconds
+
+	stopSeq            uint64   // arrival order in the trigger book
+	displayRemaining   int64    // unfilled part of the current iceberg slice
+	selfTradeQty       int64    // quantity removed from this incoming order by self-trade prevention
+	selfTradeCancelled []string // resting orders cancelled by self-trade prevention against this order
+
+	// Position in the price level queue while resting in the book
+	level      *PriceLevel
+	prev, next *Order
+}
+
+// MarshalJSON adds the version and the version 1 timestamp
+func (o Order) MarshalJSON() ([]byte, error) {
+	type order Order // without this method
+	return json.Marshal(struct {
+		order
+		TimestampMs int64 `json:"timestamp"`
+		Version     int   `json:"version"`
+	}{order(o), o.Timestamp / int64(time.Millisecond), JSONVersion})
+}
+
+// canTake reports whether an incoming order still has quantity to match
+func (o *Order) canTake() bool {
+	return o.FilledQuantity < o.Quantity && o.CancelReason == ""
+}
+
+// restsInBook reports whether an unfilled remainder should rest in the book
+func (o *Order) restsInBook() bool {
+	tif := o.executionTimeInForce()
+	return tif != IOC && tif != FOK
+}
+
+// isLive reports whether the order can still trade
+func (o *Order) isLive() bool {
+	return o.Status == ACCEPTED || o.Status == PARTIAL_FILL
+}
+
+// visibleQuantity returns how much of the order is shown in the book and
+// can trade before an iceberg has to replenish
+func (o *Order) visibleQuantity() int64 {
+	remaining := o.Quantity - o.FilledQuantity
+	if o.DisplayQuantity > 0 && o.displayRemaining < remaining {
+		return o.displayRemaining
+	}
+	return remaining
+}
+
+// replenishDisplay shows the next iceberg slice from the hidden reserve
+func (o *Order) replenishDisplay() {
+	o.displayRemaining = min(o.DisplayQuantity, o.Quantity-o.FilledQuantity)
+}
+
+// stopReached reports whether a trade at lastPrice triggers this stop order.
+// Buy stops trigger at or above their stop price, sell stops at or below.
+func (o *Order) stopReached(lastPrice int64) bool {
+	if lastPrice <= 0 || o.StopPrice <= 0 {
+		// Nothing has traded yet, or a trailing stop with no reference price
+		return false
+	}
+	if o.Side == BUY {
+		return lastPrice >= o.StopPrice
+	}
+	return lastPrice <= o.StopPrice
+}
+
+// isPendingStop reports whether the order is waiting in the trigger book
+func (o *Order) isPendingStop() bool {
+	return (o.Type == STOP || o.Type == STOP_LIMIT || o.Type == TRAILING_STOP) && !o.Triggered
+}
+
+// executionType returns how the order matches: triggered stops trade as
+// market orders and triggered stop-limits as limit orders, while keeping
+// their own type
+func (o *Order) executionType() OrderType {
+	switch {
+	case !o.Triggered:
+		return o.Type
+	case o.Type == STOP || o.Type == TRAILING_STOP:
+		return MARKET
+	case o.Type == STOP_LIMIT:
+		return LIMIT
+	}
+	return o.Type
+}
+
+// executionTimeInForce returns the time in force the order matches with. A
+// triggered stop trading as a market order takes whatever liquidity is
+// there and cancels the rest, unless it was sent fill-or-kill; its own
+// TimeInForce is left as sent.
+func (o *Order) executionTimeInForce() TimeInForce {
+	if o.Triggered && o.executionType() == MARKET && o.TimeInForce != FOK {
+		return IOC
+	}
+	return o.TimeInForce
+}
+
+// trailingStopPrice returns the stop price of a trailing stop when the
+// market is at price: above it for buys, below it for sells
+func (o *Order) trailingStopPrice(price int64) int64 {
+	offset := o.TrailAmount
+	if o.TrailBps > 0 {
+		offset = price * o.TrailBps / 10000
+	}
+
+	if o.Side == BUY {
+		return price + offset
+	}
+	return price - offset
 }
 
 // Trade represents an executed trade
 type Trade struct {
 	ID        string `json:"trade_id"`
+	Symbol    string `json:"symbol"`
+	Sequence  uint64 `json:"sequence"` // per symbol, starting at 1
 	Price     int64  `json:"price"`
 	Quantity  int64  `json:"quantity"`
-	Timestamp int64  `json:"timestamp"`
-	BuyerID   string `json:"buyer_id"`
-	SellerID  string `json:"seller_id"`
+	Timestamp int64  `json:"timestamp_ns"` // Unix nanoseconds
+	BuyerID   string `json:"buyer_id"`     // buy order ID
+	SellerID  string `json:"seller_id"`    // sell order ID
+
+	BuyerAccountID  string `json:"buyer_account_id,omitempty"`
+	SellerAccountID string `json:"seller_account_id,omitempty"`
+
+	// The aggressor is the incoming order that crossed the book (the
+	// taker); the maker order was resting
+	AggressorSide OrderSide `json:"aggressor_side"`
+	MakerOrderID  string    `json:"maker_order_id"`
+	TakerOrderID  string    `json:"taker_order_id"`
+
+	// Fees are in cents; a negative maker fee is a rebate
+	MakerSide OrderSide `json:"maker_side"`
+	TakerSide OrderSide `json:"taker_side"`
+	MakerFee  int64     `json:"maker_fee"`
+	TakerFee  int64     `json:"taker_fee"`
+}
+
+// MarshalJSON adds the version and the version 1 timestamp
+func (t Trade) MarshalJSON() ([]byte, error) {
+	type trade Trade // without this method
+	return json.Marshal(struct {
+		trade
+		TimestampMs int64 `json:"timestamp"`
+		Version     int   `json:"version"`
+	}{trade(t), t.Timestamp / int64(time.Millisecond), JSONVersion})
 }
 
-// PriceLevel represents all orders at a specific price
+// PriceLevel represents all orders at a specific price, queued in time
+// order. Orders are linked to each other directly, so one can leave from
+// anywhere in the queue in O(1).
 type PriceLevel struct {
-	Price  int64
-	Orders []*Order
-}
\ No newline at end of file
+	Price int64
+
+	// Aggregates over the queue, kept up to date on every change
+	TotalQuantity   int64 // remaining quantity, including hidden iceberg reserve
+	VisibleQuantity int64 // quantity shown in the book
+	OrderCount      int
+
+	head, tail *Order
+}
@@ -0,0 +1,525 @@
+// Package journal implements an append-only, checksummed write-ahead log
+// split into segment files.
+package journal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by operations on a closed journal
+var ErrClosed = errors.New("journal is closed")
+
+// SyncPolicy controls when appended records are flushed to stable storage
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs each record before Append returns
+	SyncAlways SyncPolicy = "always"
+
+	// SyncBatch fsyncs when a caller waits in Sync, covering every record
+	// appended so far, so concurrent callers share one fsync
+	SyncBatch SyncPolicy = "batch"
+
+	// SyncInterval fsyncs on a timer. Sync only hands records to the
+	// operating system, so an OS crash can lose up to one interval of
+	// records; a process crash loses none.
+	SyncInterval SyncPolicy = "interval"
+)
+
+const (
+	DefaultSyncInterval = 100 * time.Millisecond
+	DefaultSegmentSize  = 64 << 20
+
+	segmentExt = ".wal"
+)
+
+// Options configures a journal
+type Options struct {
+	Dir         string
+	Sync        SyncPolicy    // defaults to SyncBatch
+	Interval    time.Duration // fsync period for SyncInterval
+	SegmentSize int64         // size at which a new segment file is started
+}
+
+// ParseSyncPolicy converts a string to a SyncPolicy
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(strings.ToLower(s)); policy {
+	case SyncAlways, SyncBatch, SyncInterval:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid sync policy: %s", s)
+}
+
+// segment is one file of the journal, named after the sequence number of
+// its first record
+type segment struct {
+	firstSeq uint64
+	path     string
+}
+
+// Journal is an append-only log of records numbered from 1. Records are
+// written to the newest segment; once it reaches the segment size a new one
+// is started. It is safe for concurrent use.
+type Journal struct {
+	opts Options
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when a sync finishes
+	segments []segment
+	file     *os.File // newest segment
+	buf      *bufio.Writer
+	size     int64  // bytes in the newest segment, including buffered ones
+	lastSeq  uint64 // last record appended
+	synced   uint64 // last record known to be durable
+	syncing  bool   // an fsync is in flight outside mu
+	err      error  // first write or sync error; the journal is unusable after it
+	closed   bool
+
+	truncated int64 // bytes dropped from a damaged tail on open
+
+	stop chan struct{} // closed to stop the interval flusher
+	done chan struct{} // closed once the interval flusher has exited
+}
+
+// Open opens the journal in opts.Dir, creating it if needed. Every segment
+// is checked. A torn or corrupted record at the end of the newest segment,
+// as left by a crash mid-write, is cut off along with anything after it;
+// Truncated reports how many bytes were dropped. Damage anywhere else is an
+// error, as records after it could not be trusted.
+func Open(opts Options) (*Journal, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("journal directory is required")
+	}
+	if opts.Sync == "" {
+		opts.Sync = SyncBatch
+	}
+	if _, err := ParseSyncPolicy(string(opts.Sync)); err != nil {
+		return nil, err
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{opts: opts, segments: segments}
+	j.cond = sync.NewCond(&j.mu)
+
+	if err := j.recover(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		j.stop = make(chan struct{})
+		j.done = make(chan struct{})
+		go j.flushLoop()
+	}
+	return j, nil
+}
+
+// listSegments returns the segment files in dir, oldest first
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil || firstSeq == 0 {
+			return nil, fmt.Errorf("unexpected file in journal directory: %s", name)
+		}
+		segments = append(segments, segment{firstSeq: firstSeq, path: filepath.Join(dir, name)})
+	}
+
+	sort.Slice(segments, func(a, b int) bool {
+		return segments[a].firstSeq < segments[b].firstSeq
+	})
+	return segments, nil
+}
+
+// recover validates the segments, trims a damaged tail and opens the newest
+// segment for appending
+func (j *Journal) recover() error {
+	if len(j.segments) == 0 {
+		return j.startSegment(1)
+	}
+
+	for i, seg := range j.segments {
+		if i > 0 && seg.firstSeq != j.lastSeq+1 {
+			return fmt.Errorf("journal segment %s starts at %d, expected %d", filepath.Base(seg.path), seg.firstSeq, j.lastSeq+1)
+		}
+
+		valid, lastSeq, err := scanSegment(seg.path, seg.firstSeq, nil)
+		j.lastSeq = lastSeq
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errBadRecord) || i < len(j.segments)-1 {
+			return fmt.Errorf("journal segment %s: %w", filepath.Base(seg.path), err)
+		}
+
+		// Damaged tail: keep the valid prefix
+		info, statErr := os.Stat(seg.path)
+		if statErr != nil {
+			return statErr
+		}
+		if err := os.Truncate(seg.path, valid); err != nil {
+			return err
+		}
+		j.truncated = info.Size() - valid
+	}
+
+	tail := j.segments[len(j.segments)-1]
+	f, err := os.OpenFile(tail.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	j.file = f
+	j.buf = bufio.NewWriterSize(f, 1<<16)
+	j.size = info.Size()
+	j.synced = j.lastSeq
+	return nil
+}
+
+// startSegment creates a new segment whose first record will be firstSeq and
+// makes it the one appended to. The caller holds mu, or is Open.
+func (j *Journal) startSegment(firstSeq uint64) error {
+	path := filepath.Join(j.opts.Dir, fmt.Sprintf("%020d%s", firstSeq, segmentExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(j.opts.Dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.segments = append(j.segments, segment{firstSeq: firstSeq, path: path})
+	j.file = f
+	j.buf = bufio.NewWriterSize(f, 1<<16)
+	j.size = 0
+	return nil
+}
+
+// syncDir makes a file created in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Append writes data as the next record and returns its sequence number.
+// The record is durable once Sync returns for it, or at once under
+// SyncAlways.
+func (j *Journal) Append(data []byte) (uint64, error) {
+	if len(data) > maxRecordSize-seqSize {
+		return 0, fmt.Errorf("journal record of %d bytes is too large", len(data))
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var record []byte
+	for {
+		if err := j.usable(); err != nil {
+			return 0, err
+		}
+		record = encodeRecord(j.lastSeq+1, data)
+		if j.size == 0 || j.size+int64(len(record)) <= j.opts.SegmentSize {
+			break
+		}
+		if j.syncing {
+			// The segment is being fsynced outside mu. Other appends can
+			// get in while this waits, so look again afterwards.
+			j.cond.Wait()
+			continue
+		}
+		if err := j.rollover(); err != nil {
+			return 0, j.fail(err)
+		}
+	}
+
+	if _, err := j.buf.Write(record); err != nil {
+		return 0, j.fail(err)
+	}
+	j.size += int64(len(record))
+	j.lastSeq++
+
+	if j.opts.Sync == SyncAlways {
+		if err := j.buf.Flush(); err != nil {
+			return 0, j.fail(err)
+		}
+		if err := j.file.Sync(); err != nil {
+			return 0, j.fail(err)
+		}
+		j.synced = j.lastSeq
+	}
+	return j.lastSeq, nil
+}
+
+// rollover makes the newest segment durable, closes it and starts the next.
+// The caller holds mu, with no fsync in flight.
+func (j *Journal) rollover() error {
+	if err := j.buf.Flush(); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	j.synced = j.lastSeq
+	return j.startSegment(j.lastSeq + 1)
+}
+
+// Sync waits until the record with sequence number seq is durable, as far as
+// the sync policy promises. Under SyncBatch, callers that arrive while an
+// fsync is in flight wait for it and then share the next one.
+func (j *Journal) Sync(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.opts.Sync == SyncInterval {
+		// Hand the record to the OS; the flusher makes it durable
+		if err := j.usable(); err != nil {
+			return err
+		}
+		if err := j.buf.Flush(); err != nil {
+			return j.fail(err)
+		}
+		return nil
+	}
+	return j.syncTo(seq)
+}
+
+// Fsync waits until the record with sequence number seq is on stable
+// storage, whatever the sync policy
+func (j *Journal) Fsync(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.syncTo(seq)
+}
+
+// syncTo fsyncs until seq is durable. The fsync itself runs without mu so
+// appends can continue meanwhile. The caller holds mu.
+func (j *Journal) syncTo(seq uint64) error {
+	for {
+		if j.err != nil {
+			return j.err
+		}
+		if j.synced >= seq {
+			return nil
+		}
+		if j.closed {
+			return ErrClosed
+		}
+		if !j.syncing {
+			break
+		}
+		j.cond.Wait()
+	}
+
+	if err := j.buf.Flush(); err != nil {
+		return j.fail(err)
+	}
+	target, f := j.lastSeq, j.file
+	j.syncing = true
+
+	j.mu.Unlock()
+	err := f.Sync()
+	j.mu.Lock()
+
+	j.syncing = false
+	j.cond.Broadcast()
+	if err != nil {
+		return j.fail(err)
+	}
+	if target > j.synced {
+		j.synced = target
+	}
+	return nil
+}
+
+// flushLoop fsyncs the journal every interval under SyncInterval
+func (j *Journal) flushLoop() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.mu.Lock()
+			j.syncTo(j.lastSeq)
+			j.mu.Unlock()
+		}
+	}
+}
+
+// usable returns why the journal cannot take records, if it cannot. The
+// caller holds mu.
+func (j *Journal) usable() error {
+	if j.err != nil {
+		return j.err
+	}
+	if j.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// fail records the first write or sync error. The caller holds mu.
+func (j *Journal) fail(err error) error {
+	if j.err == nil {
+		j.err = fmt.Errorf("journal: %w", err)
+	}
+	return j.err
+}
+
+// LastSeq returns the sequence number of the last record appended
+func (j *Journal) LastSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastSeq
+}
+
+// Truncated returns the number of bytes cut off a damaged tail by Open
+func (j *Journal) Truncated() int64 {
+	return j.truncated
+}
+
+// Replay calls fn for every record from sequence number from onwards, in
+// order. It reads what is on disk, so it should run before anything is
+// appended. It fails if records from that point on have been compacted
+// away.
+func (j *Journal) Replay(from uint64, fn func(seq uint64, data []byte) error) error {
+	j.mu.Lock()
+	segments := append([]segment(nil), j.segments...)
+	lastSeq := j.lastSeq
+	j.mu.Unlock()
+
+	if from == 0 {
+		from = 1
+	}
+	if from > lastSeq+1 {
+		return fmt.Errorf("journal ends at record %d, cannot replay from %d", lastSeq, from)
+	}
+	if first := segments[0].firstSeq; from < first {
+		return fmt.Errorf("journal starts at record %d, records from %d are missing", first, from)
+	}
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].firstSeq <= from {
+			continue // every record in this segment is before from
+		}
+		_, _, err := scanSegment(seg.path, seg.firstSeq, func(seq uint64, data []byte) error {
+			if seq < from {
+				return nil
+			}
+			return fn(seq, data)
+		})
+		if err != nil {
+			return fmt.Errorf("journal segment %s: %w", filepath.Base(seg.path), err)
+		}
+	}
+	return nil
+}
+
+// Compact deletes segments holding only records up to and including seq,
+// once a snapshot covers them. The newest segment is always kept.
+func (j *Journal) Compact(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.usable(); err != nil {
+		return err
+	}
+
+	removed := 0
+	for removed+1 < len(j.segments) && j.segments[removed+1].firstSeq-1 <= seq {
+		if err := os.Remove(j.segments[removed].path); err != nil {
+			j.segments = j.segments[removed:]
+			return err
+		}
+		removed++
+	}
+	if removed == 0 {
+		return nil
+	}
+	j.segments = j.segments[removed:]
+	return syncDir(j.opts.Dir)
+}
+
+// Close makes every appended record durable and closes the journal
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return nil
+	}
+	j.closed = true
+	j.mu.Unlock()
+
+	if j.stop != nil {
+		close(j.stop)
+		<-j.done
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.syncing {
+		j.cond.Wait()
+	}
+
+	err := j.err
+	if err == nil {
+		if err = j.buf.Flush(); err == nil {
+			err = j.file.Sync()
+		}
+	}
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
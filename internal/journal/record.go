@@ -0,0 +1,92 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Records are framed as
+//
+//	[length uint32][checksum uint32][sequence uint64][data]
+//
+// little endian, where length covers the sequence number and data, and the
+// checksum is CRC-32C over the same bytes.
+const (
+	headerSize = 8
+	seqSize    = 8
+
+	// maxRecordSize bounds a record's length so a corrupted length field is
+	// caught instead of being read as a huge allocation
+	maxRecordSize = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errBadRecord marks a record that is truncated, fails its checksum or is
+// out of sequence
+var errBadRecord = errors.New("bad record")
+
+// encodeRecord frames data as the record with sequence number seq
+func encodeRecord(seq uint64, data []byte) []byte {
+	buf := make([]byte, headerSize+seqSize+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(seqSize+len(data)))
+	binary.LittleEndian.PutUint64(buf[headerSize:], seq)
+	copy(buf[headerSize+seqSize:], data)
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(buf[headerSize:], crcTable))
+	return buf
+}
+
+// scanSegment reads the records in a segment file, expecting sequence
+// numbers to run on from firstSeq, and calls fn for each one if fn is not
+// nil. It returns the size of the valid prefix and the last sequence number
+// in it. A bad record stops the scan with an error wrapping errBadRecord.
+func scanSegment(path string, firstSeq uint64, fn func(seq uint64, data []byte) error) (valid int64, lastSeq uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	lastSeq = firstSeq - 1
+	header := make([]byte, headerSize)
+
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return valid, lastSeq, nil
+		} else if err != nil {
+			return valid, lastSeq, fmt.Errorf("%w at offset %d: truncated header", errBadRecord, valid)
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if length < seqSize || length > maxRecordSize {
+			return valid, lastSeq, fmt.Errorf("%w at offset %d: invalid length %d", errBadRecord, valid, length)
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return valid, lastSeq, fmt.Errorf("%w at offset %d: truncated body", errBadRecord, valid)
+		}
+		if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return valid, lastSeq, fmt.Errorf("%w at offset %d: checksum mismatch", errBadRecord, valid)
+		}
+
+		seq := binary.LittleEndian.Uint64(body[:seqSize])
+		if seq != lastSeq+1 {
+			return valid, lastSeq, fmt.Errorf("%w at offset %d: sequence %d, expected %d", errBadRecord, valid, seq, lastSeq+1)
+		}
+
+		if fn != nil {
+			if err := fn(seq, body[seqSize:]); err != nil {
+				return valid, lastSeq, err
+			}
+		}
+		valid += int64(headerSize + length)
+		lastSeq = seq
+	}
+}
@@ -0,0 +1,130 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"order-matching-engine/internal/engine"
+	"order-matching-engine/internal/journal"
+)
+
+// countCheckInterval is how often Start checks the command count trigger
+const countCheckInterval = 100 * time.Millisecond
+
+// Snapshotter takes snapshots of an engine logging to a journal, and
+// compacts the journal once snapshots cover it
+type Snapshotter struct {
+	store   *Store
+	engine  *engine.MatchingEngine
+	journal *journal.Journal
+
+	mu      sync.Mutex    // one snapshot at a time
+	lastSeq atomic.Uint64 // covered by the newest snapshot
+}
+
+// NewSnapshotter creates a snapshotter for an engine that logs to j
+func NewSnapshotter(store *Store, me *engine.MatchingEngine, j *journal.Journal) (*Snapshotter, error) {
+	s := &Snapshotter{store: store, engine: me, journal: j}
+
+	seqs, err := store.Sequences()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		s.lastSeq.Store(seqs[0])
+	}
+	return s, nil
+}
+
+// Snapshot takes a snapshot now and returns the journal sequence number it
+// covers. Journal segments no kept snapshot needs are then deleted.
+func (s *Snapshotter) Snapshot() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, err := s.store.Save(func(w io.Writer) (uint64, error) {
+		seq, err := s.engine.WriteSnapshot(w)
+		if err != nil {
+			return 0, err
+		}
+		// A snapshot must never be ahead of the journal on disk
+		return seq, s.journal.Fsync(seq)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.lastSeq.Store(seq)
+
+	// Keep the journal back to the oldest snapshot kept, so it can still be
+	// used if a newer one is damaged
+	seqs, err := s.store.Sequences()
+	if err != nil {
+		return seq, err
+	}
+	if err := s.journal.Compact(seqs[len(seqs)-1]); err != nil {
+		return seq, fmt.Errorf("compact journal: %w", err)
+	}
+	return seq, nil
+}
+
+// Start takes a snapshot every interval, and whenever every commands have
+// been logged since the last one. A zero interval or count turns that
+// trigger off. Call the returned function to stop.
+func (s *Snapshotter) Start(interval time.Duration, every uint64) (stop func()) {
+	var tickers []*time.Ticker
+	var timer, check <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		tickers = append(tickers, ticker)
+		timer = ticker.C
+	}
+	if every > 0 {
+		ticker := time.NewTicker(countCheckInterval)
+		tickers = append(tickers, ticker)
+		check = ticker.C
+	}
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-timer:
+			case <-check:
+				if s.journal.LastSeq()-s.lastSeq.Load() < every {
+					continue
+				}
+			case <-done:
+				for _, ticker := range tickers {
+					ticker.Stop()
+				}
+				return
+			}
+
+			if _, err := s.Snapshot(); err != nil {
+				log.Println("Snapshot failed:", err)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Recover rebuilds a new engine from the newest usable snapshot in store and
+// the journal records after it. It returns the sequence number of the
+// snapshot used, 0 if there was none, and how many records were replayed.
+func Recover(store *Store, me *engine.MatchingEngine, j *journal.Journal) (snapshotSeq uint64, replayed int, err error) {
+	snapshotSeq, err = store.Load(me.LoadSnapshot)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = j.Replay(snapshotSeq+1, func(seq uint64, data []byte) error {
+		replayed++
+		return me.Replay(seq, data)
+	})
+	return snapshotSeq, replayed, err
+}
@@ -0,0 +1,177 @@
+// Package snapshot stores engine snapshots on disk, takes them on a schedule
+// and recovers an engine from the latest one plus the journal tail.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotExt = ".snap"
+	tempPrefix  = "tmp-"
+
+	// DefaultKeep is how many snapshots are kept. Older ones still on disk
+	// are a fallback if the newest turns out to be damaged.
+	DefaultKeep = 2
+)
+
+// Store keeps snapshot files in a directory, each named after the journal
+// sequence number it covers. It is not safe for concurrent use.
+type Store struct {
+	dir  string
+	keep int
+}
+
+// OpenStore opens the snapshot directory dir, creating it if needed and
+// removing files left by a snapshot that was interrupted. keep is how many
+// snapshots to retain; values below 1 mean DefaultKeep.
+func OpenStore(dir string, keep int) (*Store, error) {
+	if keep < 1 {
+		keep = DefaultKeep
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	temps, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range temps {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir: dir, keep: keep}, nil
+}
+
+// Sequences returns the sequence numbers of the stored snapshots, newest
+// first
+func (s *Store) Sequences() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, snapshotExt), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file in snapshot directory: %s", name)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] > seqs[j]
+	})
+	return seqs, nil
+}
+
+// path returns the file name of the snapshot covering seq
+func (s *Store) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, snapshotExt))
+}
+
+// Save writes a new snapshot with write, which returns the sequence number
+// it covers. The file only appears under its final name once it is
+// complete and durable. Snapshots beyond the number kept are deleted.
+func (s *Store) Save(write func(w io.Writer) (uint64, error)) (uint64, error) {
+	f, err := os.CreateTemp(s.dir, tempPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	seq, err := write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(f.Name(), s.path(seq)); err != nil {
+		return 0, err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return 0, err
+	}
+	return seq, s.prune()
+}
+
+// prune deletes all but the newest snapshots
+func (s *Store) prune() error {
+	seqs, err := s.Sequences()
+	if err != nil {
+		return err
+	}
+	for len(seqs) > s.keep {
+		if err := os.Remove(s.path(seqs[len(seqs)-1])); err != nil {
+			return err
+		}
+		seqs = seqs[:len(seqs)-1]
+	}
+	return nil
+}
+
+// Load calls load with the newest snapshot, falling back to older ones if
+// it fails. It returns the sequence number load reported, or 0 if there are
+// no snapshots. load must leave its target untouched when it fails.
+func (s *Store) Load(load func(r io.Reader) (uint64, error)) (uint64, error) {
+	seqs, err := s.Sequences()
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for _, seq := range seqs {
+		loaded, err := s.loadFile(seq, load)
+		if err == nil {
+			return loaded, nil
+		}
+		errs = append(errs, fmt.Errorf("snapshot %d: %w", seq, err))
+	}
+	return 0, errors.Join(errs...)
+}
+
+func (s *Store) loadFile(seq uint64, load func(r io.Reader) (uint64, error)) (uint64, error) {
+	f, err := os.Open(s.path(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	loaded, err := load(f)
+	if err != nil {
+		return 0, err
+	}
+	if loaded != seq {
+		return 0, fmt.Errorf("file holds sequence number %d", loaded)
+	}
+	return loaded, nil
+}
+
+// syncDir makes a file renamed into dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
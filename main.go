@@ -1,16 +1,82 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"order-matching-engine/internal/api"
+	"order-matching-engine/internal/engine"
+	"order-matching-engine/internal/journal"
+	"order-matching-engine/internal/snapshot"
+	"path/filepath"
+	"time"
 )
 
 func main() {
+	ledger := flag.Bool("ledger", false, "require orders to be backed by account balances")
+	queueDepth := flag.Int("queue-depth", engine.DefaultQueueDepth, "commands queued per symbol before requests are refused")
+	nodeID := flag.Int64("node-id", 0, fmt.Sprintf("node number in generated order and trade IDs, 0 to %d", engine.MaxSnowflakeNode))
+	journalDir := flag.String("journal-dir", "", "directory for the command journal; empty disables persistence")
+	journalSync := flag.String("journal-sync", string(journal.SyncBatch), "when the journal is fsynced: always, batch or interval")
+	journalInterval := flag.Duration("journal-sync-interval", journal.DefaultSyncInterval, "fsync period for -journal-sync=interval")
+	snapshotDir := flag.String("snapshot-dir", "", "directory for snapshots (default <journal-dir>/snapshots)")
+	snapshotInterval := flag.Duration("snapshot-interval", 10*time.Minute, "time between snapshots; 0 disables")
+	snapshotEvery := flag.Uint64("snapshot-every", 100000, "commands between snapshots; 0 disables")
+	flag.Parse()
+
 	fmt.Println("🚀 Starting Order Matching Engine...")
 
 	// Create server
-	server := api.NewServer()
+	ids, err := engine.NewSnowflakeIDGenerator(*nodeID, engine.SystemClock{})
+	if err != nil {
+		log.Fatal("Invalid -node-id:", err)
+	}
+	opts := []engine.Option{engine.WithQueueDepth(*queueDepth), engine.WithIDGenerator(ids)}
+	if *ledger {
+		opts = append(opts, engine.WithLedger())
+	}
+
+	var j *journal.Journal
+	if *journalDir != "" {
+		policy, err := journal.ParseSyncPolicy(*journalSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		j, err = journal.Open(journal.Options{Dir: *journalDir, Sync: policy, Interval: *journalInterval})
+		if err != nil {
+			log.Fatal("Failed to open journal:", err)
+		}
+		if n := j.Truncated(); n > 0 {
+			fmt.Printf("⚠️  Dropped %d bytes of incomplete records from the end of the journal\n", n)
+		}
+		opts = append(opts, engine.WithCommandLog(j))
+	}
+	server := api.NewServer(opts...)
+
+	// Rebuild state from the latest snapshot and the journal before taking
+	// requests
+	stopSnapshots := func() {}
+	if j != nil {
+		if *snapshotDir == "" {
+			*snapshotDir = filepath.Join(*journalDir, "snapshots")
+		}
+		store, err := snapshot.OpenStore(*snapshotDir, snapshot.DefaultKeep)
+		if err != nil {
+			log.Fatal("Failed to open snapshot directory:", err)
+		}
+		snapshotSeq, replayed, err := snapshot.Recover(store, server.Engine(), j)
+		if err != nil {
+			log.Fatal("Failed to recover:", err)
+		}
+		fmt.Printf("✅ Recovered from snapshot at %d and %d journal commands\n", snapshotSeq, replayed)
+
+		snapshotter, err := snapshot.NewSnapshotter(store, server.Engine(), j)
+		if err != nil {
+			log.Fatal("Failed to start snapshots:", err)
+		}
+		server.SetSnapshotter(snapshotter)
+		stopSnapshots = snapshotter.Start(*snapshotInterval, *snapshotEvery)
+	}
 
 	// Start server
 	port := "8081"
@@ -25,7 +91,12 @@ func main() {
 	fmt.Println()
 
 	// Start server (blocking call)
-	if err := server.Start(port); err != nil {
+	err = server.Start(port)
+	stopSnapshots()
+	if j != nil {
+		j.Close()
+	}
+	if err != nil {
 		log.Fatal("Server failed:", err)
 	}
-}
\ No newline at end of file
+}
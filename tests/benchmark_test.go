@@ -42,6 +42,162 @@ func BenchmarkConcurrentOrders(b *testing.B) {
 	})
 }
 
+// deepBookSizes are the number of price levels per side used by the deep
+// book benchmarks
+var deepBookSizes = []int{10000, 100000}
+
+// newDeepBook returns an engine whose AAPL book has levels bid levels below
+// 1,000,000 and levels ask levels above it, one order each
+func newDeepBook(levels int) *engine.MatchingEngine {
+	me := engine.NewMatchingEngine()
+	for i := 0; i < levels; i++ {
+		me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, int64(1000000-1-2*i), 100)
+		me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, int64(1000000+1+2*i), 100)
+	}
+	return me
+}
+
+// BenchmarkDeepBookInsertCancel adds a new price level in the middle of a
+// deep book and cancels it again
+func BenchmarkDeepBookInsertCancel(b *testing.B) {
+	for _, levels := range deepBookSizes {
+		b.Run(fmt.Sprintf("levels=%d", levels), func(b *testing.B) {
+			me := newDeepBook(levels)
+			rng := rand.New(rand.NewSource(1))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Even prices below the touch are free levels
+				price := int64(1000000 - 2*(1+rng.Intn(levels)))
+				result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, price, 100)
+				me.CancelOrder(result.OrderID)
+			}
+		})
+	}
+}
+
+// BenchmarkDeepBookBestPrice reads the touch of a deep book
+func BenchmarkDeepBookBestPrice(b *testing.B) {
+	for _, levels := range deepBookSizes {
+		b.Run(fmt.Sprintf("levels=%d", levels), func(b *testing.B) {
+			me := newDeepBook(levels)
+			book := me.GetOrCreateBook("AAPL")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				book.GetBestBid()
+				book.GetBestAsk()
+			}
+		})
+	}
+}
+
+// BenchmarkDeepBookSweep takes out the best ask level of a deep book and
+// puts it back
+func BenchmarkDeepBookSweep(b *testing.B) {
+	for _, levels := range deepBookSizes {
+		b.Run(fmt.Sprintf("levels=%d", levels), func(b *testing.B) {
+			me := newDeepBook(levels)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				me.SubmitOrder("AAPL", engine.BUY, engine.MARKET, 0, 100)
+				me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 1000001, 100)
+			}
+		})
+	}
+}
+
+// BenchmarkCancelDeepQueue cancels an order from the middle of a price
+// level holding 10,000 orders and queues a replacement at the back
+func BenchmarkCancelDeepQueue(b *testing.B) {
+	me := engine.NewMatchingEngine()
+	ids := make([]string, 10000)
+	for i := range ids {
+		result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+		ids[i] = result.OrderID
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := len(ids)/2 + i%(len(ids)/2)
+		me.CancelOrder(ids[j])
+		result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+		ids[j] = result.OrderID
+	}
+}
+
+// BenchmarkManySymbols looks up and cancels orders in an engine with 1,000
+// symbols. Each operation goes to the order's own book only, so the cost
+// does not grow with the number of symbols.
+func BenchmarkManySymbols(b *testing.B) {
+	me := engine.NewMatchingEngine()
+	symbols := make([]string, 1000)
+	ids := make([]string, len(symbols))
+	for i := range symbols {
+		symbols[i] = fmt.Sprintf("SYM%04d", i)
+		for j := 0; j < 10; j++ {
+			result, _ := me.SubmitOrder(symbols[i], engine.BUY, engine.LIMIT, int64(10000+j), 100)
+			ids[i] = result.OrderID
+		}
+	}
+
+	b.Run("GetOrder", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			me.GetOrder(ids[i%len(ids)])
+		}
+	})
+
+	b.Run("CancelAndResubmit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			k := i % len(ids)
+			me.CancelOrder(ids[k])
+			result, _ := me.SubmitOrder(symbols[k], engine.BUY, engine.LIMIT, 10009, 100)
+			ids[k] = result.OrderID
+		}
+	})
+}
+
+// BenchmarkSubmitAcrossSymbols submits crossing orders between two accounts
+// from every goroutine, on a symbol each goroutine has to itself and on
+// one symbol they all share. With fees and account tracking on, books on
+// their own symbols take no exclusive lock in common, so OwnSymbol should
+// keep scaling with -cpu while SharedSymbol is bound by its one book.
+func BenchmarkSubmitAcrossSymbols(b *testing.B) {
+	for _, shared := range []bool{false, true} {
+		name := "OwnSymbol"
+		if shared {
+			name = "SharedSymbol"
+		}
+		b.Run(name, func(b *testing.B) {
+			me := engine.NewMatchingEngine()
+			defer me.Close()
+			me.SetFeeSchedule(engine.FeeSchedule{MakerBps: -1, TakerBps: 5})
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := next.Add(1)
+				symbol := fmt.Sprintf("SYM%04d", n)
+				if shared {
+					symbol = "AAPL"
+				}
+				buyer, seller := fmt.Sprintf("buyer%d", n), fmt.Sprintf("seller%d", n)
+
+				i := 0
+				for pb.Next() {
+					req := engine.OrderRequest{AccountID: buyer, Symbol: symbol, Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 100}
+					if i%2 == 0 {
+						req.AccountID, req.Side = seller, engine.SELL
+					}
+					me.Submit(req)
+					i++
+				}
+			})
+		})
+	}
+}
+
 // TestThroughput measures sustained throughput
 func TestThroughput(t *testing.T) {
 	me := engine.NewMatchingEngine()
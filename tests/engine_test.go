@@ -216,4 +216,1023 @@ func TestPriceImprovement(t *testing.T) {
 	if buyResult.Trades[0].Price != 15000 {
 		t.Errorf("Expected trade at 15000, got %d", buyResult.Trades[0].Price)
 	}
-}
\ No newline at end of file
+}
+func TestIOCPartialFill(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15050, 50)
+
+	// IOC buy for 100 shares: 50 fill, 50 cancelled
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.BUY,
+		Type:        engine.LIMIT,
+		Price:       15050,
+		Quantity:    100,
+		TimeInForce: engine.IOC,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit IOC order: %v", err)
+	}
+
+	if result.Status != engine.PARTIAL_FILL {
+		t.Errorf("Expected PARTIAL_FILL, got %s", result.Status)
+	}
+	if result.FilledQuantity != 50 {
+		t.Errorf("Expected filled quantity 50, got %d", result.FilledQuantity)
+	}
+	if result.CancelledQuantity != 50 {
+		t.Errorf("Expected cancelled quantity 50, got %d", result.CancelledQuantity)
+	}
+
+	// Remainder must not rest in the book
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 0 {
+		t.Errorf("Expected no bids, got %d", len(book.Bids))
+	}
+}
+
+func TestIOCNoMatch(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15100, 100)
+
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.BUY,
+		Type:        engine.LIMIT,
+		Price:       15000,
+		Quantity:    100,
+		TimeInForce: engine.IOC,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit IOC order: %v", err)
+	}
+
+	if result.Status != engine.CANCELLED {
+		t.Errorf("Expected CANCELLED, got %s", result.Status)
+	}
+	if result.CancelledQuantity != 100 {
+		t.Errorf("Expected cancelled quantity 100, got %d", result.CancelledQuantity)
+	}
+}
+
+func TestFOKKilled(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// 100 shares at the limit, 100 more above it
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 100)
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15100, 100)
+
+	// FOK for 150 at 15000 cannot be filled within the limit
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.BUY,
+		Type:        engine.LIMIT,
+		Price:       15000,
+		Quantity:    150,
+		TimeInForce: engine.FOK,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit FOK order: %v", err)
+	}
+
+	if result.Status != engine.KILLED {
+		t.Errorf("Expected KILLED, got %s", result.Status)
+	}
+	if len(result.Trades) != 0 {
+		t.Errorf("Expected no trades, got %d", len(result.Trades))
+	}
+
+	// Book must be untouched
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Asks) != 2 || book.Asks[0].Quantity != 100 {
+		t.Error("FOK order must not modify the book when killed")
+	}
+}
+
+func TestFOKFilled(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 100)
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15050, 100)
+
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.BUY,
+		Type:        engine.LIMIT,
+		Price:       15050,
+		Quantity:    150,
+		TimeInForce: engine.FOK,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit FOK order: %v", err)
+	}
+
+	if result.Status != engine.FILLED {
+		t.Errorf("Expected FILLED, got %s", result.Status)
+	}
+	if len(result.Trades) != 2 {
+		t.Errorf("Expected 2 trades, got %d", len(result.Trades))
+	}
+}
+
+func TestPostOnlyRejected(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15050, 100)
+
+	// Post-only buy at the ask would take liquidity
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:   "AAPL",
+		Side:     engine.BUY,
+		Type:     engine.LIMIT,
+		Price:    15050,
+		Quantity: 100,
+		PostOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit post-only order: %v", err)
+	}
+
+	if result.Status != engine.REJECTED {
+		t.Errorf("Expected REJECTED, got %s", result.Status)
+	}
+	if result.RejectReason != engine.REJECT_POST_ONLY_WOULD_CROSS {
+		t.Errorf("Expected POST_ONLY_WOULD_CROSS, got %s", result.RejectReason)
+	}
+	if len(result.Trades) != 0 {
+		t.Errorf("Expected no trades, got %d", len(result.Trades))
+	}
+}
+
+func TestPostOnlyReprice(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+
+	// Post-only sell through the bid is repriced one tick above it
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:         "AAPL",
+		Side:           engine.SELL,
+		Type:           engine.LIMIT,
+		Price:          14900,
+		Quantity:       100,
+		PostOnly:       true,
+		RepriceOnCross: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit post-only order: %v", err)
+	}
+
+	if result.Status != engine.ACCEPTED {
+		t.Errorf("Expected ACCEPTED, got %s", result.Status)
+	}
+
+	order, err := me.GetOrder(result.OrderID)
+	if err != nil {
+		t.Fatalf("Repriced order should be in book: %v", err)
+	}
+	if order.Price != 15001 {
+		t.Errorf("Expected repriced to 15001, got %d", order.Price)
+	}
+}
+
+func TestStopOrderTrigger(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Sell stop below the market, not visible in the book
+	stop, err := me.Submit(engine.OrderRequest{
+		Symbol:    "AAPL",
+		Side:      engine.SELL,
+		Type:      engine.STOP,
+		StopPrice: 14900,
+		Quantity:  50,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit stop order: %v", err)
+	}
+	if stop.Status != engine.ACCEPTED {
+		t.Errorf("Expected ACCEPTED, got %s", stop.Status)
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Asks) != 0 {
+		t.Error("Stop order should not be visible in the book")
+	}
+
+	// Bids for the stop to hit once triggered
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 14800, 100)
+
+	// Trade at 14800 takes the price through the stop
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 14800, 10)
+
+	order, err := me.GetOrder(stop.OrderID)
+	if err != nil {
+		t.Fatalf("Triggered stop should still be queryable: %v", err)
+	}
+	if !order.Triggered || order.FilledQuantity != 50 || order.Type != engine.STOP {
+		t.Errorf("Expected STOP triggered and filled 50, got %s triggered=%v filled=%d", order.Type, order.Triggered, order.FilledQuantity)
+	}
+}
+
+func TestTriggeredStopLimitKeepsType(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	stop, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.STOP_LIMIT, StopPrice: 10100, Price: 10100, Quantity: 10})
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10100, 1)
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10100, 1)
+
+	// The triggered order rests as a limit order but is still a STOP_LIMIT
+	order, _ := me.GetOrder(stop.OrderID)
+	if !order.Triggered || order.Type != engine.STOP_LIMIT || order.Status != engine.ACCEPTED {
+		t.Errorf("Expected a resting triggered STOP_LIMIT, got %s triggered=%v status=%s", order.Type, order.Triggered, order.Status)
+	}
+	orders, _ := me.GetAccountOrders("alice")
+	if len(orders) != 1 || orders[0].Type != engine.STOP_LIMIT {
+		t.Errorf("Expected the account to show a STOP_LIMIT, got %+v", orders)
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 1 || book.Bids[0].Quantity != 10 {
+		t.Errorf("Expected 10 bid at 10100, got %+v", book.Bids)
+	}
+	if result, err := me.ReplaceOrder(stop.OrderID, 0, 5); err != nil || result.RemainingQuantity != 5 {
+		t.Errorf("Expected the resting order to be amendable, got %+v (%v)", result, err)
+	}
+}
+
+func TestTriggeredStopKeepsTimeInForce(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Only 5 offered above the stop price once it triggers
+	fok, _ := me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.BUY, Type: engine.STOP, StopPrice: 10000, Quantity: 20, TimeInForce: engine.FOK})
+	gtc, _ := me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.BUY, Type: engine.STOP, StopPrice: 10000, Quantity: 20})
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 1)
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10100, 5)
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 1)
+
+	// Fill-or-kill is killed without trading, the GTC stop takes the 5 and
+	// cancels the rest; both still show the time in force they were sent
+	tests := []struct {
+		id     string
+		tif    engine.TimeInForce
+		status engine.OrderStatus
+		filled int64
+	}{
+		{fok.OrderID, engine.FOK, engine.KILLED, 0},
+		{gtc.OrderID, engine.GTC, engine.CANCELLED, 5},
+	}
+	for _, tt := range tests {
+		order, _ := me.GetOrder(tt.id)
+		if !order.Triggered || order.TimeInForce != tt.tif || order.Status != tt.status || order.FilledQuantity != tt.filled {
+			t.Errorf("Expected a triggered %s stop %s with %d filled, got %s %s with %d", tt.tif, tt.status, tt.filled, order.TimeInForce, order.Status, order.FilledQuantity)
+		}
+	}
+}
+
+func TestStopOrderCascade(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Bids at descending prices
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 10)
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 14900, 10)
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 14800, 10)
+
+	// Sell stop at 15000 hits the 14900 bid, which triggers the 14900 stop
+	first, _ := me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.SELL, Type: engine.STOP, StopPrice: 15000, Quantity: 10})
+	second, _ := me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.SELL, Type: engine.STOP_LIMIT, StopPrice: 14900, Price: 14800, Quantity: 10})
+
+	// Trade at 15000 starts the cascade
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 10)
+
+	for _, id := range []string{first.OrderID, second.OrderID} {
+		order, err := me.GetOrder(id)
+		if err != nil {
+			t.Fatalf("Stop order %s should be queryable: %v", id, err)
+		}
+		if order.Status != engine.FILLED {
+			t.Errorf("Expected stop order FILLED, got %s", order.Status)
+		}
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 0 {
+		t.Errorf("Expected all bids consumed, got %d levels", len(book.Bids))
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Establish a last trade at 10000
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 10000, 1)
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 10000, 1)
+
+	// Sell trailing stop 200 below the market
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:      "BTC",
+		Side:        engine.SELL,
+		Type:        engine.TRAILING_STOP,
+		TrailAmount: 200,
+		Quantity:    5,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit trailing stop: %v", err)
+	}
+
+	order, _ := me.GetOrder(result.OrderID)
+	if order.StopPrice != 9800 {
+		t.Errorf("Expected initial stop price 9800, got %d", order.StopPrice)
+	}
+
+	// Market rallies to 10500: stop follows to 10300
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 10500, 1)
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 10500, 1)
+
+	order, _ = me.GetOrder(result.OrderID)
+	if order.StopPrice != 10300 {
+		t.Errorf("Expected stop price to trail up to 10300, got %d", order.StopPrice)
+	}
+
+	// Market dips to 10400: stop must not move down
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 10400, 1)
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 10400, 1)
+
+	order, _ = me.GetOrder(result.OrderID)
+	if order.StopPrice != 10300 || order.Triggered {
+		t.Errorf("Expected untriggered stop at 10300, got %d triggered=%v", order.StopPrice, order.Triggered)
+	}
+
+	// Reversal through the trail triggers a market sell into the bid
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 10200, 10)
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 10200, 1)
+
+	order, _ = me.GetOrder(result.OrderID)
+	if !order.Triggered || order.Status != engine.FILLED {
+		t.Errorf("Expected trailing stop triggered and FILLED, got triggered=%v status=%s", order.Triggered, order.Status)
+	}
+}
+
+func TestTrailingStopWithoutReferenceTrade(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Nothing to trail on an empty book: the stop waits for the first trade
+	sell, _ := me.Submit(engine.OrderRequest{Symbol: "BTC", Side: engine.SELL, Type: engine.TRAILING_STOP, TrailAmount: 200, Quantity: 5})
+	order, _ := me.GetOrder(sell.OrderID)
+	if order.StopPrice != 0 || order.Triggered {
+		t.Errorf("Expected an unarmed stop, got stop price %d triggered=%v", order.StopPrice, order.Triggered)
+	}
+
+	// With no trade yet a buy trails the best ask
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 10100, 1)
+	buy, _ := me.Submit(engine.OrderRequest{Symbol: "BTC", Side: engine.BUY, Type: engine.TRAILING_STOP, TrailAmount: 300, Quantity: 1})
+	order, _ = me.GetOrder(buy.OrderID)
+	if order.StopPrice != 10400 {
+		t.Errorf("Expected buy stop 300 above the ask at 10400, got %d", order.StopPrice)
+	}
+
+	// The first trade arms the sell stop without triggering it
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 10100, 1)
+	order, _ = me.GetOrder(sell.OrderID)
+	if order.StopPrice != 9900 || order.Triggered {
+		t.Errorf("Expected untriggered sell stop at 9900, got %d triggered=%v", order.StopPrice, order.Triggered)
+	}
+
+	// A trade at the stop price triggers it; the buy stop trails down
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 9900, 10)
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 9900, 1)
+	order, _ = me.GetOrder(sell.OrderID)
+	if !order.Triggered || order.Status != engine.FILLED {
+		t.Errorf("Expected sell stop triggered and FILLED, got triggered=%v status=%s", order.Triggered, order.Status)
+	}
+	order, _ = me.GetOrder(buy.OrderID)
+	if order.StopPrice != 10200 || order.Triggered {
+		t.Errorf("Expected untriggered buy stop at 10200, got %d triggered=%v", order.StopPrice, order.Triggered)
+	}
+}
+
+func TestTrailingStopBps(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 10000, 1)
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 10000, 1)
+
+	// Sell trailing stop 1% below the market
+	result, err := me.Submit(engine.OrderRequest{Symbol: "BTC", Side: engine.SELL, Type: engine.TRAILING_STOP, TrailBps: 100, Quantity: 2})
+	if err != nil {
+		t.Fatalf("Failed to submit trailing stop: %v", err)
+	}
+	order, _ := me.GetOrder(result.OrderID)
+	if order.StopPrice != 9900 {
+		t.Errorf("Expected initial stop price 9900, got %d", order.StopPrice)
+	}
+
+	// The trail is a percentage, so it widens as the price rises
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 12000, 1)
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 12000, 1)
+	order, _ = me.GetOrder(result.OrderID)
+	if order.StopPrice != 11880 {
+		t.Errorf("Expected stop price to trail up to 11880, got %d", order.StopPrice)
+	}
+
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 11900, 1)
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 11900, 1)
+	order, _ = me.GetOrder(result.OrderID)
+	if order.StopPrice != 11880 || order.Triggered {
+		t.Errorf("Expected untriggered stop at 11880, got %d triggered=%v", order.StopPrice, order.Triggered)
+	}
+
+	me.SubmitOrder("BTC", engine.BUY, engine.LIMIT, 11880, 10)
+	me.SubmitOrder("BTC", engine.SELL, engine.LIMIT, 11880, 1)
+	order, _ = me.GetOrder(result.OrderID)
+	if !order.Triggered || order.Status != engine.FILLED {
+		t.Errorf("Expected trailing stop triggered and FILLED, got triggered=%v status=%s", order.Triggered, order.Status)
+	}
+}
+
+func TestIcebergOrder(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Iceberg sell of 500 showing 100 at a time
+	iceberg, err := me.Submit(engine.OrderRequest{
+		Symbol:          "AAPL",
+		Side:            engine.SELL,
+		Type:            engine.LIMIT,
+		Price:           15000,
+		Quantity:        500,
+		DisplayQuantity: 100,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit iceberg order: %v", err)
+	}
+	plain, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 100)
+
+	// Only the visible slice is shown
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Asks) != 1 || book.Asks[0].Quantity != 200 {
+		t.Fatalf("Expected 200 visible at 15000, got %+v", book.Asks)
+	}
+
+	// Buy 150: 100 from the iceberg slice, then the plain order moves ahead
+	// of the replenished slice
+	result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 150)
+	if len(result.Trades) != 2 {
+		t.Fatalf("Expected 2 trades, got %d", len(result.Trades))
+	}
+	if result.Trades[0].SellerID != iceberg.OrderID || result.Trades[0].Quantity != 100 {
+		t.Error("First trade should take the iceberg's visible slice")
+	}
+	if result.Trades[1].SellerID != plain.OrderID {
+		t.Error("Replenished iceberg slice should lose time priority")
+	}
+
+	book, _ = me.GetOrderBook("AAPL", 10)
+	if book.Asks[0].Quantity != 150 {
+		t.Errorf("Expected 150 visible (50 plain + 100 slice), got %d", book.Asks[0].Quantity)
+	}
+}
+
+func TestIncomingIcebergOrder(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 100)
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15010, 100)
+
+	// An iceberg takes liquidity like any order, then rests showing a slice
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:          "AAPL",
+		Side:            engine.BUY,
+		Type:            engine.LIMIT,
+		Price:           15010,
+		Quantity:        500,
+		DisplayQuantity: 100,
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit iceberg order: %v", err)
+	}
+	if len(result.Trades) != 2 || result.FilledQuantity != 200 || result.RemainingQuantity != 300 {
+		t.Fatalf("Expected 200 filled in 2 trades and 300 left, got %+v", result)
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 1 || book.Bids[0].Quantity != 100 || len(book.Asks) != 0 {
+		t.Errorf("Expected a 100 slice bid and no asks, got bids %+v asks %+v", book.Bids, book.Asks)
+	}
+}
+
+func TestIcebergCancelAndReplaceWithHiddenReserve(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	iceberg, _ := me.Submit(engine.OrderRequest{
+		Symbol:          "AAPL",
+		Side:            engine.SELL,
+		Type:            engine.LIMIT,
+		Price:           15000,
+		Quantity:        500,
+		DisplayQuantity: 100,
+	})
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 150)
+
+	// Shrinking keeps the slice on show, capped by what is left
+	result, err := me.ReplaceOrder(iceberg.OrderID, 0, 180)
+	if err != nil || result.RemainingQuantity != 30 {
+		t.Fatalf("Expected 30 left after shrinking, got %+v (%v)", result, err)
+	}
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Asks) != 1 || book.Asks[0].Quantity != 30 {
+		t.Errorf("Expected 30 visible, got %+v", book.Asks)
+	}
+
+	// Growing it again re-enters the book showing a full slice, with the
+	// rest hidden behind it
+	result, err = me.ReplaceOrder(iceberg.OrderID, 15010, 600)
+	if err != nil || result.RemainingQuantity != 450 {
+		t.Fatalf("Expected 450 left after growing, got %+v (%v)", result, err)
+	}
+	book, _ = me.GetOrderBook("AAPL", 10)
+	if len(book.Asks) != 1 || book.Asks[0].Price != 15010 || book.Asks[0].Quantity != 100 {
+		t.Errorf("Expected a 100 slice at 15010, got %+v", book.Asks)
+	}
+
+	// Cancelling takes the hidden reserve with it
+	if err := me.CancelOrder(iceberg.OrderID); err != nil {
+		t.Fatalf("Failed to cancel iceberg: %v", err)
+	}
+	book, _ = me.GetOrderBook("AAPL", 10)
+	if len(book.Asks) != 0 {
+		t.Errorf("Expected no asks after cancel, got %+v", book.Asks)
+	}
+	buy, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15010, 100)
+	if len(buy.Trades) != 0 {
+		t.Errorf("Expected nothing left to trade with, got %d trades", len(buy.Trades))
+	}
+}
+
+func TestFOKFillsFromHiddenReserve(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	iceberg, _ := me.Submit(engine.OrderRequest{
+		Symbol:          "AAPL",
+		Side:            engine.SELL,
+		Type:            engine.LIMIT,
+		Price:           15000,
+		Quantity:        500,
+		DisplayQuantity: 100,
+	})
+
+	// More than the book shows, but not more than the iceberg holds
+	result, _ := me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 400, TimeInForce: engine.FOK})
+	if result.Status != engine.FILLED || result.FilledQuantity != 400 {
+		t.Fatalf("Expected FOK to fill 400 from the hidden reserve, got %s with %d filled", result.Status, result.FilledQuantity)
+	}
+	for _, trade := range result.Trades {
+		if trade.SellerID != iceberg.OrderID {
+			t.Errorf("Expected every trade against the iceberg, got seller %s", trade.SellerID)
+		}
+	}
+
+	// More than it holds in total is killed without trading
+	result, _ = me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 150, TimeInForce: engine.FOK})
+	if result.Status != engine.KILLED || len(result.Trades) != 0 {
+		t.Errorf("Expected FOK for 150 to be killed, got %s with %d trades", result.Status, len(result.Trades))
+	}
+	order, _ := me.GetOrder(iceberg.OrderID)
+	if order.FilledQuantity != 400 {
+		t.Errorf("Expected the iceberg to keep its last 100, got %d filled", order.FilledQuantity)
+	}
+}
+
+func TestReplaceOrderKeepsPriorityOnDecrease(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	first, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15050, 100)
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15050, 100)
+
+	// Shrink the first order; it stays at the front of the queue
+	result, err := me.ReplaceOrder(first.OrderID, 0, 60)
+	if err != nil {
+		t.Fatalf("Failed to replace order: %v", err)
+	}
+	if result.OrderID != first.OrderID || result.RemainingQuantity != 60 {
+		t.Errorf("Expected same order with 60 remaining, got %+v", result)
+	}
+
+	buyResult, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15050, 50)
+	if buyResult.Trades[0].SellerID != first.OrderID {
+		t.Error("Quantity decrease should keep queue position")
+	}
+}
+
+func TestReplaceOrderPriceChangeMatches(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15050, 100)
+	buy, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+
+	// Moving the bid up to the ask trades immediately
+	result, err := me.ReplaceOrder(buy.OrderID, 15050, 0)
+	if err != nil {
+		t.Fatalf("Failed to replace order: %v", err)
+	}
+	if result.Status != engine.FILLED || len(result.Trades) != 1 {
+		t.Errorf("Expected replaced order to fill with 1 trade, got %s with %d trades", result.Status, len(result.Trades))
+	}
+	if result.OrderID != buy.OrderID {
+		t.Error("Replace should keep the order ID")
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 0 || len(book.Asks) != 0 {
+		t.Error("Expected empty book after replace matched")
+	}
+}
+
+func TestMassCancel(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	bid1, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+	bid2, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 14900, 100)
+	ask, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15100, 100)
+	other, _ := me.SubmitOrder("TSLA", engine.BUY, engine.LIMIT, 20000, 100)
+
+	result := me.MassCancel(engine.CancelFilter{Symbol: "AAPL", Side: engine.BUY})
+	if result.Count != 2 {
+		t.Fatalf("Expected 2 cancelled orders, got %d", result.Count)
+	}
+
+	cancelled := map[string]bool{}
+	for _, id := range result.CancelledIDs {
+		cancelled[id] = true
+	}
+	if !cancelled[bid1.OrderID] || !cancelled[bid2.OrderID] {
+		t.Errorf("Expected both AAPL bids cancelled, got %v", result.CancelledIDs)
+	}
+
+	// Other side and other symbols are untouched
+	if _, err := me.GetOrder(ask.OrderID); err != nil {
+		t.Error("AAPL ask should still be in the book")
+	}
+	if _, err := me.GetOrder(other.OrderID); err != nil {
+		t.Error("TSLA bid should still be in the book")
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 0 || len(book.Asks) != 1 {
+		t.Errorf("Expected 0 bids and 1 ask, got %d and %d", len(book.Bids), len(book.Asks))
+	}
+}
+
+func TestClientOrderIDIdempotent(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	req := engine.OrderRequest{
+		AccountID:     "acct-1",
+		ClientOrderID: "client-1",
+		Symbol:        "AAPL",
+		Side:          engine.BUY,
+		Type:          engine.LIMIT,
+		Price:         15000,
+		Quantity:      100,
+	}
+
+	first, err := me.Submit(req)
+	if err != nil {
+		t.Fatalf("Failed to submit order: %v", err)
+	}
+
+	// Retry returns the original result without a new order
+	retry, err := me.Submit(req)
+	if err != nil {
+		t.Fatalf("Failed to resubmit order: %v", err)
+	}
+	if retry.OrderID != first.OrderID || !retry.Duplicate {
+		t.Errorf("Expected duplicate of %s, got %+v", first.OrderID, retry)
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 1 || book.Bids[0].Quantity != 100 {
+		t.Error("Resubmission must not add a second order")
+	}
+
+	order, err := me.GetOrderByClientID("acct-1", "client-1")
+	if err != nil || order.ID != first.OrderID {
+		t.Fatalf("Expected lookup by client order ID to find %s", first.OrderID)
+	}
+
+	// Client order IDs are scoped per account
+	if _, err := me.GetOrderByClientID("acct-2", "client-1"); err == nil {
+		t.Error("Client order ID should not be visible to another account")
+	}
+
+	if err := me.CancelOrderByClientID("acct-1", "client-1"); err != nil {
+		t.Errorf("Failed to cancel by client order ID: %v", err)
+	}
+	if _, err := me.GetOrder(first.OrderID); err == nil {
+		t.Error("Expected order to be cancelled")
+	}
+}
+
+func TestAccountOrdersAndTrades(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	sell, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 100})
+	buy, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 40})
+
+	if len(buy.Trades) != 1 {
+		t.Fatalf("Expected 1 trade, got %d", len(buy.Trades))
+	}
+	trade := buy.Trades[0]
+	if trade.BuyerAccountID != "bob" || trade.SellerAccountID != "alice" {
+		t.Errorf("Expected buyer bob and seller alice, got %s and %s", trade.BuyerAccountID, trade.SellerAccountID)
+	}
+
+	orders, err := me.GetAccountOrders("alice")
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("Expected 1 order for alice, got %d (%v)", len(orders), err)
+	}
+	if orders[0].ID != sell.OrderID || orders[0].FilledQuantity != 40 {
+		t.Errorf("Expected alice's order with 40 filled, got %+v", orders[0])
+	}
+
+	for _, account := range []string{"alice", "bob"} {
+		trades, err := me.GetAccountTrades(account)
+		if err != nil || len(trades) != 1 || trades[0].ID != trade.ID {
+			t.Errorf("Expected %s to have the trade, got %v (%v)", account, trades, err)
+		}
+	}
+
+	if _, err := me.GetAccountOrders("carol"); err == nil {
+		t.Error("Expected error for unknown account")
+	}
+}
+
+func TestFailedOrderNotInAccountHistory(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// A market order with nothing to trade against is never created
+	if _, err := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.MARKET, Quantity: 5}); err == nil {
+		t.Fatal("Expected insufficient liquidity error")
+	}
+	if orders, _ := me.GetAccountOrders("alice"); len(orders) != 0 {
+		t.Errorf("Expected no orders for alice, got %+v", orders)
+	}
+
+	placed, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10000, Quantity: 5})
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.MARKET, Quantity: 10})
+	orders, _ := me.GetAccountOrders("alice")
+	if len(orders) != 1 || orders[0].ID != placed.OrderID {
+		t.Errorf("Expected only the limit order for alice, got %+v", orders)
+	}
+}
+
+func TestSelfTradeCancelNewest(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 30})
+	own, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 50})
+
+	// Trades with bob, then stops at alice's own order
+	result, err := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 100})
+	if err != nil {
+		t.Fatalf("Failed to submit order: %v", err)
+	}
+
+	if result.Status != engine.PARTIAL_FILL || result.FilledQuantity != 30 {
+		t.Errorf("Expected PARTIAL_FILL with 30 filled, got %s with %d", result.Status, result.FilledQuantity)
+	}
+	if result.CancelReason != engine.CANCEL_SELF_TRADE || result.CancelledQuantity != 70 || result.SelfTradePreventedQuantity != 70 {
+		t.Errorf("Expected 70 cancelled by self-trade prevention, got %+v", result)
+	}
+
+	resting, _ := me.GetOrder(own.OrderID)
+	if resting.Status != engine.ACCEPTED {
+		t.Errorf("Expected resting order to stay ACCEPTED, got %s", resting.Status)
+	}
+	if snapshot, _ := me.GetOrderBook("AAPL", 10); len(snapshot.Bids) != 0 || snapshot.Asks[0].Quantity != 50 {
+		t.Errorf("Expected only alice's 50 ask in the book, got %+v", snapshot)
+	}
+}
+
+func TestSelfTradeCancelOldestAndBoth(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	own, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 50})
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 30})
+
+	// CANCEL_OLDEST removes alice's ask and keeps matching against bob
+	result, _ := me.Submit(engine.OrderRequest{
+		AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 40,
+		SelfTradePrevention: engine.STP_CANCEL_OLDEST,
+	})
+	if result.FilledQuantity != 30 || result.RemainingQuantity != 10 {
+		t.Errorf("Expected 30 filled and 10 resting, got %+v", result)
+	}
+	if len(result.SelfTradeCancelledOrderIDs) != 1 || result.SelfTradeCancelledOrderIDs[0] != own.OrderID {
+		t.Errorf("Expected alice's ask to be cancelled, got %v", result.SelfTradeCancelledOrderIDs)
+	}
+	if _, err := me.GetOrder(own.OrderID); err == nil {
+		t.Error("Expected cancelled resting order to leave the book")
+	}
+
+	// CANCEL_BOTH, set as the account default
+	if err := me.SetSelfTradePrevention("alice", engine.STP_CANCEL_BOTH); err != nil {
+		t.Fatalf("Failed to set self-trade prevention: %v", err)
+	}
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 25})
+	if result.Status != engine.CANCELLED || result.CancelledQuantity != 25 || len(result.SelfTradeCancelledOrderIDs) != 1 {
+		t.Errorf("Expected both orders cancelled, got %+v", result)
+	}
+	if snapshot, _ := me.GetOrderBook("AAPL", 10); len(snapshot.Bids) != 0 || len(snapshot.Asks) != 0 {
+		t.Errorf("Expected empty book, got %+v", snapshot)
+	}
+}
+
+func TestSelfTradeDecrementAndCancel(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	own, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 100})
+
+	result, _ := me.Submit(engine.OrderRequest{
+		AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 40,
+		SelfTradePrevention: engine.STP_DECREMENT_AND_CANCEL,
+	})
+	if result.Status != engine.CANCELLED || len(result.Trades) != 0 || result.SelfTradePreventedQuantity != 40 {
+		t.Errorf("Expected incoming order cancelled with 40 prevented, got %+v", result)
+	}
+
+	resting, _ := me.GetOrder(own.OrderID)
+	if resting.Quantity != 60 || resting.Status != engine.ACCEPTED {
+		t.Errorf("Expected resting order decremented to 60, got %d (%s)", resting.Quantity, resting.Status)
+	}
+
+	// FOK never fills against its own orders
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 15000, Quantity: 10, TimeInForce: engine.FOK})
+	if result.Status != engine.KILLED {
+		t.Errorf("Expected FOK against own liquidity to be KILLED, got %s", result.Status)
+	}
+}
+
+func TestTradeAggressorAndSequence(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	sell1, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 10})
+	sell2, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15100, Quantity: 10})
+	buy, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.MARKET, Quantity: 15})
+
+	if len(buy.Trades) != 2 {
+		t.Fatalf("Expected 2 trades, got %d", len(buy.Trades))
+	}
+	for i, trade := range buy.Trades {
+		if trade.Symbol != "AAPL" || trade.Sequence != uint64(i+1) {
+			t.Errorf("Expected AAPL trade with sequence %d, got %s %d", i+1, trade.Symbol, trade.Sequence)
+		}
+		if trade.AggressorSide != engine.BUY || trade.TakerOrderID != buy.OrderID {
+			t.Errorf("Expected buy order %s as aggressor, got %s %s", buy.OrderID, trade.AggressorSide, trade.TakerOrderID)
+		}
+	}
+	if buy.Trades[0].MakerOrderID != sell1.OrderID || buy.Trades[1].MakerOrderID != sell2.OrderID {
+		t.Errorf("Expected makers %s and %s, got %s and %s", sell1.OrderID, sell2.OrderID, buy.Trades[0].MakerOrderID, buy.Trades[1].MakerOrderID)
+	}
+
+	// Sequences are per symbol
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "MSFT", Side: engine.BUY, Type: engine.LIMIT, Price: 30000, Quantity: 5})
+	sell, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "MSFT", Side: engine.SELL, Type: engine.LIMIT, Price: 30000, Quantity: 5})
+	if sell.Trades[0].Sequence != 1 || sell.Trades[0].AggressorSide != engine.SELL {
+		t.Errorf("Expected first MSFT trade sold into, got %+v", sell.Trades[0])
+	}
+
+	tape, err := me.GetTrades("AAPL", 10)
+	if err != nil || len(tape) != 2 || tape[1].Sequence != 2 {
+		t.Errorf("Expected 2 AAPL trades on the tape, got %v (%v)", tape, err)
+	}
+}
+
+func TestPriceLevelsStayOrdered(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// Insert levels out of order, then cancel every third one
+	ids := map[int64]string{}
+	for i := int64(0); i < 300; i++ {
+		price := 10000 + (i*37)%300
+		result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, price, 10)
+		ids[price] = result.OrderID
+	}
+	for price, id := range ids {
+		if price%3 == 0 {
+			me.CancelOrder(id)
+		}
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 1000)
+	if len(book.Bids) != 200 {
+		t.Fatalf("Expected 200 bid levels, got %d", len(book.Bids))
+	}
+	for i := 1; i < len(book.Bids); i++ {
+		if book.Bids[i-1].Price <= book.Bids[i].Price {
+			t.Fatalf("Bids out of order at %d: %d then %d", i, book.Bids[i-1].Price, book.Bids[i].Price)
+		}
+	}
+	if best := me.GetOrCreateBook("AAPL").GetBestBid(); best != 10298 {
+		t.Errorf("Expected best bid 10298, got %d", best)
+	}
+}
+
+func TestPriceLevelAggregates(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	a, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 100)
+	me.Submit(engine.OrderRequest{Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 15000, Quantity: 300, DisplayQuantity: 50})
+	c, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 70)
+
+	level := me.GetOrCreateBook("AAPL").Asks.Best()
+	if level.OrderCount != 3 || level.TotalQuantity != 470 || level.VisibleQuantity != 220 {
+		t.Fatalf("Expected 3 orders, 470 total, 220 visible, got %d, %d, %d", level.OrderCount, level.TotalQuantity, level.VisibleQuantity)
+	}
+
+	// Cancel from the middle of the queue
+	me.CancelOrder(c.OrderID)
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 120)
+
+	// a is filled, the iceberg traded 20 of its slice
+	if level.OrderCount != 1 || level.TotalQuantity != 280 || level.VisibleQuantity != 30 {
+		t.Errorf("Expected 1 order, 280 total, 30 visible, got %d, %d, %d", level.OrderCount, level.TotalQuantity, level.VisibleQuantity)
+	}
+	if front := level.Front(); front == nil || front.ID == a.OrderID {
+		t.Errorf("Expected the iceberg at the front of the queue, got %+v", front)
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if book.Asks[0].Quantity != 30 {
+		t.Errorf("Expected snapshot to show 30, got %d", book.Asks[0].Quantity)
+	}
+}
+
+func TestOrderIndexFollowsOrders(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	bid, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+	other, _ := me.SubmitOrder("MSFT", engine.BUY, engine.LIMIT, 30000, 100)
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15100, 100)
+
+	order, err := me.GetOrder(other.OrderID)
+	if err != nil || order.Symbol != "MSFT" {
+		t.Fatalf("Expected to find the MSFT order, got %+v (%v)", order, err)
+	}
+
+	// Cancelled orders leave the index
+	if err := me.CancelOrder(other.OrderID); err != nil {
+		t.Fatalf("Failed to cancel order: %v", err)
+	}
+	if _, err := me.GetOrder(other.OrderID); err == nil || err.Error() != "order not found" {
+		t.Errorf("Expected cancelled order to be gone, got %v", err)
+	}
+
+	// An amended order that fills on re-entry can still be looked up
+	result, err := me.ReplaceOrder(bid.OrderID, 15100, 0)
+	if err != nil || result.Status != engine.FILLED {
+		t.Fatalf("Expected amended order to fill, got %+v (%v)", result, err)
+	}
+	order, err = me.GetOrder(bid.OrderID)
+	if err != nil || order.Status != engine.FILLED {
+		t.Fatalf("Expected filled order to be found, got %+v (%v)", order, err)
+	}
+	if err := me.CancelOrder(bid.OrderID); err == nil || err.Error() != "cannot cancel: order already filled" {
+		t.Errorf("Expected filled order to refuse cancel, got %v", err)
+	}
+}
+
+func TestCancelByIDAfterFillOrReplace(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	// A resting order that filled stays indexed and refuses the cancel
+	resting, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 15000, 100)
+	incoming, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+	if err := me.CancelOrder(resting.OrderID); err == nil || err.Error() != "cannot cancel: order already filled" {
+		t.Errorf("Expected filled order to refuse cancel, got %v", err)
+	}
+	if order, err := me.GetOrder(resting.OrderID); err != nil || order.Status != engine.FILLED {
+		t.Errorf("Expected order still FILLED after the cancel, got %+v (%v)", order, err)
+	}
+
+	// One that filled on arrival never rested, so it was never indexed
+	if err := me.CancelOrder(incoming.OrderID); err == nil || err.Error() != "order not found" {
+		t.Errorf("Expected an order filled on arrival not to be found, got %v", err)
+	}
+
+	// A replaced order is cancelled at its new price, once
+	bid, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 14900, 100)
+	if _, err := me.ReplaceOrder(bid.OrderID, 14950, 200); err != nil {
+		t.Fatalf("Failed to replace order: %v", err)
+	}
+	if err := me.CancelOrder(bid.OrderID); err != nil {
+		t.Fatalf("Failed to cancel replaced order: %v", err)
+	}
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 0 {
+		t.Errorf("Expected no bids after cancel, got %+v", book.Bids)
+	}
+	if err := me.CancelOrder(bid.OrderID); err == nil || err.Error() != "order not found" {
+		t.Errorf("Expected a second cancel to find nothing, got %v", err)
+	}
+}
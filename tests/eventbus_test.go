@@ -0,0 +1,240 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"order-matching-engine/internal/engine"
+)
+
+// drainEvents returns the events already delivered to a subscription
+func drainEvents(sub *engine.Subscription) []engine.Event {
+	var events []engine.Event
+	for {
+		select {
+		case event := <-sub.Events():
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventStreamReportsExecutions(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+	me := engine.NewMatchingEngine(engine.WithClock(clock), engine.WithIDGenerator(engine.NewSequentialIDGenerator("")))
+	defer me.Close()
+
+	sub := me.Subscribe(100)
+	defer sub.Close()
+
+	sell, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 10000, Quantity: 10})
+	gtd, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 10100, Quantity: 5,
+		TimeInForce: engine.GTD, ExpireAt: clock.now.Add(time.Minute).UnixMilli()})
+	buy, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10000, Quantity: 4})
+	ioc, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10000, Quantity: 8, TimeInForce: engine.IOC})
+	clock.Advance(2 * time.Minute)
+	me.ExpireOrders()
+
+	var got []string
+	for _, event := range drainEvents(sub) {
+		switch {
+		case event.Book != nil:
+			got = append(got, fmt.Sprintf("%s %d", event.Type, len(event.Book.Asks)))
+		case event.Order != nil:
+			got = append(got, fmt.Sprintf("%s %s %d %s", event.Type, event.Order.ID, event.Order.FilledQuantity, event.Order.Status))
+		default:
+			got = append(got, fmt.Sprintf("%s %d", event.Type, event.Trade.Quantity))
+		}
+	}
+	want := []string{
+		fmt.Sprintf("ORDER_ACCEPTED %s 0 ACCEPTED", sell.OrderID),
+		"BOOK_UPDATED 1",
+		fmt.Sprintf("ORDER_ACCEPTED %s 0 ACCEPTED", gtd.OrderID),
+		"BOOK_UPDATED 2",
+		// The resting order hears about the fill as well as the taker
+		fmt.Sprintf("ORDER_ACCEPTED %s 0 ACCEPTED", buy.OrderID),
+		"TRADE_EXECUTED 4",
+		fmt.Sprintf("ORDER_PARTIALLY_FILLED %s 4 PARTIAL_FILL", sell.OrderID),
+		fmt.Sprintf("ORDER_FILLED %s 4 FILLED", buy.OrderID),
+		"BOOK_UPDATED 2",
+		fmt.Sprintf("ORDER_ACCEPTED %s 0 ACCEPTED", ioc.OrderID),
+		"TRADE_EXECUTED 6",
+		fmt.Sprintf("ORDER_FILLED %s 10 FILLED", sell.OrderID),
+		fmt.Sprintf("ORDER_PARTIALLY_FILLED %s 6 PARTIAL_FILL", ioc.OrderID),
+		fmt.Sprintf("ORDER_CANCELLED %s 6 CANCELLED", ioc.OrderID),
+		"BOOK_UPDATED 1",
+		fmt.Sprintf("ORDER_EXPIRED %s 0 EXPIRED", gtd.OrderID),
+		"BOOK_UPDATED 0",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unexpected events:\n  want: %q\n  got:  %q", want, got)
+	}
+
+	// Rejected orders and failed commands report nothing
+	me.SubmitOrder("AAPL", engine.BUY, engine.MARKET, 0, 5)
+	me.CancelOrder(sell.OrderID)
+	if events := drainEvents(sub); len(events) != 0 {
+		t.Errorf("Expected no events, got %+v", events)
+	}
+}
+
+func TestEventStreamKeepsSymbolOrder(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	defer me.Close()
+
+	all := me.Subscribe(100000)
+	eth := me.Subscribe(100000, "ETH-USD")
+
+	var wg sync.WaitGroup
+	for _, symbol := range []string{"BTC-USD", "ETH-USD"} {
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(side engine.OrderSide) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					me.SubmitOrder(symbol, side, engine.LIMIT, 10000+int64(i%5), 1)
+				}
+			}([]engine.OrderSide{engine.BUY, engine.SELL}[g%2])
+		}
+	}
+	wg.Wait()
+	me.Close()
+
+	last := make(map[string]uint64)
+	count := 0
+	for event := range all.Events() {
+		if event.Sequence < last[event.Symbol] {
+			t.Fatalf("Event at sequence %d in %s after %d", event.Sequence, event.Symbol, last[event.Symbol])
+		}
+		last[event.Symbol] = event.Sequence
+		count++
+	}
+	if count == 0 || all.Dropped() != 0 {
+		t.Errorf("Expected every event delivered, got %d with %d dropped", count, all.Dropped())
+	}
+	for event := range eth.Events() {
+		if event.Symbol != "ETH-USD" {
+			t.Fatalf("Expected only ETH-USD events, got %s", event.Symbol)
+		}
+	}
+}
+
+func TestSlowSubscriberDoesNotBlockMatching(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	defer me.Close()
+
+	slow := me.Subscribe(1)
+	for i := 0; i < 100; i++ {
+		me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 1)
+	}
+
+	// Nothing is read from the subscription, yet every order went through
+	book, _ := me.GetOrderBook("AAPL", 1)
+	if book.Bids[0].Quantity != 100 {
+		t.Errorf("Expected 100 resting, got %d", book.Bids[0].Quantity)
+	}
+	if len(drainEvents(slow)) != 1 || slow.Dropped() != 199 {
+		t.Errorf("Expected 1 event kept and 199 dropped, got %d dropped", slow.Dropped())
+	}
+
+	slow.Close()
+	if _, open := <-slow.Events(); open {
+		t.Error("Expected the events channel to be closed")
+	}
+}
+
+// gatedLog is an engine.CommandLog whose syncs wait until the gate opens
+type gatedLog struct {
+	seq     atomic.Uint64
+	syncing chan struct{}
+	gate    chan struct{}
+	fail    bool
+}
+
+func (l *gatedLog) Append(data []byte) (uint64, error) {
+	return l.seq.Add(1), nil
+}
+
+func (l *gatedLog) Sync(seq uint64) error {
+	l.syncing <- struct{}{}
+	<-l.gate
+	if l.fail {
+		return errors.New("disk gone")
+	}
+	return nil
+}
+
+func TestEventsWaitForDurability(t *testing.T) {
+	log := &gatedLog{syncing: make(chan struct{}, 1), gate: make(chan struct{})}
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log))
+	defer me.Close()
+	sub := me.Subscribe(100)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 5)
+		done <- err
+	}()
+
+	// Applied and logged, but not yet synced: nothing goes out
+	<-log.syncing
+	if events := drainEvents(sub); len(events) != 0 {
+		t.Errorf("Expected no events before the sync, got %+v", events)
+	}
+
+	close(log.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to submit order: %v", err)
+	}
+	if events := drainEvents(sub); len(events) != 2 || events[0].Type != engine.ORDER_ACCEPTED {
+		t.Errorf("Expected ORDER_ACCEPTED and BOOK_UPDATED once synced, got %+v", events)
+	}
+}
+
+func TestNoEventsForCommandsThatFailToSync(t *testing.T) {
+	log := &gatedLog{syncing: make(chan struct{}, 1), gate: make(chan struct{}), fail: true}
+	close(log.gate)
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log))
+	defer me.Close()
+	sub := me.Subscribe(100)
+
+	if _, err := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 5); !errors.Is(err, engine.ErrCommandLogFailed) {
+		t.Fatalf("Expected the sync failure, got %v", err)
+	}
+	if events := drainEvents(sub); len(events) != 0 {
+		t.Errorf("Expected no events, got %+v", events)
+	}
+}
+
+func TestRestoredBooksPublishEvents(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	defer me.Close()
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 5)
+
+	var buf bytes.Buffer
+	if _, err := me.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	restored := engine.NewMatchingEngine()
+	defer restored.Close()
+	if _, err := restored.LoadSnapshot(&buf); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+
+	sub := restored.Subscribe(100)
+	restored.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 5)
+	var got []engine.EventType
+	for _, event := range drainEvents(sub) {
+		got = append(got, event.Type)
+	}
+	want := []engine.EventType{engine.ORDER_ACCEPTED, engine.TRADE_EXECUTED, engine.ORDER_FILLED, engine.ORDER_FILLED, engine.BOOK_UPDATED}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected %v from the restored book, got %v", want, got)
+	}
+}
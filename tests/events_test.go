@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"order-matching-engine/internal/engine"
+)
+
+func TestBookEventsAreSequencedPerSymbol(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+	me := engine.NewMatchingEngine(engine.WithClock(clock), engine.WithIDGenerator(engine.NewSequentialIDGenerator("")))
+	defer me.Close()
+
+	submit := func(req engine.OrderRequest) *engine.OrderResult {
+		t.Helper()
+		clock.Advance(time.Microsecond)
+		result, err := me.Submit(req)
+		if err != nil {
+			t.Fatalf("Failed to submit order: %v", err)
+		}
+		return result
+	}
+
+	iceberg := submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 50000, Quantity: 6, DisplayQuantity: 2})
+	ask := submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 50100, Quantity: 5})
+	eth := submit(engine.OrderRequest{AccountID: "alice", Symbol: "ETH-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 3000, Quantity: 5})
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 2})
+	me.ReplaceOrder(ask.OrderID, 0, 3)
+	me.CancelOrder(eth.OrderID)
+
+	events, err := me.GetEvents("BTC-USD", 0, 100)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	var got []string
+	for i, event := range events {
+		if event.Sequence != uint64(i+1) {
+			t.Errorf("Expected event %d to have sequence %d, got %d", i, i+1, event.Sequence)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d %s", event.Type, event.OrderID, event.Quantity, event.Status))
+	}
+	want := []string{
+		fmt.Sprintf("ADD %s 2 ACCEPTED", iceberg.OrderID),
+		fmt.Sprintf("ADD %s 5 ACCEPTED", ask.OrderID),
+		"TRADE  2 ",
+		fmt.Sprintf("FILL %s 2 PARTIAL_FILL", iceberg.OrderID),
+		fmt.Sprintf("ADD %s 2 PARTIAL_FILL", iceberg.OrderID), // next slice
+		fmt.Sprintf("AMEND %s 3 ACCEPTED", ask.OrderID),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unexpected BTC-USD events:\n  want: %q\n  got:  %q", want, got)
+	}
+	if events[2].TradeID == "" || events[3].TradeID != events[2].TradeID {
+		t.Errorf("Expected the fill to name its trade, got %q and %q", events[2].TradeID, events[3].TradeID)
+	}
+
+	// The engine sequence runs across both symbols without gaps
+	ethEvents, _ := me.GetEvents("ETH-USD", 0, 100)
+	if len(ethEvents) != 2 || ethEvents[0].Type != engine.EVENT_ADD || ethEvents[1].Type != engine.EVENT_CANCEL || ethEvents[1].Sequence != 2 {
+		t.Errorf("Expected an add and a cancel in ETH-USD, got %+v", ethEvents)
+	}
+	seen := make(map[uint64]bool)
+	for _, event := range append(events, ethEvents...) {
+		seen[event.EngineSequence] = true
+	}
+	for seq := uint64(1); seq <= uint64(len(events)+len(ethEvents)); seq++ {
+		if !seen[seq] {
+			t.Errorf("Expected engine sequence %d to be used", seq)
+		}
+	}
+	if ethEvents[0].EngineSequence <= events[1].EngineSequence || ethEvents[0].EngineSequence >= events[2].EngineSequence {
+		t.Errorf("Expected the ETH-USD add between the BTC-USD adds and trade, got engine sequence %d", ethEvents[0].EngineSequence)
+	}
+
+	// The book says which event it reflects, and later events page on from it
+	book, _ := me.GetOrderBook("BTC-USD", 10)
+	if book.Sequence != uint64(len(events)) {
+		t.Errorf("Expected the book at sequence %d, got %d", len(events), book.Sequence)
+	}
+	page, _ := me.GetEvents("BTC-USD", 2, 2)
+	if len(page) != 2 || page[0].Sequence != 3 || page[1].Sequence != 4 {
+		t.Errorf("Expected events 3 and 4, got %+v", page)
+	}
+	if rest, _ := me.GetEvents("BTC-USD", book.Sequence, 10); len(rest) != 0 {
+		t.Errorf("Expected no events after the latest, got %+v", rest)
+	}
+}
+
+func TestDroppedEventsAreReported(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	defer me.Close()
+
+	for i := 0; i < 2100; i++ {
+		result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 1)
+		me.CancelOrder(result.OrderID)
+	}
+
+	if _, err := me.GetEvents("AAPL", 0, 10); !errors.Is(err, engine.ErrEventsUnavailable) {
+		t.Errorf("Expected ErrEventsUnavailable for dropped events, got %v", err)
+	}
+	events, err := me.GetEvents("AAPL", 4190, 100)
+	if err != nil || len(events) != 10 || events[9].Sequence != 4200 {
+		t.Errorf("Expected the last 10 events, got %d (%v)", len(events), err)
+	}
+}
+
+func TestNanosecondTimestamps(t *testing.T) {
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	me := engine.NewMatchingEngine(engine.WithClock(clock))
+	defer me.Close()
+
+	sell, _ := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 10)
+	clock.Advance(time.Microsecond)
+	buy, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 15)
+
+	first, _ := me.GetOrder(sell.OrderID)
+	second, _ := me.GetOrder(buy.OrderID)
+	if first.Timestamp != start.UnixNano() || second.Timestamp-first.Timestamp != int64(time.Microsecond) {
+		t.Errorf("Expected timestamps a microsecond apart, got %d and %d", first.Timestamp, second.Timestamp)
+	}
+	if trade := buy.Trades[0]; trade.Timestamp != second.Timestamp {
+		t.Errorf("Expected the trade at %d, got %d", second.Timestamp, trade.Timestamp)
+	}
+
+	// The JSON keeps the millisecond timestamp of version 1 alongside
+	for name, v := range map[string]any{"order": second, "trade": buy.Trades[0]} {
+		data, _ := json.Marshal(v)
+		var fields map[string]any
+		json.Unmarshal(data, &fields)
+		if fields["timestamp"] != float64(start.UnixMilli()) || fields["timestamp_ns"] != float64(second.Timestamp) || fields["version"] != float64(engine.JSONVersion) {
+			t.Errorf("Unexpected %s JSON: %s", name, data)
+		}
+	}
+}
+
+func TestReplayFailsOnUnloggedTrades(t *testing.T) {
+	log := &recordingLog{}
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log))
+	defer me.Close()
+
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 5)
+	if result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 5); len(result.Trades) != 1 {
+		t.Fatalf("Expected one trade, got %d", len(result.Trades))
+	}
+
+	// The buy's record without the IDs of the trade it made
+	var fields map[string]any
+	json.Unmarshal(log.records[1], &fields)
+	delete(fields, "trade_ids")
+	stripped, _ := json.Marshal(fields)
+
+	replayed := engine.NewMatchingEngine()
+	defer replayed.Close()
+	if err := replayed.Replay(1, log.records[0]); err != nil {
+		t.Fatalf("Failed to replay the sell: %v", err)
+	}
+	if err := replayed.Replay(2, stripped); err == nil {
+		t.Error("Expected replay to fail for a trade the command did not log")
+	}
+}
@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"order-matching-engine/internal/engine"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced engine.Clock
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestGTDOrderExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+
+	var expired []engine.Order
+	me := engine.NewMatchingEngine(
+		engine.WithClock(clock),
+		engine.WithExpiryHandler(func(o engine.Order) {
+			expired = append(expired, o)
+		}),
+	)
+
+	result, err := me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.BUY,
+		Type:        engine.LIMIT,
+		Price:       15000,
+		Quantity:    100,
+		TimeInForce: engine.GTD,
+		ExpireAt:    clock.now.Add(time.Minute).UnixMilli(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to submit GTD order: %v", err)
+	}
+
+	// Not due yet
+	clock.Advance(30 * time.Second)
+	if ids := me.ExpireOrders(); len(ids) != 0 {
+		t.Fatalf("Expected no expiries yet, got %v", ids)
+	}
+
+	clock.Advance(30 * time.Second)
+	ids := me.ExpireOrders()
+	if len(ids) != 1 || ids[0] != result.OrderID {
+		t.Fatalf("Expected order %s to expire, got %v", result.OrderID, ids)
+	}
+
+	if len(expired) != 1 || expired[0].Status != engine.EXPIRED {
+		t.Errorf("Expected one EXPIRED event, got %+v", expired)
+	}
+
+	book, _ := me.GetOrderBook("AAPL", 10)
+	if len(book.Bids) != 0 {
+		t.Error("Expired order should be removed from the book")
+	}
+}
+
+func TestDayOrderExpiresAtEndOfDay(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC)}
+	me := engine.NewMatchingEngine(engine.WithClock(clock))
+
+	resting, _ := me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.SELL,
+		Type:        engine.LIMIT,
+		Price:       16000,
+		Quantity:    100,
+		TimeInForce: engine.DAY,
+	})
+
+	// A DAY order that fills is not expired
+	me.Submit(engine.OrderRequest{
+		Symbol:      "AAPL",
+		Side:        engine.SELL,
+		Type:        engine.LIMIT,
+		Price:       15000,
+		Quantity:    100,
+		TimeInForce: engine.DAY,
+	})
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 15000, 100)
+
+	clock.Advance(59 * time.Minute)
+	if ids := me.ExpireOrders(); len(ids) != 0 {
+		t.Fatalf("Expected no expiries before midnight, got %v", ids)
+	}
+
+	clock.Advance(time.Minute)
+	ids := me.ExpireOrders()
+	if len(ids) != 1 || ids[0] != resting.OrderID {
+		t.Errorf("Expected DAY order %s to expire at midnight, got %v", resting.OrderID, ids)
+	}
+}
+
+func TestExpiredOrderOnlyInAccountHistory(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+	me := engine.NewMatchingEngine(engine.WithClock(clock))
+	defer me.Close()
+
+	result, _ := me.Submit(engine.OrderRequest{
+		AccountID:   "alice",
+		Symbol:      "AAPL",
+		Side:        engine.BUY,
+		Type:        engine.LIMIT,
+		Price:       15000,
+		Quantity:    100,
+		TimeInForce: engine.GTD,
+		ExpireAt:    clock.now.Add(time.Minute).UnixMilli(),
+	})
+	clock.Advance(time.Minute)
+	if ids := me.ExpireOrders(); len(ids) != 1 {
+		t.Fatalf("Expected one expiry, got %v", ids)
+	}
+
+	// Like a cancelled order, it leaves the order index
+	if _, err := me.GetOrder(result.OrderID); err == nil {
+		t.Error("Expected an expired order not to be found by ID")
+	}
+
+	orders, err := me.GetAccountOrders("alice")
+	if err != nil || len(orders) != 1 || orders[0].ID != result.OrderID || orders[0].Status != engine.EXPIRED {
+		t.Errorf("Expected the account history to show the order EXPIRED, got %+v (%v)", orders, err)
+	}
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"order-matching-engine/internal/engine"
+)
+
+func TestMakerTakerFees(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	me.SetFeeSchedule(engine.FeeSchedule{MakerBps: 10, TakerBps: 20})
+	me.SetFeeSchedule(engine.FeeSchedule{Tier: "mm", MakerBps: -5, TakerBps: 15})
+	me.SetAccountFeeTier("alice", "mm")
+
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 10001, Quantity: 10})
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10001, Quantity: 10})
+
+	if len(result.Trades) != 1 {
+		t.Fatalf("Expected 1 trade, got %d", len(result.Trades))
+	}
+	trade := result.Trades[0]
+	if trade.MakerSide != engine.SELL || trade.TakerSide != engine.BUY {
+		t.Errorf("Expected SELL maker and BUY taker, got %s and %s", trade.MakerSide, trade.TakerSide)
+	}
+
+	// Notional 100010: the maker rebate rounds toward zero, the taker fee up
+	if trade.MakerFee != -50 || trade.TakerFee != 201 {
+		t.Errorf("Expected maker fee -50 and taker fee 201, got %d and %d", trade.MakerFee, trade.TakerFee)
+	}
+
+	bySymbol, total, err := me.GetFeeRevenue()
+	if err != nil {
+		t.Fatalf("Failed to get fee revenue: %v", err)
+	}
+	if len(bySymbol) != 1 || total.Net != 151 || total.Notional != 100010 {
+		t.Errorf("Expected net revenue 151 on 100010 notional, got %+v", total)
+	}
+
+	if err := me.SetFeeSchedule(engine.FeeSchedule{MakerBps: -30, TakerBps: 20}); err == nil {
+		t.Error("Expected a rebate larger than the taker fee to be refused")
+	}
+}
+
+func TestFeesSettleThroughLedger(t *testing.T) {
+	me := engine.NewMatchingEngine(engine.WithLedger())
+	me.SetFeeSchedule(engine.FeeSchedule{MakerBps: -10, TakerBps: 30})
+	me.Deposit("alice", "BTC", 2)
+	me.Deposit("bob", "USD", 1000000)
+
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 100000, Quantity: 2})
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.MARKET, Quantity: 2})
+
+	// Notional 200000: bob pays 600 in fees, alice earns a 200 rebate
+	if b := balanceOf(t, me, "bob", "USD"); b.Available != 799400 || b.Held != 0 {
+		t.Errorf("Expected bob to pay 200600 USD, got %+v", b)
+	}
+	if b := balanceOf(t, me, "alice", "USD"); b.Available != 200200 {
+		t.Errorf("Expected alice to receive 200200 USD, got %+v", b)
+	}
+	if b := balanceOf(t, me, engine.FeeAccountID, "USD"); b.Available != 400 {
+		t.Errorf("Expected fee account to collect 400 USD, got %+v", b)
+	}
+
+	if totals := me.AssetTotals(); totals["USD"] != 1000000 || totals["BTC"] != 2 {
+		t.Errorf("Expected totals to be conserved, got %v", totals)
+	}
+}
+
+func TestFeesStayWithinHeldFunds(t *testing.T) {
+	me := engine.NewMatchingEngine(engine.WithLedger())
+	me.SetFeeSchedule(engine.FeeSchedule{TakerBps: 1})
+	me.Deposit("alice", "BTC", 3)
+	me.Deposit("bob", "USD", 4)
+	for i := 0; i < 3; i++ {
+		me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 1, Quantity: 1})
+	}
+
+	// Each of three fills rounds its fee up to 1, so 3 of cost can take 3
+	// in fees; 4 cannot cover that
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 1, Quantity: 3})
+	if result.RejectReason != engine.REJECT_INSUFFICIENT_FUNDS {
+		t.Fatalf("Expected INSUFFICIENT_FUNDS rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	me.Deposit("bob", "USD", 2)
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 1, Quantity: 3})
+	if result.Status != engine.FILLED || len(result.Trades) != 3 {
+		t.Fatalf("Expected the buy to fill in 3 trades, got %s with %d", result.Status, len(result.Trades))
+	}
+	if b := balanceOf(t, me, "bob", "USD"); b.Available != 0 || b.Held != 0 {
+		t.Errorf("Expected bob to pay 3 for the BTC and 3 in fees, got %+v", b)
+	}
+
+	// Fees raised under a resting buy are capped at what it holds for them
+	me.Deposit("bob", "USD", 10020)
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 10000, Quantity: 1})
+	me.SetFeeSchedule(engine.FeeSchedule{MakerBps: 100, TakerBps: 100})
+	me.Deposit("alice", "BTC", 1)
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 10000, Quantity: 1})
+	if len(result.Trades) != 1 || result.Trades[0].MakerFee != 1 {
+		t.Fatalf("Expected one trade with the maker fee capped at 1, got %+v", result.Trades)
+	}
+	if b := balanceOf(t, me, "bob", "USD"); b.Available != 19 || b.Held != 0 {
+		t.Errorf("Expected bob to keep 19 USD, got %+v", b)
+	}
+	_, total, err := me.GetFeeRevenue()
+	if err != nil {
+		t.Fatalf("Failed to get fee revenue: %v", err)
+	}
+	if fees := balanceOf(t, me, engine.FeeAccountID, "USD"); fees.Available != total.Net {
+		t.Errorf("Expected the fee account to hold the %d of revenue, got %+v", total.Net, fees)
+	}
+}
+
+func TestFeeChangeWaitsForCommandsInProgress(t *testing.T) {
+	log := &blockingLog{entered: make(chan struct{}), release: make(chan struct{})}
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log))
+	defer me.Close()
+	me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 5)
+
+	// Stall a trade after its fees are worked out but before it is logged
+	log.armed.Store(true)
+	traded := make(chan *engine.OrderResult, 1)
+	go func() {
+		result, _ := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 5)
+		traded <- result
+	}()
+	<-log.entered
+
+	changed := make(chan error, 1)
+	go func() {
+		changed <- me.SetFeeSchedule(engine.FeeSchedule{TakerBps: 50})
+	}()
+	select {
+	case err := <-changed:
+		close(log.release)
+		t.Fatalf("Expected the fee change to wait for the trade, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(log.release)
+	if result := <-traded; len(result.Trades) != 1 || result.Trades[0].TakerFee != 0 {
+		t.Errorf("Expected one trade at the old fees, got %+v", result.Trades)
+	}
+	if err := <-changed; err != nil {
+		t.Fatalf("Failed to change fees: %v", err)
+	}
+}
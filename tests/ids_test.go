@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"order-matching-engine/internal/engine"
+)
+
+func TestSequentialIDGenerator(t *testing.T) {
+	ids := engine.NewSequentialIDGenerator("o-")
+	for _, want := range []string{"o-1", "o-2", "o-3"} {
+		if got := ids.NextID(); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestSnowflakeIDsIncrease(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+	ids, err := engine.NewSnowflakeIDGenerator(7, clock)
+	if err != nil {
+		t.Fatalf("Failed to create generator: %v", err)
+	}
+
+	// More IDs than fit in one millisecond, then the clock going back
+	last := int64(0)
+	for i := 0; i < 10000; i++ {
+		if i == 9000 {
+			clock.Advance(-time.Second)
+		}
+		id, err := strconv.ParseInt(ids.NextID(), 10, 64)
+		if err != nil {
+			t.Fatalf("Expected a numeric ID: %v", err)
+		}
+		if id <= last {
+			t.Fatalf("Expected ID %d to be above %d", id, last)
+		}
+		last = id
+	}
+
+	if _, err := engine.NewSnowflakeIDGenerator(engine.MaxSnowflakeNode+1, clock); err == nil {
+		t.Error("Expected a node out of range to be rejected")
+	}
+}
+
+func TestSnowflakeIDsUniqueAcrossGoroutines(t *testing.T) {
+	ids, _ := engine.NewSnowflakeIDGenerator(1, engine.SystemClock{})
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := ids.NextID()
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("Duplicate ID %s", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEngineIsDeterministic(t *testing.T) {
+	run := func() string {
+		clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+		me := engine.NewMatchingEngine(engine.WithClock(clock), engine.WithIDGenerator(engine.NewSequentialIDGenerator("")))
+		defer me.Close()
+
+		var results []any
+		for i, req := range []engine.OrderRequest{
+			{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 50100, Quantity: 5},
+			{AccountID: "alice", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 50000, Quantity: 5},
+			{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.STOP, StopPrice: 50050, Quantity: 3},
+			{AccountID: "bob", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 4},
+			{AccountID: "carol", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.MARKET, Quantity: 3},
+		} {
+			clock.Advance(time.Duration(i) * time.Millisecond)
+			result, err := me.Submit(req)
+			if err != nil {
+				t.Fatalf("Failed to submit order: %v", err)
+			}
+			results = append(results, result)
+		}
+
+		trades, _ := me.GetTrades("BTC-USD", 100)
+		book, _ := me.GetOrderBook("BTC-USD", 10)
+		data, err := json.Marshal([]any{results, trades, book})
+		if err != nil {
+			t.Fatalf("Failed to encode results: %v", err)
+		}
+		return string(data)
+	}
+
+	first, second := run(), run()
+	if first != second {
+		t.Errorf("Expected identical output for identical input:\n  %s\n  %s", first, second)
+	}
+}
@@ -0,0 +1,296 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+
+	"order-matching-engine/internal/engine"
+	"order-matching-engine/internal/journal"
+)
+
+// openJournal opens a journal in dir, failing the test on error
+func openJournal(t *testing.T, opts journal.Options) *journal.Journal {
+	t.Helper()
+	j, err := journal.Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	return j
+}
+
+// readJournal returns every record in a journal, checking they are numbered
+// from 1 without gaps
+func readJournal(t *testing.T, j *journal.Journal) []string {
+	t.Helper()
+	var records []string
+	err := j.Replay(1, func(seq uint64, data []byte) error {
+		if seq != uint64(len(records)+1) {
+			return fmt.Errorf("record %d out of order", seq)
+		}
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay journal: %v", err)
+	}
+	return records
+}
+
+// segmentFiles returns the journal's segment files, oldest first
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	return files
+}
+
+func TestJournalReopenAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, journal.Options{Dir: dir, Sync: journal.SyncAlways, SegmentSize: 100})
+	for i := 1; i <= 20; i++ {
+		seq, err := j.Append([]byte(fmt.Sprintf("record-%d", i)))
+		if err != nil || seq != uint64(i) {
+			t.Fatalf("Expected record %d, got %d (%v)", i, seq, err)
+		}
+	}
+	j.Close()
+
+	if n := len(segmentFiles(t, dir)); n < 2 {
+		t.Fatalf("Expected the journal to roll over to new segments, got %d", n)
+	}
+
+	j = openJournal(t, journal.Options{Dir: dir})
+	defer j.Close()
+
+	records := readJournal(t, j)
+	if len(records) != 20 || records[19] != "record-20" {
+		t.Fatalf("Expected 20 records back, got %d", len(records))
+	}
+	if seq, err := j.Append([]byte("record-21")); err != nil || seq != 21 {
+		t.Errorf("Expected appends to continue at 21, got %d (%v)", seq, err)
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, journal.Options{Dir: dir})
+	for i := 1; i <= 3; i++ {
+		seq, _ := j.Append([]byte(fmt.Sprintf("record-%d", i)))
+		j.Sync(seq)
+	}
+	j.Close()
+
+	// A crash partway through writing the last record
+	path := segmentFiles(t, dir)[0]
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("Failed to truncate segment: %v", err)
+	}
+
+	j = openJournal(t, journal.Options{Dir: dir})
+	defer j.Close()
+
+	if j.Truncated() == 0 {
+		t.Error("Expected the torn record to be reported as truncated")
+	}
+	if records := readJournal(t, j); len(records) != 2 {
+		t.Fatalf("Expected 2 intact records, got %d", len(records))
+	}
+	if seq, err := j.Append([]byte("record-3")); err != nil || seq != 3 {
+		t.Errorf("Expected the torn record's sequence number to be reused, got %d (%v)", seq, err)
+	}
+}
+
+func TestJournalCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, journal.Options{Dir: dir, Sync: journal.SyncAlways, SegmentSize: 60})
+	for i := 1; i <= 4; i++ {
+		j.Append([]byte(fmt.Sprintf("record-%d", i)))
+	}
+	j.Close()
+
+	flipLastByte := func(path string) {
+		data, _ := os.ReadFile(path)
+		data[len(data)-1] ^= 0xff
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("Failed to corrupt segment: %v", err)
+		}
+	}
+
+	// A bad checksum in the newest segment is cut off like a torn write
+	segments := segmentFiles(t, dir)
+	flipLastByte(segments[len(segments)-1])
+
+	j = openJournal(t, journal.Options{Dir: dir})
+	if records := readJournal(t, j); len(records) != 3 {
+		t.Fatalf("Expected 3 intact records, got %d", len(records))
+	}
+	j.Close()
+
+	// Damage in an older segment cannot be repaired by truncation
+	flipLastByte(segments[0])
+	if _, err := journal.Open(journal.Options{Dir: dir}); err == nil {
+		t.Error("Expected corruption before the tail to fail Open")
+	}
+}
+
+func TestJournalConcurrentBatchSync(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, journal.Options{Dir: dir, Sync: journal.SyncBatch, SegmentSize: 4096})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				seq, err := j.Append([]byte(fmt.Sprintf("worker-%d-%d", w, i)))
+				if err == nil {
+					err = j.Sync(seq)
+				}
+				if err != nil {
+					t.Errorf("Failed to append: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	j.Close()
+
+	j = openJournal(t, journal.Options{Dir: dir})
+	defer j.Close()
+	if records := readJournal(t, j); len(records) != 800 {
+		t.Errorf("Expected 800 records, got %d", len(records))
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	dir := t.TempDir()
+	opts := journal.Options{Dir: dir, SegmentSize: 1024}
+
+	j := openJournal(t, opts)
+	me := engine.NewMatchingEngine(engine.WithLedger(), engine.WithCommandLog(j))
+
+	me.Deposit("alice", "USD", 10000000)
+	me.Deposit("bob", "BTC", 100)
+	me.SetAccountRiskLimits("bob", engine.RiskLimits{MaxOrderQuantity: 50})
+
+	var ids []string
+	submit := func(req engine.OrderRequest) {
+		result, err := me.Submit(req)
+		if err != nil {
+			t.Fatalf("Failed to submit order: %v", err)
+		}
+		ids = append(ids, result.OrderID)
+	}
+
+	for i := 0; i < 5; i++ {
+		submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: int64(50000 - 100*i), Quantity: 10})
+		submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: int64(51000 + 100*i), Quantity: 10})
+	}
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 49900, Quantity: 15}) // trades
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 52000, Quantity: 60}) // risk rejection
+	submit(engine.OrderRequest{AccountID: "alice", Symbol: "ETH-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 3000, Quantity: 5})
+
+	if err := me.CancelOrder(ids[2]); err != nil {
+		t.Fatalf("Failed to cancel order: %v", err)
+	}
+	if _, err := me.ReplaceOrder(ids[3], 51050, 8); err != nil {
+		t.Fatalf("Failed to replace order: %v", err)
+	}
+	me.MassCancel(engine.CancelFilter{Symbol: "ETH-USD"})
+
+	before := captureState(t, me, ids)
+	me.Close()
+	j.Close()
+
+	// Rebuild a fresh engine from the journal
+	j = openJournal(t, opts)
+	defer j.Close()
+
+	// Records carry the log's own field names rather than Go's, so renaming
+	// a field cannot break replay
+	goName := regexp.MustCompile(`"[A-Z][A-Za-z]*":`)
+	for _, record := range readJournal(t, j) {
+		if name := goName.FindString(record); name != "" {
+			t.Errorf("Expected snake_case field names, got %s in %s", name, record)
+		}
+	}
+	recovered := engine.NewMatchingEngine(engine.WithLedger(), engine.WithCommandLog(j))
+	defer recovered.Close()
+
+	if err := j.Replay(1, func(seq uint64, data []byte) error {
+		return recovered.Replay(seq, data)
+	}); err != nil {
+		t.Fatalf("Failed to replay journal: %v", err)
+	}
+
+	after := captureState(t, recovered, ids)
+	for key, want := range before {
+		if after[key] != want {
+			t.Errorf("%s differs after recovery:\n  before: %s\n  after:  %s", key, want, after[key])
+		}
+	}
+
+	// The recovered engine keeps logging where the journal left off
+	last := j.LastSeq()
+	recovered.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 40000, Quantity: 1})
+	if j.LastSeq() != last+1 {
+		t.Errorf("Expected new commands to be appended after recovery")
+	}
+}
+
+// captureState renders the parts of an engine that recovery must reproduce
+func captureState(t *testing.T, me *engine.MatchingEngine, ids []string) map[string]string {
+	t.Helper()
+	state := make(map[string]string)
+	render := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Failed to encode state: %v", err)
+		}
+		return string(data)
+	}
+
+	for _, symbol := range []string{"BTC-USD", "ETH-USD"} {
+		snapshot, err := me.GetOrderBook(symbol, 100)
+		if err != nil {
+			t.Fatalf("Failed to get order book: %v", err)
+		}
+		state["book "+symbol] = render([2]any{snapshot.Bids, snapshot.Asks})
+
+		trades, err := me.GetTrades(symbol, 1000)
+		if err != nil {
+			t.Fatalf("Failed to get trades: %v", err)
+		}
+		state["trades "+symbol] = render(trades)
+
+		events, err := me.GetEvents(symbol, 0, 10000)
+		if err != nil {
+			t.Fatalf("Failed to get events: %v", err)
+		}
+		state["events "+symbol] = render(events)
+	}
+	for _, id := range ids {
+		// Cancelled orders are forgotten, so not found is state too
+		order, err := me.GetOrder(id)
+		if err != nil {
+			state["order "+id] = err.Error()
+			continue
+		}
+		state["order "+id] = render(order)
+	}
+	for _, account := range []string{"alice", "bob"} {
+		balances, _ := me.GetBalances(account)
+		state["balances "+account] = render(balances)
+	}
+	return state
+}
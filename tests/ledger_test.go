@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"sync"
+	"testing"
+
+	"order-matching-engine/internal/engine"
+)
+
+// balanceOf returns an account's balance of one asset
+func balanceOf(t *testing.T, me *engine.MatchingEngine, accountID, asset string) engine.Balance {
+	t.Helper()
+	balances, err := me.GetBalances(accountID)
+	if err != nil {
+		t.Fatalf("Failed to get balances: %v", err)
+	}
+	for _, b := range balances {
+		if b.Asset == asset {
+			return b
+		}
+	}
+	return engine.Balance{Asset: asset}
+}
+
+func TestLedgerHoldsAndSettlement(t *testing.T) {
+	me := engine.NewMatchingEngine(engine.WithLedger())
+	me.Deposit("alice", "USD", 1000000)
+	me.Deposit("bob", "BTC", 10)
+
+	// Limit buy holds price * quantity of the quote asset
+	buy, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 4})
+	if b := balanceOf(t, me, "alice", "USD"); b.Available != 800000 || b.Held != 200000 {
+		t.Errorf("Expected 200000 USD held, got %+v", b)
+	}
+
+	// Sell below the buy's limit: trades at the resting price
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 49000, Quantity: 3})
+
+	if b := balanceOf(t, me, "alice", "USD"); b.Available != 800000 || b.Held != 50000 {
+		t.Errorf("Expected 50000 USD still held for 1 BTC, got %+v", b)
+	}
+	if b := balanceOf(t, me, "alice", "BTC"); b.Available != 3 {
+		t.Errorf("Expected alice to receive 3 BTC, got %+v", b)
+	}
+	if b := balanceOf(t, me, "bob", "USD"); b.Available != 150000 {
+		t.Errorf("Expected bob to receive 150000 USD, got %+v", b)
+	}
+
+	// Cancelling releases the rest of the hold
+	if err := me.CancelOrder(buy.OrderID); err != nil {
+		t.Fatalf("Failed to cancel order: %v", err)
+	}
+	if b := balanceOf(t, me, "alice", "USD"); b.Available != 850000 || b.Held != 0 {
+		t.Errorf("Expected hold released, got %+v", b)
+	}
+
+	totals := me.AssetTotals()
+	if totals["USD"] != 1000000 || totals["BTC"] != 10 {
+		t.Errorf("Expected totals to be conserved, got %v", totals)
+	}
+}
+
+func TestLedgerInsufficientFunds(t *testing.T) {
+	me := engine.NewMatchingEngine(engine.WithLedger())
+	me.Deposit("alice", "USD", 100000)
+	me.Deposit("bob", "BTC", 5)
+
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 3})
+	if result.Status != engine.REJECTED || result.RejectReason != engine.REJECT_INSUFFICIENT_FUNDS {
+		t.Errorf("Expected INSUFFICIENT_FUNDS rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	// Market buy priced against the liquidity it would take
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 40000, Quantity: 2})
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 70000, Quantity: 2})
+
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.MARKET, Quantity: 3})
+	if result.Status != engine.REJECTED || result.RejectReason != engine.REJECT_INSUFFICIENT_FUNDS {
+		t.Errorf("Expected market buy costing 150000 to be rejected, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.MARKET, Quantity: 2})
+	if result.Status != engine.FILLED {
+		t.Errorf("Expected market buy costing 80000 to fill, got %s (%s)", result.Status, result.Message)
+	}
+	if b := balanceOf(t, me, "alice", "USD"); b.Available != 20000 || b.Held != 0 {
+		t.Errorf("Expected 20000 USD left and nothing held, got %+v", b)
+	}
+
+	if _, err := me.Withdraw("bob", "BTC", 2); err == nil {
+		t.Error("Expected withdrawal of held BTC to fail")
+	}
+}
+
+// recordingLog is an engine.CommandLog that keeps its records in memory
+type recordingLog struct {
+	mu      sync.Mutex
+	records [][]byte
+}
+
+func (l *recordingLog) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, append([]byte{}, data...))
+	return uint64(len(l.records)), nil
+}
+
+func (l *recordingLog) Sync(seq uint64) error {
+	return nil
+}
+
+func TestLedgerReplayRepeatsFundsDecisions(t *testing.T) {
+	log := &recordingLog{}
+	me := engine.NewMatchingEngine(engine.WithLedger(), engine.WithCommandLog(log))
+	defer me.Close()
+
+	// Rejected for want of funds that arrive just after
+	rejected, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 1})
+	me.Deposit("alice", "USD", 50000)
+
+	// Accepted, then cancelled to free the funds a withdrawal takes
+	accepted, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 1})
+	me.CancelOrder(accepted.OrderID)
+	if _, err := me.Withdraw("alice", "USD", 50000); err != nil {
+		t.Fatalf("Failed to withdraw: %v", err)
+	}
+
+	// Balances change outside the books, so a deposit or withdrawal can be
+	// logged ahead of a book command that happened before it
+	records := log.records
+	order := []int{1, 0, 2, 4, 3}
+	replayed := engine.NewMatchingEngine(engine.WithLedger())
+	defer replayed.Close()
+	for i, r := range order {
+		if err := replayed.Replay(uint64(i+1), records[r]); err != nil {
+			t.Fatalf("Failed to replay record %d: %v", r+1, err)
+		}
+	}
+
+	want, _ := me.GetAccountOrders("alice")
+	got, _ := replayed.GetAccountOrders("alice")
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d orders after replay, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Status != want[i].Status {
+			t.Errorf("Expected order %s %s after replay, got %s %s", want[i].ID, want[i].Status, got[i].ID, got[i].Status)
+		}
+	}
+	if want[0].ID != rejected.OrderID || want[0].Status != engine.REJECTED {
+		t.Errorf("Expected the first order rejected, got %s %s", want[0].ID, want[0].Status)
+	}
+	if b := balanceOf(t, replayed, "alice", "USD"); b.Available != 0 || b.Held != 0 {
+		t.Errorf("Expected no USD left after replay, got %+v", b)
+	}
+}
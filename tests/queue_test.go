@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"order-matching-engine/internal/engine"
+)
+
+// blockingLog is an engine.CommandLog that, once armed, parks the next
+// append until released. Appends run on the book's goroutine, so this holds
+// the book inside a command.
+type blockingLog struct {
+	armed   atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+	seq     atomic.Uint64
+}
+
+func (l *blockingLog) Append(data []byte) (uint64, error) {
+	if l.armed.CompareAndSwap(true, false) {
+		close(l.entered)
+		<-l.release
+	}
+	return l.seq.Add(1), nil
+}
+
+func (l *blockingLog) Sync(seq uint64) error {
+	return nil
+}
+
+func TestQueueFullBackpressure(t *testing.T) {
+	log := &blockingLog{entered: make(chan struct{}), release: make(chan struct{})}
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log), engine.WithQueueDepth(1))
+	defer me.Close()
+
+	bid, err := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 100)
+	if err != nil {
+		t.Fatalf("Failed to submit order: %v", err)
+	}
+
+	// Stall the book while it logs a sell that trades with the bid
+	log.armed.Store(true)
+	sold := make(chan error, 1)
+	go func() {
+		_, err := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 10)
+		sold <- err
+	}()
+	<-log.entered
+
+	// One query fits in the queue; the rest are turned away at once
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := me.GetOrderBook("AAPL", 10)
+			results <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-results; !errors.Is(err, engine.ErrQueueFull) {
+			t.Fatalf("Expected ErrQueueFull, got %v", err)
+		}
+	}
+
+	if _, err := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10100, 10); !errors.Is(err, engine.ErrQueueFull) {
+		t.Errorf("Expected submit to fail with ErrQueueFull, got %v", err)
+	}
+
+	// Other symbols have their own queue
+	if _, err := me.SubmitOrder("MSFT", engine.BUY, engine.LIMIT, 30000, 10); err != nil {
+		t.Errorf("Expected other symbols to keep accepting orders, got %v", err)
+	}
+
+	close(log.release)
+	if err := <-sold; err != nil {
+		t.Fatalf("Failed to submit sell order: %v", err)
+	}
+	if err := <-results; err != nil {
+		t.Errorf("Expected the queued query to complete, got %v", err)
+	}
+
+	// With the queue drained, commands are accepted again
+	if _, err := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 10); err != nil {
+		t.Fatalf("Expected submit to succeed after the queue drained, got %v", err)
+	}
+	order, err := me.GetOrder(bid.OrderID)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	if order.FilledQuantity != 20 {
+		t.Errorf("Expected 20 filled, got %d", order.FilledQuantity)
+	}
+}
+
+func TestCloseStopsBooks(t *testing.T) {
+	me := engine.NewMatchingEngine()
+
+	result, err := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 100)
+	if err != nil {
+		t.Fatalf("Failed to submit order: %v", err)
+	}
+
+	me.Close()
+	me.Close() // closing twice is harmless
+
+	if _, err := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 100); !errors.Is(err, engine.ErrEngineClosed) {
+		t.Errorf("Expected ErrEngineClosed for a submit after Close, got %v", err)
+	}
+	if err := me.CancelOrder(result.OrderID); !errors.Is(err, engine.ErrEngineClosed) {
+		t.Errorf("Expected ErrEngineClosed for a cancel after Close, got %v", err)
+	}
+
+	// Books created after Close refuse commands too
+	if _, err := me.GetOrderBook("MSFT", 10); !errors.Is(err, engine.ErrEngineClosed) {
+		t.Errorf("Expected ErrEngineClosed for a new symbol after Close, got %v", err)
+	}
+}
+
+func TestOpenOrderLimitIgnoresOtherQueues(t *testing.T) {
+	log := &blockingLog{entered: make(chan struct{}), release: make(chan struct{})}
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log), engine.WithQueueDepth(1))
+	defer me.Close()
+	me.SetAccountRiskLimits("alice", engine.RiskLimits{MaxOpenOrders: 2})
+
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 10})
+	me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 100)
+
+	// Stall AAPL and fill its queue
+	log.armed.Store(true)
+	sold := make(chan error, 1)
+	go func() {
+		_, err := me.SubmitOrder("AAPL", engine.SELL, engine.LIMIT, 10000, 10)
+		sold <- err
+	}()
+	<-log.entered
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := me.GetOrderBook("AAPL", 10)
+			results <- err
+		}()
+	}
+	if err := <-results; !errors.Is(err, engine.ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+
+	// Alice's AAPL order still counts, without asking the AAPL book
+	result, err := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "MSFT", Side: engine.BUY, Type: engine.LIMIT, Price: 30000, Quantity: 10})
+	if err != nil || result.Status != engine.ACCEPTED {
+		t.Errorf("Expected the MSFT order to be accepted, got %+v (%v)", result, err)
+	}
+	result, err = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "MSFT", Side: engine.BUY, Type: engine.LIMIT, Price: 30000, Quantity: 10})
+	if err != nil || result.RejectReason != engine.REJECT_MAX_OPEN_ORDERS {
+		t.Errorf("Expected MAX_OPEN_ORDERS rejection, got %+v (%v)", result, err)
+	}
+
+	close(log.release)
+	if err := <-sold; err != nil {
+		t.Fatalf("Failed to submit sell order: %v", err)
+	}
+	<-results
+}
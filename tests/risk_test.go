@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"order-matching-engine/internal/engine"
+)
+
+func TestRiskOrderQuantityAndNotional(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	me.SetSymbolRiskLimits("AAPL", engine.RiskLimits{MaxOrderQuantity: 1000, MaxNotional: 1000000})
+	me.SetAccountRiskLimits("alice", engine.RiskLimits{MaxOrderQuantity: 100})
+
+	// The account limit is stricter than the symbol limit
+	result, err := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 5000, Quantity: 150})
+	if err != nil {
+		t.Fatalf("Failed to submit order: %v", err)
+	}
+	if result.Status != engine.REJECTED || result.RejectReason != engine.REJECT_MAX_ORDER_QUANTITY {
+		t.Errorf("Expected MAX_ORDER_QUANTITY rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	// 300 * 5000 = 1,500,000 cents, over the symbol's notional limit
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 5000, Quantity: 300})
+	if result.Status != engine.REJECTED || result.RejectReason != engine.REJECT_MAX_NOTIONAL {
+		t.Errorf("Expected MAX_NOTIONAL rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	// Rejected orders never reach the book
+	if snapshot, _ := me.GetOrderBook("AAPL", 10); len(snapshot.Bids) != 0 {
+		t.Errorf("Expected empty book, got %+v", snapshot.Bids)
+	}
+}
+
+func TestRiskPriceCollar(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	me.SetSymbolRiskLimits("AAPL", engine.RiskLimits{PriceCollarBps: 500})
+
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 10000, Quantity: 10})
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10000, Quantity: 10})
+
+	// More than 5% above the last trade
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10600, Quantity: 10})
+	if result.RejectReason != engine.REJECT_PRICE_COLLAR {
+		t.Errorf("Expected PRICE_OUTSIDE_COLLAR rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	// Passive orders far from the market are fine
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 8000, Quantity: 10})
+	if result.Status != engine.ACCEPTED {
+		t.Errorf("Expected passive order to be accepted, got %s (%s)", result.Status, result.RejectReason)
+	}
+}
+
+func TestRiskOpenOrdersAndPosition(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	me.SetAccountRiskLimits("alice", engine.RiskLimits{MaxOpenOrders: 2, MaxPosition: 50})
+
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 10})
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "MSFT", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 10})
+
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 10})
+	if result.RejectReason != engine.REJECT_MAX_OPEN_ORDERS {
+		t.Errorf("Expected MAX_OPEN_ORDERS rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	// Filling one order frees a slot and builds a long position of 10
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 9000, Quantity: 10})
+
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 8000, Quantity: 45})
+	if result.RejectReason != engine.REJECT_MAX_POSITION {
+		t.Errorf("Expected MAX_POSITION rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 8000, Quantity: 40})
+	if result.Status != engine.ACCEPTED {
+		t.Errorf("Expected order within limits to be accepted, got %s (%s)", result.Status, result.RejectReason)
+	}
+}
+
+func TestRiskPositionCountsLiveOrders(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	me.SetAccountRiskLimits("alice", engine.RiskLimits{MaxPosition: 50})
+
+	// Two resting buys of 30 could take the position to 60 between them
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 30})
+	if result.Status != engine.ACCEPTED {
+		t.Fatalf("Expected first buy to be accepted, got %s (%s)", result.Status, result.RejectReason)
+	}
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 30})
+	if result.RejectReason != engine.REJECT_MAX_POSITION {
+		t.Errorf("Expected MAX_POSITION rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+
+	// Sells are measured against the position alone, not the resting buy
+	result, _ = me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 9500, Quantity: 50})
+	if result.Status != engine.ACCEPTED {
+		t.Errorf("Expected sell within limits to be accepted, got %s (%s)", result.Status, result.RejectReason)
+	}
+}
+
+func TestRiskLimitsHoldUnderConcurrentSubmits(t *testing.T) {
+	me := engine.NewMatchingEngine()
+	defer me.Close()
+	me.SetAccountRiskLimits("alice", engine.RiskLimits{MaxOpenOrders: 1})
+	me.SetAccountRiskLimits("bob", engine.RiskLimits{MaxPosition: 10})
+
+	// Each order goes to a different book, so nothing serialises them but
+	// the limits themselves
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			symbol := fmt.Sprintf("SYM%d", i)
+			me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: symbol, Side: engine.BUY, Type: engine.LIMIT, Price: 100, Quantity: 1})
+			me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 100 + int64(i), Quantity: 4})
+		}(i)
+	}
+	wg.Wait()
+
+	for account, want := range map[string]int{"alice": 1, "bob": 2} {
+		orders, _ := me.GetAccountOrders(account)
+		live := 0
+		for _, order := range orders {
+			if order.Status == engine.ACCEPTED {
+				live++
+			}
+		}
+		if live != want {
+			t.Errorf("Expected %d live orders for %s, got %d", want, account, live)
+		}
+	}
+}
+
+func TestRiskChecksOnReplace(t *testing.T) {
+	log := &recordingLog{}
+	me := engine.NewMatchingEngine(engine.WithCommandLog(log))
+	defer me.Close()
+	me.SetAccountRiskLimits("alice", engine.RiskLimits{MaxOrderQuantity: 100, MaxOpenOrders: 1, MaxPosition: 50, PriceCollarBps: 1000})
+	me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "AAPL", Side: engine.SELL, Type: engine.LIMIT, Price: 10000, Quantity: 1})
+	me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 10000, Quantity: 1})
+	placed, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "AAPL", Side: engine.BUY, Type: engine.LIMIT, Price: 9000, Quantity: 10})
+
+	tests := []struct {
+		price, quantity int64
+		want            engine.RejectReason
+	}{
+		{0, 1000, engine.REJECT_MAX_ORDER_QUANTITY},
+		{12000, 0, engine.REJECT_PRICE_COLLAR},
+		{0, 60, engine.REJECT_MAX_POSITION},
+		// The order's own quantity and slot are not counted twice
+		{9500, 49, ""},
+	}
+	for _, tt := range tests {
+		result, err := me.ReplaceOrder(placed.OrderID, tt.price, tt.quantity)
+		if err != nil {
+			t.Fatalf("Failed to replace: %v", err)
+		}
+		if result.RejectReason != tt.want {
+			t.Errorf("Replacing with price %d quantity %d: expected %q, got %s (%s)", tt.price, tt.quantity, tt.want, result.Status, result.RejectReason)
+		}
+	}
+	if order, _ := me.GetOrder(placed.OrderID); order.Price != 9500 || order.Quantity != 49 {
+		t.Errorf("Expected only the last amendment applied, got %d at %d", order.Quantity, order.Price)
+	}
+
+	// Replay reaches the same decisions, even with the limits lifted first
+	replayed := engine.NewMatchingEngine()
+	defer replayed.Close()
+	for i, record := range log.records {
+		if err := replayed.Replay(uint64(i+1), record); err != nil {
+			t.Fatalf("Failed to replay record %d: %v", i+1, err)
+		}
+		if i == 0 {
+			replayed.SetAccountRiskLimits("alice", engine.RiskLimits{})
+		}
+	}
+	if order, _ := replayed.GetOrder(placed.OrderID); order.Price != 9500 || order.Quantity != 49 {
+		t.Errorf("Expected the replayed order at 49 for 9500, got %d at %d", order.Quantity, order.Price)
+	}
+}
+
+func TestCustomRiskChecker(t *testing.T) {
+	halted := engine.RiskCheckerFunc(func(order engine.Order, ctx engine.RiskContext) *engine.RiskRejection {
+		if order.Symbol == "HALT" {
+			return &engine.RiskRejection{Reason: "SYMBOL_HALTED", Message: "trading is halted"}
+		}
+		return nil
+	})
+	me := engine.NewMatchingEngine(engine.WithRiskChecker(halted))
+
+	result, _ := me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "HALT", Side: engine.BUY, Type: engine.LIMIT, Price: 100, Quantity: 1})
+	if result.RejectReason != "SYMBOL_HALTED" {
+		t.Errorf("Expected custom rejection, got %s (%s)", result.Status, result.RejectReason)
+	}
+}
@@ -0,0 +1,390 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"order-matching-engine/internal/engine"
+	"order-matching-engine/internal/journal"
+	"order-matching-engine/internal/snapshot"
+)
+
+// fillSnapshotEngine puts an engine with a ledger through a mix of commands
+// that leave state in every part of it. Returns the IDs of the orders.
+func fillSnapshotEngine(t *testing.T, me *engine.MatchingEngine, expireAt int64) []string {
+	t.Helper()
+
+	me.Deposit("alice", "USD", 100000000)
+	me.Deposit("bob", "BTC", 1000)
+	me.SetFeeSchedule(engine.FeeSchedule{MakerBps: -1, TakerBps: 5})
+	me.SetFeeSchedule(engine.FeeSchedule{Tier: "VIP", MakerBps: -2, TakerBps: 3})
+	me.SetAccountFeeTier("alice", "VIP")
+	me.SetSelfTradePrevention("bob", engine.STP_CANCEL_OLDEST)
+	me.SetSymbolRiskLimits("BTC-USD", engine.RiskLimits{MaxOrderQuantity: 500})
+
+	var ids []string
+	submit := func(req engine.OrderRequest) {
+		t.Helper()
+		result, err := me.Submit(req)
+		if err != nil {
+			t.Fatalf("Failed to submit order: %v", err)
+		}
+		ids = append(ids, result.OrderID)
+	}
+
+	// A queue of three at one price, an iceberg and a GTD bid below it
+	for i := 0; i < 3; i++ {
+		submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 50000, Quantity: 10})
+	}
+	submit(engine.OrderRequest{AccountID: "alice", ClientOrderID: "iceberg-1", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 49900, Quantity: 10, DisplayQuantity: 3})
+	submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 49800, Quantity: 5, TimeInForce: engine.GTD, ExpireAt: expireAt})
+
+	// A partial fill of the front of the queue, a resting ask, stops and a
+	// risk rejection
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 50000, Quantity: 4})
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 51000, Quantity: 10})
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.STOP, StopPrice: 45000, Quantity: 1})
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.TRAILING_STOP, TrailAmount: 500, Quantity: 1})
+	submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 52000, Quantity: 600})
+
+	submit(engine.OrderRequest{AccountID: "alice", Symbol: "ETH-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 3000, Quantity: 5})
+	me.CancelOrder(ids[len(ids)-1])
+
+	return ids
+}
+
+// compareEngines fails the test where the state of two engines differs
+func compareEngines(t *testing.T, want, got *engine.MatchingEngine, ids []string) {
+	t.Helper()
+
+	before, after := captureState(t, want, ids), captureState(t, got, ids)
+	for key, value := range before {
+		if after[key] != value {
+			t.Errorf("%s differs:\n  want: %s\n  got:  %s", key, value, after[key])
+		}
+	}
+
+	for _, account := range []string{"alice", "bob"} {
+		wantTrades, _ := want.GetAccountTrades(account)
+		gotTrades, _ := got.GetAccountTrades(account)
+		if fmt.Sprint(wantTrades) != fmt.Sprint(gotTrades) {
+			t.Errorf("Trades of %s differ:\n  want: %v\n  got:  %v", account, wantTrades, gotTrades)
+		}
+	}
+
+	wantBySymbol, wantRevenue, err := want.GetFeeRevenue()
+	if err != nil {
+		t.Fatalf("Failed to get fee revenue: %v", err)
+	}
+	gotBySymbol, gotRevenue, err := got.GetFeeRevenue()
+	if err != nil {
+		t.Fatalf("Failed to get fee revenue: %v", err)
+	}
+	if wantRevenue != gotRevenue || fmt.Sprint(wantBySymbol) != fmt.Sprint(gotBySymbol) {
+		t.Errorf("Fee revenue differs: want %+v %+v, got %+v %+v", wantRevenue, wantBySymbol, gotRevenue, gotBySymbol)
+	}
+}
+
+// riskProbe is a risk checker that rejects orders with the client order ID
+// "probe" and keeps what it was told about them
+type riskProbe struct {
+	seen engine.RiskContext
+}
+
+func (p *riskProbe) Check(order engine.Order, ctx engine.RiskContext) *engine.RiskRejection {
+	if order.ClientOrderID != "probe" {
+		return nil
+	}
+	p.seen = ctx
+	return &engine.RiskRejection{Reason: "PROBE", Message: "probe"}
+}
+
+// probeRisk returns what the risk checks know about account in symbol
+func probeRisk(t *testing.T, me *engine.MatchingEngine, probe *riskProbe, account, symbol string) string {
+	t.Helper()
+	result, err := me.Submit(engine.OrderRequest{AccountID: account, ClientOrderID: "probe", Symbol: symbol, Side: engine.BUY, Type: engine.LIMIT, Price: 1, Quantity: 1})
+	if err != nil || result.RejectReason != "PROBE" {
+		t.Fatalf("Expected the probe to be rejected, got %+v (%v)", result, err)
+	}
+	return fmt.Sprintf("open=%d position=%d", probe.seen.OpenOrders, probe.seen.Position)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	probe := &riskProbe{}
+	me := engine.NewMatchingEngine(engine.WithLedger(), engine.WithClock(clock), engine.WithRiskChecker(probe))
+	defer me.Close()
+	ids := fillSnapshotEngine(t, me, start.Add(time.Hour).UnixMilli())
+
+	var buf bytes.Buffer
+	if _, err := me.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	restoredClock := &fakeClock{now: start}
+	restoredProbe := &riskProbe{}
+	restored := engine.NewMatchingEngine(engine.WithLedger(), engine.WithClock(restoredClock), engine.WithRiskChecker(restoredProbe))
+	defer restored.Close()
+	if _, err := restored.LoadSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	compareEngines(t, me, restored, ids)
+
+	// The fake clocks have not moved, so move both on before new IDs are
+	// issued or the restored engine would hand out those already in use
+	clock.Advance(time.Millisecond)
+	restoredClock.Advance(time.Millisecond)
+
+	// Risk checks see the same open orders and positions
+	for _, account := range []string{"alice", "bob"} {
+		want, got := probeRisk(t, me, probe, account, "BTC-USD"), probeRisk(t, restored, restoredProbe, account, "BTC-USD")
+		if want != got || want == "open=0 position=0" {
+			t.Errorf("Risk state of %s differs after restore: want %s, got %s", account, want, got)
+		}
+	}
+
+	if order, err := restored.GetOrderByClientID("alice", "iceberg-1"); err != nil || order.ID != ids[3] {
+		t.Errorf("Expected client order IDs to survive the snapshot, got %v (%v)", order, err)
+	}
+
+	// Both engines carry on identically: the sweep takes the queue in the
+	// same order, the iceberg shows the same slices, stops and expiry fire
+	// the same way
+	sweep := engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 49900, Quantity: 30}
+	makers := func(m *engine.MatchingEngine) string {
+		result, err := m.Submit(sweep)
+		if err != nil {
+			t.Fatalf("Failed to submit order: %v", err)
+		}
+		var fills []string
+		for _, trade := range result.Trades {
+			fills = append(fills, fmt.Sprintf("%s:%d@%d", trade.MakerOrderID, trade.Quantity, trade.Price))
+		}
+		return fmt.Sprint(fills)
+	}
+	if want, got := makers(me), makers(restored); want != got {
+		t.Errorf("Sweep differs after restore:\n  want: %s\n  got:  %s", want, got)
+	}
+
+	clock.Advance(2 * time.Hour)
+	restoredClock.Advance(2 * time.Hour)
+	if want, got := me.ExpireOrders(), restored.ExpireOrders(); fmt.Sprint(want) != fmt.Sprint(got) || len(want) != 1 {
+		t.Errorf("Expected the GTD order to expire in both engines, got %v and %v", want, got)
+	}
+
+	for _, id := range ids {
+		wantOrder, wantErr := me.GetOrder(id)
+		gotOrder, gotErr := restored.GetOrder(id)
+		if fmt.Sprint(wantErr) != fmt.Sprint(gotErr) || (wantOrder != nil && (wantOrder.Status != gotOrder.Status || wantOrder.FilledQuantity != gotOrder.FilledQuantity)) {
+			t.Errorf("Order %s differs after trading on: want %+v, got %+v", id, wantOrder, gotOrder)
+		}
+	}
+}
+
+func TestLoadSnapshotRejectsBadInput(t *testing.T) {
+	me := engine.NewMatchingEngine(engine.WithLedger())
+	defer me.Close()
+	fillSnapshotEngine(t, me, time.Now().Add(time.Hour).UnixMilli())
+
+	var buf bytes.Buffer
+	if _, err := me.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	data := buf.Bytes()
+
+	// A flipped byte fails the checksum and leaves the engine untouched
+	damaged := append([]byte{}, data...)
+	damaged[len(damaged)/2] ^= 0xff
+	fresh := engine.NewMatchingEngine(engine.WithLedger())
+	defer fresh.Close()
+	if _, err := fresh.LoadSnapshot(bytes.NewReader(damaged)); err == nil {
+		t.Error("Expected a damaged snapshot to be rejected")
+	}
+	if book, _ := fresh.GetOrderBook("BTC-USD", 10); len(book.Bids) != 0 {
+		t.Errorf("Expected a rejected snapshot to change nothing, got bids %v", book.Bids)
+	}
+
+	// The ledger setting must match
+	if _, err := engine.NewMatchingEngine().LoadSnapshot(bytes.NewReader(data)); err == nil {
+		t.Error("Expected a ledger snapshot to be rejected by an engine without a ledger")
+	}
+
+	// Snapshots only go into new engines
+	if _, err := me.LoadSnapshot(bytes.NewReader(data)); err == nil {
+		t.Error("Expected loading into an engine with state to fail")
+	}
+}
+
+// persistentEngine is an engine logging to a journal in dir, with
+// snapshots stored alongside
+type persistentEngine struct {
+	me          *engine.MatchingEngine
+	journal     *journal.Journal
+	store       *snapshot.Store
+	snapshotter *snapshot.Snapshotter
+}
+
+// openPersistentEngine recovers an engine from dir
+func openPersistentEngine(t *testing.T, dir string) (*persistentEngine, uint64, int) {
+	t.Helper()
+	p := &persistentEngine{journal: openJournal(t, journal.Options{Dir: dir, SegmentSize: 512})}
+	p.me = engine.NewMatchingEngine(engine.WithLedger(), engine.WithCommandLog(p.journal))
+
+	var err error
+	if p.store, err = snapshot.OpenStore(filepath.Join(dir, "snapshots"), 0); err != nil {
+		t.Fatalf("Failed to open snapshot store: %v", err)
+	}
+	snapshotSeq, replayed, err := snapshot.Recover(p.store, p.me, p.journal)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if p.snapshotter, err = snapshot.NewSnapshotter(p.store, p.me, p.journal); err != nil {
+		t.Fatalf("Failed to create snapshotter: %v", err)
+	}
+	return p, snapshotSeq, replayed
+}
+
+func (p *persistentEngine) close() {
+	p.me.Close()
+	p.journal.Close()
+}
+
+func TestSnapshotRecoveryCompactsJournal(t *testing.T) {
+	dir := t.TempDir()
+	p, _, _ := openPersistentEngine(t, dir)
+	ids := fillSnapshotEngine(t, p.me, time.Now().Add(time.Hour).UnixMilli())
+
+	first, err := p.snapshotter.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	if first != p.journal.LastSeq() {
+		t.Errorf("Expected the snapshot to cover record %d, got %d", p.journal.LastSeq(), first)
+	}
+
+	// More activity, a second snapshot, and a tail after it
+	for i := 0; i < 10; i++ {
+		result, _ := p.me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: int64(48000 - i), Quantity: 1})
+		ids = append(ids, result.OrderID)
+	}
+	if _, err := p.snapshotter.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		result, _ := p.me.Submit(engine.OrderRequest{AccountID: "bob", Symbol: "BTC-USD", Side: engine.SELL, Type: engine.LIMIT, Price: 53000, Quantity: 1})
+		ids = append(ids, result.OrderID)
+	}
+
+	// Segments before the older kept snapshot are gone
+	segments := segmentFiles(t, dir)
+	if oldest := filepath.Base(segments[0]); oldest == fmt.Sprintf("%020d.wal", 1) {
+		t.Errorf("Expected the journal to be compacted, oldest segment is %s", oldest)
+	}
+
+	want := captureState(t, p.me, ids)
+	p.close()
+
+	recovered, snapshotSeq, replayed := openPersistentEngine(t, dir)
+	defer recovered.close()
+	if replayed != 3 {
+		t.Errorf("Expected only the 3 commands after the snapshot at %d to be replayed, got %d", snapshotSeq, replayed)
+	}
+	got := captureState(t, recovered.me, ids)
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s differs after recovery:\n  want: %s\n  got:  %s", key, value, got[key])
+		}
+	}
+}
+
+func TestSnapshotRecoveryFallsBackToOlderSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	p, _, _ := openPersistentEngine(t, dir)
+	ids := fillSnapshotEngine(t, p.me, time.Now().Add(time.Hour).UnixMilli())
+	p.snapshotter.Snapshot()
+	result, _ := p.me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 47000, Quantity: 1})
+	ids = append(ids, result.OrderID)
+	latest, _ := p.snapshotter.Snapshot()
+	want := captureState(t, p.me, ids)
+	p.close()
+
+	// Damage the newest snapshot
+	path := filepath.Join(dir, "snapshots", fmt.Sprintf("%020d.snap", latest))
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	recovered, snapshotSeq, replayed := openPersistentEngine(t, dir)
+	defer recovered.close()
+	if snapshotSeq == latest || replayed != 1 {
+		t.Errorf("Expected recovery from the older snapshot plus 1 command, got snapshot %d and %d commands", snapshotSeq, replayed)
+	}
+	got := captureState(t, recovered.me, ids)
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s differs after recovery:\n  want: %s\n  got:  %s", key, value, got[key])
+		}
+	}
+}
+
+func TestSnapshotCommandCountTrigger(t *testing.T) {
+	dir := t.TempDir()
+	p, _, _ := openPersistentEngine(t, dir)
+	defer p.close()
+
+	stop := p.snapshotter.Start(0, 5)
+	defer stop()
+
+	p.me.Deposit("alice", "USD", 1000000)
+	for i := 0; i < 5; i++ {
+		p.me.Submit(engine.OrderRequest{AccountID: "alice", Symbol: "BTC-USD", Side: engine.BUY, Type: engine.LIMIT, Price: 100, Quantity: 1})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		seqs, err := p.store.Sequences()
+		if err != nil {
+			t.Fatalf("Failed to list snapshots: %v", err)
+		}
+		if len(seqs) > 0 {
+			if seqs[0] < 5 {
+				t.Errorf("Expected a snapshot after at least 5 commands, got one at %d", seqs[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a snapshot once 5 commands were logged")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSnapshotRefusedAfterLogFailure(t *testing.T) {
+	me := engine.NewMatchingEngine(engine.WithCommandLog(failingLog{}))
+	defer me.Close()
+
+	if _, err := me.SubmitOrder("AAPL", engine.BUY, engine.LIMIT, 10000, 10); !errors.Is(err, engine.ErrCommandLogFailed) {
+		t.Fatalf("Expected ErrCommandLogFailed, got %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := me.WriteSnapshot(&buf); !errors.Is(err, engine.ErrCommandLogFailed) {
+		t.Errorf("Expected no snapshot of state the log does not have, got %v", err)
+	}
+}
+
+// failingLog is an engine.CommandLog whose writes always fail
+type failingLog struct{}
+
+func (failingLog) Append(data []byte) (uint64, error) {
+	return 0, errors.New("disk full")
+}
+
+func (failingLog) Sync(seq uint64) error {
+	return nil
+}